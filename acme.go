@@ -0,0 +1,728 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	acmeDefaultDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+	acmeDefaultStorage   = "acme"
+	acmeChallengePath    = "/.well-known/acme-challenge/"
+	acmeALPNProto        = "acme-tls/1"
+
+	// acmeCheckInterval is how often certificates are checked for renewal;
+	// a failed attempt is retried after acmeRetryInterval instead.
+	acmeCheckInterval = 12 * time.Hour
+	acmeRetryInterval = 10 * time.Minute
+	acmeTimeout       = 5 * time.Minute // for one whole issuance
+)
+
+// acmePollInterval spaces out polls of pending authorizations and orders.
+var acmePollInterval = time.Second
+
+// idPeACMEIdentifier is the certificate extension carrying the TLS-ALPN-01
+// key authorization digest, RFC 8737.
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// Pending challenges are process wide: HTTP-01 is answered by whichever http
+// server receives the validation request, not only the https server that
+// wants the certificate.
+var (
+	acmeHTTPTokens sync.Map // token -> key authorization
+	acmeALPNCerts  sync.Map // host name -> *tls.Certificate
+)
+
+// serveACMEChallenge answers HTTP-01 validation requests for pending
+// challenges. It returns false when r is not one, so the request is routed as
+// usual.
+func serveACMEChallenge(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.URL.Path, acmeChallengePath)
+	if !ok || r.Method != http.MethodGet {
+		return false
+	}
+	keyAuth, ok := acmeHTTPTokens.Load(token)
+	if !ok {
+		return false
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, keyAuth)
+	return true
+}
+
+// acmeALPNConfig answers TLS-ALPN-01 validation handshakes, which offer only
+// the acme-tls/1 protocol, with the challenge certificate for the name. Every
+// other handshake continues with the server's own config.
+func acmeALPNConfig(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if len(hello.SupportedProtos) != 1 || hello.SupportedProtos[0] != acmeALPNProto {
+		return nil, nil
+	}
+	cert, ok := acmeALPNCerts.Load(normalizeHost(hello.ServerName))
+	if !ok {
+		return nil, fmt.Errorf("no pending ACME challenge for '%v'", hello.ServerName)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert.(*tls.Certificate)},
+		NextProtos:   []string{acmeALPNProto},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// acmeALPNCertificate builds the self-signed TLS-ALPN-01 challenge
+// certificate for name.
+func acmeALPNCertificate(name, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(keyAuth))
+	extValue, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:    serial,
+		Subject:         pkix.Name{CommonName: name},
+		DNSNames:        []string{name},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: idPeACMEIdentifier, Critical: true, Value: extValue}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// acmeDir returns where this server keeps its ACME state. Each directory URL
+// gets its own subdirectory, so certificates from a staging or test CA are
+// never served once the config points at the real one.
+func (this *Server) acmeDir() string {
+	storage := this.ACMEStorage
+	if storage == "" {
+		storage = acmeDefaultStorage
+	}
+	directory := this.ACMEDirectory
+	if directory == "" {
+		directory = acmeDefaultDirectory
+	}
+	name := directory
+	if u, err := url.Parse(directory); err == nil && u.Host != "" {
+		name = u.Host
+	}
+	return filepath.Join(storage, strings.NewReplacer(":", "_", "/", "_").Replace(name))
+}
+
+func (this *Server) acmeCertPaths(host *Host) (certPath, keyPath string) {
+	dir := filepath.Join(this.acmeDir(), host.Name)
+	return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+}
+
+// prepareACME validates an ACME host and loads the certificate stored by an
+// earlier run, if any. A missing or expired certificate is not an error: it is
+// obtained once the server is listening.
+func (this *Server) prepareACME(host *Host) error {
+	switch this.ACMEChallenge {
+	case "", "tls-alpn-01", "http-01":
+	default:
+		return fmt.Errorf("Invalid acme_challenge '%v'", this.ACMEChallenge)
+	}
+	for _, name := range host.names() {
+		if strings.HasPrefix(name, "*") {
+			return fmt.Errorf("ACME cannot issue wildcard name '%v'", name)
+		}
+	}
+	if host.Disabled {
+		return nil
+	}
+	certPath, keyPath := this.acmeCertPaths(host)
+	keyPair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Failed to load stored ACME certificate, obtaining a new one",
+				"host", host.Name, "server", this.Name, "path", certPath, "err", err)
+		}
+		return nil
+	}
+	host.certificate.Store(&keyPair)
+	return nil
+}
+
+// acmeNeedsRenewal reports whether cert is missing or has less than a third
+// of its lifetime left, the margin Let's Encrypt recommends.
+func acmeNeedsRenewal(cert *tls.Certificate, now time.Time) bool {
+	if cert == nil || cert.Leaf == nil {
+		return true
+	}
+	lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)
+	return cert.Leaf.NotAfter.Sub(now) < lifetime/3
+}
+
+// manageACME obtains and renews the certificates of hosts until done is
+// closed. The account it registers is its own, so a server the admin API
+// restarts never shares one with the goroutine of its previous run.
+func (this *Server) manageACME(hosts []*Host, done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+	var client *acmeClient
+	for {
+		next := acmeCheckInterval
+		for _, host := range hosts {
+			if stopped(done) {
+				return
+			}
+			if !acmeNeedsRenewal(host.certificate.Load(), time.Now()) {
+				continue
+			}
+			var err error
+			if client, err = this.obtainCertificate(ctx, client, host, done); err != nil {
+				mu.Lock()
+				if stopped(done) {
+					mu.Unlock()
+					return
+				}
+				host.Status = fmt.Sprintf("%v for host: %v, server: %v, %v", err, host.Name, this.Name, this.Listen)
+				mu.Unlock()
+				slog.Error("Failed to obtain ACME certificate", "host", host.Name, "server", this.Name, "err", err)
+				next = acmeRetryInterval
+				// the account may be what failed; register afresh next time
+				client = nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next):
+		}
+	}
+}
+
+// obtainCertificate runs one ACME issuance for host with client, registering
+// a client first when it is nil, and returns the client for the next one.
+// The result is stored and served under mu, unless done was closed in the
+// meantime.
+func (this *Server) obtainCertificate(ctx context.Context, client *acmeClient, host *Host, done <-chan struct{}) (*acmeClient, error) {
+	ctx, cancel := context.WithTimeout(ctx, acmeTimeout)
+	defer cancel()
+	if client == nil {
+		var err error
+		if client, err = this.newACMEClient(ctx); err != nil {
+			return nil, err
+		}
+	}
+	challenge := this.ACMEChallenge
+	if challenge == "" {
+		challenge = "tls-alpn-01"
+	}
+	slog.Info("Obtaining ACME certificate", "host", host.Name, "server", this.Name, "challenge", challenge)
+	certPEM, keyPEM, err := client.obtain(ctx, host.names(), challenge)
+	if err != nil {
+		return client, err
+	}
+	keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return client, err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if stopped(done) {
+		return client, nil
+	}
+	certPath, keyPath := this.acmeCertPaths(host)
+	if err := writeFileAtomic(keyPath, keyPEM, 0600); err != nil {
+		return client, err
+	}
+	if err := writeFileAtomic(certPath, certPEM, 0644); err != nil {
+		return client, err
+	}
+	host.certificate.Store(&keyPair)
+	host.Status = ""
+	slog.Info("Obtained ACME certificate", "host", host.Name, "server", this.Name, "not_after", keyPair.Leaf.NotAfter)
+	return client, nil
+}
+
+// writeFileAtomic writes to a temp file and renames it into place, creating
+// the directory if needed, so readers never see a half written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// newACMEClient loads or creates the account key and registers the account,
+// which returns the existing account when the key is already registered.
+func (this *Server) newACMEClient(ctx context.Context) (*acmeClient, error) {
+	directory := this.ACMEDirectory
+	if directory == "" {
+		directory = acmeDefaultDirectory
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if this.ACMECAPath != "" {
+		caPEM, err := os.ReadFile(this.ACMECAPath)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in acme_ca_path '%v'", this.ACMECAPath)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	}
+	key, err := loadOrCreateKey(filepath.Join(this.acmeDir(), "account.key"))
+	if err != nil {
+		return nil, err
+	}
+	client := &acmeClient{
+		directoryURL: directory,
+		http:         &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		key:          key,
+	}
+	if err := client.register(ctx, this.ACMEEmail); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// loadOrCreateKey reads a PEM encoded P-256 key, generating and storing a new
+// one when the file does not exist yet.
+func loadOrCreateKey(path string) (*ecdsa.PrivateKey, error) {
+	keyPEM, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(keyPEM)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data in '%v'", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// acmeClient is a minimal RFC 8555 client: one account, ES256 signatures,
+// and the HTTP-01 and TLS-ALPN-01 challenges.
+type acmeClient struct {
+	directoryURL string
+	http         *http.Client
+	key          *ecdsa.PrivateKey
+	kid          string // account URL, set by register
+	nonce        string // the last Replay-Nonce received, used once
+	directory    struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+}
+
+// acmeProblem is an RFC 7807 problem document returned by the CA.
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (this *acmeProblem) Error() string {
+	return fmt.Sprintf("acme: %v: %v", this.Type, this.Detail)
+}
+
+type acmeOrder struct {
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []struct {
+		Type   string       `json:"type"`
+		URL    string       `json:"url"`
+		Token  string       `json:"token"`
+		Status string       `json:"status"`
+		Error  *acmeProblem `json:"error"`
+	} `json:"challenges"`
+}
+
+func (this *acmeClient) register(ctx context.Context, email string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, this.directoryURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := this.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("acme: directory '%v' returned %v", this.directoryURL, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&this.directory); err != nil {
+		return fmt.Errorf("acme: decoding directory: %v", err)
+	}
+
+	account := map[string]any{"termsOfServiceAgreed": true}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	_, header, err := this.post(ctx, this.directory.NewAccount, account, nil)
+	if err != nil {
+		return err
+	}
+	this.kid = header.Get("Location")
+	if this.kid == "" {
+		return errors.New("acme: account response carries no Location")
+	}
+	return nil
+}
+
+// obtain orders a certificate for names, completes the challenges and
+// returns the certificate chain and its new private key, both PEM encoded.
+func (this *acmeClient) obtain(ctx context.Context, names []string, challenge string) (certPEM, keyPEM []byte, err error) {
+	identifiers := make([]map[string]string, 0, len(names))
+	for _, name := range names {
+		identifiers = append(identifiers, map[string]string{"type": "dns", "value": strings.ToLower(name)})
+	}
+	var order acmeOrder
+	_, header, err := this.post(ctx, this.directory.NewOrder, map[string]any{"identifiers": identifiers}, &order)
+	if err != nil {
+		return nil, nil, err
+	}
+	orderURL := header.Get("Location")
+
+	for _, authzURL := range order.Authorizations {
+		if err := this.authorize(ctx, authzURL, challenge); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := this.pollOrder(ctx, orderURL, &order, "pending"); err != nil {
+		return nil, nil, err
+	}
+	if order.Status != "ready" {
+		return nil, nil, fmt.Errorf("acme: order is %v, want ready", order.Status)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: strings.ToLower(names[0])},
+		DNSNames: identifierValues(identifiers),
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, _, err := this.post(ctx, order.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}, &order); err != nil {
+		return nil, nil, err
+	}
+	if err := this.pollOrder(ctx, orderURL, &order, "processing"); err != nil {
+		return nil, nil, err
+	}
+	if order.Status != "valid" {
+		return nil, nil, fmt.Errorf("acme: order is %v, want valid", order.Status)
+	}
+
+	certPEM, _, err = this.post(ctx, order.Certificate, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+func identifierValues(identifiers []map[string]string) []string {
+	values := make([]string, 0, len(identifiers))
+	for _, identifier := range identifiers {
+		values = append(values, identifier["value"])
+	}
+	return values
+}
+
+// authorize publishes the answer to one authorization's challenge, asks the
+// CA to validate it and waits for the verdict.
+func (this *acmeClient) authorize(ctx context.Context, authzURL, challengeType string) error {
+	var authz acmeAuthorization
+	if _, _, err := this.post(ctx, authzURL, nil, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil // still valid from an earlier order
+	}
+	name := authz.Identifier.Value
+	index := -1
+	for i, challenge := range authz.Challenges {
+		if challenge.Type == challengeType {
+			index = i
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("acme: no %v challenge offered for '%v'", challengeType, name)
+	}
+	challenge := authz.Challenges[index]
+	thumbprint, err := jwkThumbprint(&this.key.PublicKey)
+	if err != nil {
+		return err
+	}
+	keyAuth := challenge.Token + "." + thumbprint
+
+	switch challengeType {
+	case "http-01":
+		acmeHTTPTokens.Store(challenge.Token, keyAuth)
+		defer acmeHTTPTokens.Delete(challenge.Token)
+	case "tls-alpn-01":
+		cert, err := acmeALPNCertificate(name, keyAuth)
+		if err != nil {
+			return err
+		}
+		acmeALPNCerts.Store(name, cert)
+		defer acmeALPNCerts.Delete(name)
+	}
+
+	if _, _, err := this.post(ctx, challenge.URL, map[string]any{}, nil); err != nil {
+		return err
+	}
+	for {
+		if _, _, err := this.post(ctx, authzURL, nil, &authz); err != nil {
+			return err
+		}
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "pending", "processing":
+		default:
+			for _, c := range authz.Challenges {
+				if c.Type == challengeType && c.Error != nil {
+					return fmt.Errorf("acme: %v for '%v' failed: %w", challengeType, name, c.Error)
+				}
+			}
+			return fmt.Errorf("acme: authorization for '%v' is %v", name, authz.Status)
+		}
+		if err := sleepContext(ctx, acmePollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// pollOrder refreshes order until it leaves the given status.
+func (this *acmeClient) pollOrder(ctx context.Context, orderURL string, order *acmeOrder, status string) error {
+	for order.Status == status {
+		if err := sleepContext(ctx, acmePollInterval); err != nil {
+			return err
+		}
+		if _, _, err := this.post(ctx, orderURL, nil, order); err != nil {
+			return err
+		}
+	}
+	if order.Status == "invalid" && order.Error != nil {
+		return order.Error
+	}
+	return nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// post sends a JWS signed request, or a POST-as-GET when payload is nil, and
+// decodes a JSON response into out when given. A rejected nonce is retried
+// with the fresh one the CA sends along with the rejection.
+func (this *acmeClient) post(ctx context.Context, postURL string, payload any, out any) ([]byte, http.Header, error) {
+	var payloadJSON []byte
+	if payload != nil {
+		var err error
+		if payloadJSON, err = json.Marshal(payload); err != nil {
+			return nil, nil, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		if this.nonce == "" {
+			if err := this.fetchNonce(ctx); err != nil {
+				return nil, nil, err
+			}
+		}
+		body, err := this.sign(postURL, this.nonce, payloadJSON)
+		if err != nil {
+			return nil, nil, err
+		}
+		this.nonce = ""
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, postURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		resp, err := this.http.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		this.nonce = resp.Header.Get("Replay-Nonce")
+		respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode >= 400 {
+			problem := &acmeProblem{Status: resp.StatusCode}
+			if json.Unmarshal(respBody, problem) != nil || problem.Type == "" {
+				problem.Type, problem.Detail = "unknown", resp.Status
+			}
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt < 2 {
+				continue
+			}
+			return nil, nil, problem
+		}
+		if out != nil {
+			if err := json.Unmarshal(respBody, out); err != nil {
+				return nil, nil, fmt.Errorf("acme: decoding response from '%v': %v", postURL, err)
+			}
+		}
+		return respBody, resp.Header, nil
+	}
+}
+
+func (this *acmeClient) fetchNonce(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, this.directory.NewNonce, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := this.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	this.nonce = resp.Header.Get("Replay-Nonce")
+	if this.nonce == "" {
+		return errors.New("acme: newNonce returned no Replay-Nonce")
+	}
+	return nil
+}
+
+// sign wraps payload in a flattened JWS. Requests before registration carry
+// the account's public key, later ones the account URL.
+func (this *acmeClient) sign(postURL, nonce string, payload []byte) ([]byte, error) {
+	protected := map[string]any{"alg": "ES256", "nonce": nonce, "url": postURL}
+	if this.kid != "" {
+		protected["kid"] = this.kid
+	} else {
+		jwk, err := ecJWK(&this.key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		protected["jwk"] = jwk
+	}
+	protectedJSON, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	encodedProtected := base64.RawURLEncoding.EncodeToString(protectedJSON)
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(encodedProtected + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, this.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	// JWS wants the fixed size r||s form, not ASN.1
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return json.Marshal(map[string]string{
+		"protected": encodedProtected,
+		"payload":   encodedPayload,
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+// ecJWK returns the JWK of a P-256 public key, with its members in the
+// lexical order the RFC 7638 thumbprint requires.
+func ecJWK(pub *ecdsa.PublicKey) (map[string]string, error) {
+	point, err := pub.Bytes() // 0x04 || x || y
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   base64.RawURLEncoding.EncodeToString(point[1:33]),
+		"y":   base64.RawURLEncoding.EncodeToString(point[33:]),
+	}, nil
+}
+
+// jwkThumbprint returns the RFC 7638 thumbprint of the account key, the
+// second half of every key authorization.
+func jwkThumbprint(pub *ecdsa.PublicKey) (string, error) {
+	jwk, err := ecJWK(pub)
+	if err != nil {
+		return "", err
+	}
+	// json.Marshal sorts map keys, which is the canonical form
+	canonical, err := json.Marshal(jwk)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(canonical)
+	return base64.RawURLEncoding.EncodeToString(digest[:]), nil
+}
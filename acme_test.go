@@ -0,0 +1,535 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeACME is just enough of an RFC 8555 CA to drive a whole issuance: it
+// checks every JWS signature and nonce, validates challenges against the
+// address goweb listens on, and signs the CSR with its own root.
+type fakeACME struct {
+	t      *testing.T
+	srv    *httptest.Server
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+	caPath string // the directory's TLS root, for acme_ca_path
+
+	target atomic.Value // host:port the challenges are validated against
+
+	mu       sync.Mutex
+	nonces   map[string]bool
+	accounts map[string]*ecdsa.PublicKey // kid -> key
+	orders   map[string]*fakeOrder
+	issued   int
+}
+
+type fakeOrder struct {
+	names  []string
+	status string
+	authz  string // "pending" or "valid"
+	token  string
+	thumb  string
+	cert   []byte
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	t.Helper()
+	ca := &fakeACME{
+		t:        t,
+		nonces:   map[string]bool{},
+		accounts: map[string]*ecdsa.PublicKey{},
+		orders:   map[string]*fakeOrder{},
+	}
+	var err error
+	ca.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake acme root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &ca.caKey.PublicKey, ca.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.caCert, _ = x509.ParseCertificate(der)
+
+	ca.srv = httptest.NewTLSServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.srv.Close)
+	ca.caPath = filepath.Join(t.TempDir(), "acme-root.pem")
+	rootPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.srv.Certificate().Raw})
+	if err := os.WriteFile(ca.caPath, rootPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func (this *fakeACME) directoryURL() string { return this.srv.URL + "/dir" }
+
+func (this *fakeACME) setTarget(addr string) {
+	this.target.Store(addr)
+}
+
+func (this *fakeACME) issuedCount() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.issued
+}
+
+func (this *fakeACME) newNonce(w http.ResponseWriter) {
+	nonce := fmt.Sprint(time.Now().UnixNano())
+	this.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+}
+
+func (this *fakeACME) problem(w http.ResponseWriter, status int, kind, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:" + kind, "detail": detail})
+}
+
+// verify checks a JWS request and returns its payload and account kid.
+func (this *fakeACME) verify(r *http.Request) (payload []byte, kid string, jwk map[string]string, err error) {
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, "", nil, err
+	}
+	protectedJSON, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  map[string]string
+	}
+	if err := json.Unmarshal(protectedJSON, &protected); err != nil {
+		return nil, "", nil, err
+	}
+	if !this.nonces[protected.Nonce] {
+		return nil, "", nil, fmt.Errorf("badNonce")
+	}
+	delete(this.nonces, protected.Nonce)
+	if protected.URL != this.srv.URL+r.URL.Path {
+		return nil, "", nil, fmt.Errorf("url %q does not match %q", protected.URL, r.URL.Path)
+	}
+	var pub *ecdsa.PublicKey
+	if protected.Kid != "" {
+		pub = this.accounts[protected.Kid]
+	} else if protected.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(protected.JWK["x"])
+		y, _ := base64.RawURLEncoding.DecodeString(protected.JWK["y"])
+		pub, _ = ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+	}
+	if pub == nil || protected.Alg != "ES256" {
+		return nil, "", nil, fmt.Errorf("unknown key")
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(signature) != 64 || !ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return nil, "", nil, fmt.Errorf("bad signature")
+	}
+	payload, _ = base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload, protected.Kid, protected.JWK, nil
+}
+
+func (this *fakeACME) serve(w http.ResponseWriter, r *http.Request) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	base := this.srv.URL
+	if r.URL.Path == "/dir" {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce": base + "/nonce", "newAccount": base + "/account", "newOrder": base + "/order",
+		})
+		return
+	}
+	this.newNonce(w)
+	if r.URL.Path == "/nonce" {
+		return
+	}
+	payload, kid, jwk, err := this.verify(r)
+	if err != nil {
+		kind := "malformed"
+		if err.Error() == "badNonce" {
+			kind = "badNonce"
+		}
+		this.problem(w, http.StatusBadRequest, kind, err.Error())
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch parts[0] {
+	case "account":
+		kid = fmt.Sprintf("%v/acct/%v", base, len(this.accounts)+1)
+		x, _ := base64.RawURLEncoding.DecodeString(jwk["x"])
+		y, _ := base64.RawURLEncoding.DecodeString(jwk["y"])
+		this.accounts[kid], _ = ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+		w.Header().Set("Location", kid)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"status":"valid"}`)
+	case "order":
+		if len(parts) == 1 {
+			var req struct{ Identifiers []struct{ Value string } }
+			json.Unmarshal(payload, &req)
+			id := fmt.Sprint(len(this.orders) + 1)
+			order := &fakeOrder{status: "pending", authz: "pending", token: "token" + id}
+			for _, identifier := range req.Identifiers {
+				order.names = append(order.names, identifier.Value)
+			}
+			order.thumb = thumbprintOf(this.t, this.accounts[kid])
+			this.orders[id] = order
+			w.Header().Set("Location", base+"/order/"+id)
+			w.WriteHeader(http.StatusCreated)
+		}
+		this.writeOrder(w, parts)
+	case "authz":
+		order := this.orders[parts[1]]
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":     order.authz,
+			"identifier": map[string]string{"type": "dns", "value": order.names[0]},
+			"challenges": []map[string]string{
+				{"type": "http-01", "url": base + "/chal/" + parts[1] + "/http-01", "token": order.token},
+				{"type": "tls-alpn-01", "url": base + "/chal/" + parts[1] + "/tls-alpn-01", "token": order.token},
+			},
+		})
+	case "chal":
+		order := this.orders[parts[1]]
+		keyAuth := order.token + "." + order.thumb
+		if err := this.validate(parts[2], order.names[0], order.token, keyAuth); err != nil {
+			this.t.Logf("fake ACME validation failed: %v", err)
+			order.authz = "invalid"
+		} else {
+			order.authz = "valid"
+			order.status = "ready"
+		}
+		fmt.Fprint(w, `{"status":"processing"}`)
+	case "finalize":
+		order := this.orders[parts[1]]
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || csr.CheckSignature() != nil {
+			this.problem(w, http.StatusBadRequest, "badCSR", fmt.Sprint(err))
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(100 + len(this.orders))),
+			Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		certDER, err := x509.CreateCertificate(rand.Reader, template, this.caCert, csr.PublicKey, this.caKey)
+		if err != nil {
+			this.problem(w, http.StatusInternalServerError, "serverInternal", err.Error())
+			return
+		}
+		order.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: this.caCert.Raw})...)
+		order.status = "valid"
+		this.issued++
+		this.writeOrder(w, []string{"order", parts[1]})
+	case "cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(this.orders[parts[1]].cert)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (this *fakeACME) writeOrder(w http.ResponseWriter, parts []string) {
+	id := fmt.Sprint(len(this.orders))
+	if len(parts) > 1 {
+		id = parts[1]
+	}
+	order := this.orders[id]
+	body := map[string]any{
+		"status":         order.status,
+		"authorizations": []string{this.srv.URL + "/authz/" + id},
+		"finalize":       this.srv.URL + "/finalize/" + id,
+	}
+	if order.status == "valid" {
+		body["certificate"] = this.srv.URL + "/cert/" + id
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// validate plays the CA's side of a challenge against the target address.
+func (this *fakeACME) validate(kind, name, token, keyAuth string) error {
+	// the test learns the address only once Start returns, which may be
+	// after the server already asked for validation
+	deadline := time.Now().Add(5 * time.Second)
+	for this.target.Load() == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	target, _ := this.target.Load().(string)
+	switch kind {
+	case "http-01":
+		client := newTestClient(target, false)
+		resp, err := client.Get("http://" + name + acmeChallengePath + token)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != keyAuth {
+			return fmt.Errorf("http-01 answered %q, want %q", body, keyAuth)
+		}
+		return nil
+	case "tls-alpn-01":
+		conn, err := tls.Dial("tcp", target, &tls.Config{
+			ServerName: name, NextProtos: []string{acmeALPNProto}, InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		if state.NegotiatedProtocol != acmeALPNProto {
+			return fmt.Errorf("negotiated %q, want %q", state.NegotiatedProtocol, acmeALPNProto)
+		}
+		want, _ := asn1.Marshal(sha256Of(keyAuth))
+		for _, ext := range state.PeerCertificates[0].Extensions {
+			if ext.Id.Equal(idPeACMEIdentifier) && ext.Critical && string(ext.Value) == string(want) {
+				return nil
+			}
+		}
+		return fmt.Errorf("no acmeIdentifier extension with the key authorization")
+	}
+	return fmt.Errorf("unknown challenge %v", kind)
+}
+
+func sha256Of(s string) []byte {
+	digest := sha256.Sum256([]byte(s))
+	return digest[:]
+}
+
+func thumbprintOf(t *testing.T, pub *ecdsa.PublicKey) string {
+	thumbprint, err := jwkThumbprint(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return thumbprint
+}
+
+// issuerOf returns the common name of the issuer of the certificate served
+// for name.
+func issuerOf(t *testing.T, addr, name string) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Issuer.CommonName
+}
+
+func fastACMEPolling(t *testing.T) {
+	old := acmePollInterval
+	acmePollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { acmePollInterval = old })
+}
+
+func TestACMEObtainsCertificateWithTLSALPN(t *testing.T) {
+	fastACMEPolling(t)
+	ca := newFakeACME(t)
+	storage := t.TempDir()
+	newServer := func() *Server {
+		return &Server{
+			Name:          "test-https",
+			Type:          "https",
+			Listen:        "127.0.0.1:0",
+			ACMEDirectory: ca.directoryURL(),
+			ACMECAPath:    ca.caPath,
+			ACMEStorage:   storage,
+			Hosts:         []*Host{{Name: "secure.example.com", Type: "301_redirect", RedirectURL: "https://elsewhere.example.com", ACME: true}},
+		}
+	}
+
+	// The server starts with no certificate at all: the challenge can only
+	// be answered once it listens.
+	server := newServer()
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() = %v, want nil", err)
+	}
+	ca.setTarget(server.listener.Addr().String())
+	addr := server.listener.Addr().String()
+	waitFor(t, "the ACME certificate", func() bool {
+		// read the server as the admin API does while the issuance goes on
+		mu.Lock()
+		json.Marshal(server)
+		mu.Unlock()
+		return issuerOf(t, addr, "secure.example.com") == "fake acme root"
+	})
+	server.Shutdown()
+
+	certPath, keyPath := server.acmeCertPaths(server.Hosts[0])
+	if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+		t.Fatalf("stored certificate: %v", err)
+	}
+	if server.Hosts[0].Status != "" {
+		t.Errorf("host Status = %q, want empty", server.Hosts[0].Status)
+	}
+
+	// A restart serves the stored certificate instead of ordering another.
+	server = newServer()
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() after restart = %v, want nil", err)
+	}
+	defer server.Shutdown()
+	if got := issuerOf(t, server.listener.Addr().String(), "secure.example.com"); got != "fake acme root" {
+		t.Errorf("after restart the certificate is issued by %q, want the stored one", got)
+	}
+	if got := ca.issuedCount(); got != 1 {
+		t.Errorf("the CA issued %v certificates, want 1", got)
+	}
+}
+
+// HTTP-01 is validated on port 80, so it is answered by the http server, not
+// by the https server that wants the certificate.
+func TestACMEObtainsCertificateWithHTTP01(t *testing.T) {
+	fastACMEPolling(t)
+	ca := newFakeACME(t)
+	plain := &Server{Name: "test-http", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{redirectHost("secure.example.com")}}
+	startTestServer(t, plain)
+	ca.setTarget(plain.listener.Addr().String())
+
+	server := &Server{
+		Name:          "test-https",
+		Type:          "https",
+		Listen:        "127.0.0.1:0",
+		ACMEDirectory: ca.directoryURL(),
+		ACMECAPath:    ca.caPath,
+		ACMEStorage:   t.TempDir(),
+		ACMEChallenge: "http-01",
+		Hosts:         []*Host{{Name: "secure.example.com", Type: "301_redirect", RedirectURL: "https://elsewhere.example.com", ACME: true}},
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() = %v, want nil", err)
+	}
+	defer server.Shutdown()
+	addr := server.listener.Addr().String()
+	waitFor(t, "the ACME certificate", func() bool { return issuerOf(t, addr, "secure.example.com") == "fake acme root" })
+}
+
+func TestServeACMEChallenge(t *testing.T) {
+	acmeHTTPTokens.Store("known", "known.thumbprint")
+	defer acmeHTTPTokens.Delete("known")
+
+	rec := httptest.NewRecorder()
+	if !serveACMEChallenge(rec, httptest.NewRequest(http.MethodGet, acmeChallengePath+"known", nil)) {
+		t.Fatal("serveACMEChallenge() = false for a pending token, want true")
+	}
+	if got := rec.Body.String(); got != "known.thumbprint" {
+		t.Errorf("body = %q, want the key authorization", got)
+	}
+	for _, path := range []string{acmeChallengePath + "unknown", "/known"} {
+		if serveACMEChallenge(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil)) {
+			t.Errorf("serveACMEChallenge(%v) = true, want the request routed as usual", path)
+		}
+	}
+}
+
+func TestACMENeedsRenewal(t *testing.T) {
+	now := time.Now()
+	withLifetime := func(issued, expires time.Time) *tls.Certificate {
+		return &tls.Certificate{Leaf: &x509.Certificate{NotBefore: issued, NotAfter: expires}}
+	}
+	cases := []struct {
+		name string
+		cert *tls.Certificate
+		want bool
+	}{
+		{"missing", nil, true},
+		{"fresh", withLifetime(now, now.Add(90*24*time.Hour)), false},
+		{"half way", withLifetime(now.Add(-45*24*time.Hour), now.Add(45*24*time.Hour)), false},
+		{"last third", withLifetime(now.Add(-70*24*time.Hour), now.Add(20*24*time.Hour)), true},
+		{"expired", withLifetime(now.Add(-100*24*time.Hour), now.Add(-time.Hour)), true},
+	}
+	for _, c := range cases {
+		if got := acmeNeedsRenewal(c.cert, now); got != c.want {
+			t.Errorf("%v: acmeNeedsRenewal() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestStartRejectsInvalidACMEHosts(t *testing.T) {
+	cases := []struct {
+		name   string
+		server *Server
+		want   string
+	}{
+		{"wildcard", &Server{Hosts: []*Host{{Name: "*.example.com", Type: "301_redirect", ACME: true}}}, "wildcard"},
+		{"unknown challenge", &Server{ACMEChallenge: "dns-01", Hosts: []*Host{{Name: "a.example.com", Type: "301_redirect", ACME: true}}}, "Invalid acme_challenge"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := c.server
+			server.Name, server.Type, server.Listen, server.ACMEStorage = "test-https", "https", "127.0.0.1:0", t.TempDir()
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %q, want it to mention %q", err, c.want)
+			}
+		})
+	}
+}
+
+// The JWS signature is the one part a CA cannot be lenient about; check it
+// round-trips through the public key in its own protected header.
+func TestACMESignIsVerifiable(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &acmeClient{key: key}
+	body, err := client.sign("https://ca.example.com/new-acct", "nonce-1", []byte(`{"a":1}`))
+	if err != nil {
+		t.Fatalf("sign() = %v", err)
+	}
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.Unmarshal(body, &jws); err != nil {
+		t.Fatal(err)
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if !ecdsa.Verify(&key.PublicKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		t.Error("signature does not verify")
+	}
+	protected, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	for _, want := range []string{`"alg":"ES256"`, `"nonce":"nonce-1"`, `"url":"https://ca.example.com/new-acct"`, `"jwk":{`} {
+		if !strings.Contains(string(protected), want) {
+			t.Errorf("protected header %s, want it to contain %s", protected, want)
+		}
+	}
+}
@@ -235,6 +235,72 @@ func adminMux() (*http.ServeMux, error) {
 		}
 	})
 
+	mux.HandleFunc("/api/upstreams/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(secret, w, r) {
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			// health of the running reverse_proxy upstreams
+			states := []upstreamState{}
+			mu.Lock()
+			for _, server := range servers {
+				states = append(states, server.upstreamStates()...)
+			}
+			mu.Unlock()
+			json.NewEncoder(w).Encode(states)
+		}
+	})
+
+	mux.HandleFunc("/api/groups/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(secret, w, r) {
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			// weights of the running upstream groups
+			states := []groupState{}
+			mu.Lock()
+			for _, server := range servers {
+				states = append(states, server.groupStates()...)
+			}
+			mu.Unlock()
+			json.NewEncoder(w).Encode(states)
+		case http.MethodPatch:
+			// change the weights of a host's upstream groups, without
+			// restarting its server
+			var update groupWeights
+			if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+				writeErr(w, r, http.StatusBadRequest, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			var target *Host
+			for _, server := range servers {
+				if server.Name != update.Server || server.done == nil {
+					continue
+				}
+				for _, h := range server.Hosts {
+					if h.Name == update.Host && !h.Disabled {
+						target = h
+					}
+				}
+			}
+			if target == nil {
+				writeErr(w, r, http.StatusNotFound, fmt.Errorf("Host '%v' is not running on server '%v'", update.Host, update.Server))
+				return
+			}
+			if err := target.setGroupWeights(update.Weights); err != nil {
+				writeErr(w, r, http.StatusBadRequest, err)
+				return
+			}
+			slog.Info("Admin changed upstream group weights", "client", clientIP(r.RemoteAddr), "server", update.Server, "host", update.Host, "weights", update.Weights)
+			fmt.Fprint(w, "{}")
+		}
+	})
+
 	return mux, nil
 }
 
@@ -245,13 +311,21 @@ func StartAdmin() error {
 	if err != nil {
 		return err
 	}
+	trusted, err := parseTrustedProxies(adminTrustedProxies)
+	if err != nil {
+		return fmt.Errorf("%v in GOWEB_ADMIN_TRUSTED_PROXIES", err)
+	}
+	var handler http.Handler = mux
+	if len(trusted) > 0 {
+		handler = trusted.realClient(mux)
+	}
 
 	listener, err := net.Listen("tcp", listen)
 	if err != nil {
 		return err
 	}
 	srv := &http.Server{
-		Handler:           mux,
+		Handler:           handler,
 		ReadHeaderTimeout: readHeaderTimeout,
 		IdleTimeout:       idleTimeout,
 		ErrorLog:          httpErrorLog(),
@@ -201,6 +201,9 @@ func TestAdminAPIRequiresToken(t *testing.T) {
 		{http.MethodPost, "/api/servers/"},
 		{http.MethodPatch, "/api/servers/"},
 		{http.MethodPost, "/api/server/"},
+		{http.MethodGet, "/api/upstreams/"},
+		{http.MethodGet, "/api/groups/"},
+		{http.MethodPatch, "/api/groups/"},
 	} {
 		resp := adminDo(t, admin, c.method, c.path, "wrong-token", "[]")
 		if resp.StatusCode != http.StatusUnauthorized {
@@ -242,6 +245,43 @@ func TestAdminGetServers(t *testing.T) {
 	}
 }
 
+func TestAdminGetUpstreams(t *testing.T) {
+	admin := newAdminServer(t)
+	healthy, _ := checkedServer(t, "healthy")
+	sick, sickFlag := checkedServer(t, "sick")
+	sickFlag.Store(true)
+	checked := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: healthy.URL + " " + sick.URL,
+		HealthCheckPath: "/healthz", HealthCheckInterval: "10ms", HealthCheckFall: 1,
+	}}}
+	startTestServer(t, checked)
+	unchecked := &Server{Name: "plain", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: healthy.URL,
+	}}}
+	startTestServer(t, unchecked)
+	stopped := &Server{Name: "stopped", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: healthy.URL,
+	}}}
+	servers = []*Server{checked, unchecked, stopped}
+
+	var states []upstreamState
+	waitFor(t, "the sick upstream reported down and the healthy one checked", func() bool {
+		resp := adminDo(t, admin, http.MethodGet, "/api/upstreams/", adminToken, "")
+		states = nil
+		json.Unmarshal([]byte(bodyString(t, resp)), &states)
+		return len(states) == 3 && !states[1].Healthy && states[0].LastCheck != nil
+	})
+	if !states[0].Healthy || !states[0].Checked || states[0].URL != healthy.URL || states[0].LastCheck == nil {
+		t.Errorf("healthy upstream = %+v, want it checked and healthy", states[0])
+	}
+	if states[1].LastError != "unexpected status 503" {
+		t.Errorf("last_error = %q, want the failed check's reason", states[1].LastError)
+	}
+	if states[2].Server != "plain" || states[2].Checked || !states[2].Healthy {
+		t.Errorf("unchecked upstream = %+v, want it reported healthy and unchecked", states[2])
+	}
+}
+
 func TestAdminSaveWritesConfigFile(t *testing.T) {
 	admin := newAdminServer(t)
 	config := []*Server{{Name: "web", Type: "http", Listen: "[::]:80", Hosts: []*Host{redirectHost("a.example.com")}}}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// certPollInterval is how often cert_path and key_path are checked for
+// changes. A variable so tests can poll faster.
+var certPollInterval = 30 * time.Second
+
+// certExpiryWarning is how close to expiry a loaded certificate is logged as
+// a warning instead of plain information.
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// loadCertificate loads the host's cert_path/key_path pair and starts serving
+// it, clearing any degradation the host had from earlier failures. The files'
+// stamp is recorded even when loading fails, so an unchanged broken pair is
+// not retried on every poll.
+func (this *Server) loadCertificate(host *Host) error {
+	host.certStamp = certFilesStamp(host.CertPath, host.KeyPath)
+	keyPair, err := tls.LoadX509KeyPair(host.CertPath, host.KeyPath)
+	if err != nil {
+		return err
+	}
+	// Status is cleared before the store is published, so whoever sees the
+	// new certificate also sees the host healthy.
+	host.Status = ""
+	host.certificate.Store(&keyPair)
+	return nil
+}
+
+// certFilesStamp identifies the current version of a certificate and key
+// pair by modification time and size, or "" when either file is missing.
+func certFilesStamp(certPath, keyPath string) string {
+	stamp := ""
+	for _, path := range []string{certPath, keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return ""
+		}
+		stamp += fmt.Sprintf("%v/%v;", info.ModTime().UnixNano(), info.Size())
+	}
+	return stamp
+}
+
+// logCertificate logs which certificate a host serves and when it expires,
+// warning when that is soon or already past.
+func (this *Server) logCertificate(msg string, host *Host) {
+	cert := host.certificate.Load()
+	if cert == nil || cert.Leaf == nil {
+		return
+	}
+	notAfter := cert.Leaf.NotAfter
+	level := slog.LevelInfo
+	if time.Until(notAfter) < certExpiryWarning {
+		level = slog.LevelWarn
+	}
+	slog.Log(context.Background(), level, msg, "host", host.Name, "server", this.Name,
+		"subject", cert.Leaf.Subject.CommonName, "not_after", notAfter.Format(time.RFC3339))
+}
+
+// watchCertificates reloads the certificates of hosts whenever their files
+// change, until done is closed. A pair that fails to load keeps the previous
+// certificate in service and degrades the host; a later valid pair clears
+// the degradation again.
+func (this *Server) watchCertificates(hosts []*Host, done <-chan struct{}) {
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		this.reloadCertificates(hosts, done)
+	}
+}
+
+// reloadCertificates is one pass of watchCertificates. It holds mu, under
+// which the admin API reads the hosts' status, and does nothing once done
+// is closed.
+func (this *Server) reloadCertificates(hosts []*Host, done <-chan struct{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if stopped(done) {
+		return
+	}
+	for _, host := range hosts {
+		if certFilesStamp(host.CertPath, host.KeyPath) == host.certStamp {
+			continue
+		}
+		if err := this.loadCertificate(host); err != nil {
+			host.Status = fmt.Sprintf("%v for host: %v, server: %v, %v", err, host.Name, this.Name, this.Listen)
+			level := slog.LevelError
+			if host.Disabled {
+				level = slog.LevelWarn
+			}
+			slog.Log(context.Background(), level, "Failed to reload certificate",
+				"host", host.Name, "server", this.Name, "listen", this.Listen, "err", err)
+			continue
+		}
+		this.logCertificate("Certificate reloaded", host)
+	}
+}
+
+// getCertificate picks the certificate of the host the SNI name routes to,
+// with the same precedence as request routing, so clients connecting by IP
+// get the default host's certificate. A host without a certificate of its
+// own — its files failed to load — gets any other host's certificate that
+// covers the name, or failing that the first one loaded, as crypto/tls would
+// pick from a static certificate list.
+func (this *Server) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := this.routeHost(normalizeHost(hello.ServerName))
+	if host != nil && !host.Disabled {
+		if cert := host.certificate.Load(); cert != nil {
+			return cert, nil
+		}
+	}
+	var first *tls.Certificate
+	for _, host := range this.Hosts {
+		cert := host.certificate.Load()
+		if cert == nil {
+			continue
+		}
+		if first == nil {
+			first = cert
+		}
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	if first == nil {
+		return nil, errors.New("no certificate available")
+	}
+	return first, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fastCertPolling makes watchCertificates poll every few milliseconds for
+// the rest of the test.
+func fastCertPolling(t *testing.T) {
+	old := certPollInterval
+	certPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { certPollInterval = old })
+}
+
+// servedCertificate returns the leaf certificate the server presents for
+// serverName.
+func servedCertificate(t *testing.T, addr, serverName string) []byte {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TLS handshake for %v: %v", serverName, err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Raw
+}
+
+// A renewed pair written over the old files is served on the next poll,
+// without a restart and on the same listener.
+func TestCertificateReloadsOnChange(t *testing.T) {
+	fastCertPolling(t)
+	dir := t.TempDir()
+	certPath, keyPath := writeSelfSignedCert(t, dir, "a.example.com")
+	host := redirectHost("a.example.com")
+	host.CertPath, host.KeyPath = certPath, keyPath
+	server := &Server{Name: "edge", Type: "https", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() = %v, want nil", err)
+	}
+	defer server.Shutdown()
+	addr := server.listener.Addr().String()
+	before := servedCertificate(t, addr, "a.example.com")
+
+	writeSelfSignedCert(t, dir, "a.example.com")
+	waitFor(t, "the renewed certificate to be served", func() bool {
+		return !bytes.Equal(servedCertificate(t, addr, "a.example.com"), before)
+	})
+	if server.listener.Addr().String() != addr {
+		t.Error("listener changed, want the reload to keep it")
+	}
+}
+
+// A host that started degraded because its files were missing recovers as
+// soon as they appear: its own certificate is served and its Status clears.
+func TestCertificateReloadRecoversDegradedHost(t *testing.T) {
+	fastCertPolling(t)
+	dir := t.TempDir()
+	goodCert, goodKey := writeSelfSignedCert(t, dir, "good.example.com")
+	good := redirectHost("good.example.com")
+	good.CertPath, good.KeyPath = goodCert, goodKey
+	late := redirectHost("late.example.com")
+	late.CertPath = filepath.Join(dir, "late.example.com.crt")
+	late.KeyPath = filepath.Join(dir, "late.example.com.key")
+	server := &Server{Name: "edge", Type: "https", Listen: "127.0.0.1:0", Hosts: []*Host{good, late}}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() = %v, want nil", err)
+	}
+	defer server.Shutdown()
+	if late.Status == "" {
+		t.Fatal("late host Status is empty, want the missing files recorded")
+	}
+	addr := server.listener.Addr().String()
+	if got := servedCertificate(t, addr, "late.example.com"); !bytes.Equal(got, good.certificate.Load().Leaf.Raw) {
+		t.Error("degraded host did not fall back to the other host's certificate")
+	}
+
+	writeSelfSignedCert(t, dir, "late.example.com")
+	waitFor(t, "the late certificate to load", func() bool { return late.certificate.Load() != nil })
+	if late.Status != "" {
+		t.Errorf("late host Status = %q, want it cleared once the files load", late.Status)
+	}
+	if got := servedCertificate(t, addr, "late.example.com"); !bytes.Equal(got, late.certificate.Load().Leaf.Raw) {
+		t.Error("late host is not served its own certificate after the reload")
+	}
+}
+
+// A broken pair written mid-renewal must not replace a working certificate:
+// the old one stays in service and the host is marked degraded until the
+// files are valid again.
+func TestCertificateReloadKeepsPreviousOnError(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeSelfSignedCert(t, dir, "a.example.com")
+	host := redirectHost("a.example.com")
+	host.CertPath, host.KeyPath = certPath, keyPath
+	server := &Server{Name: "edge", Type: "https", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+	if err := server.loadCertificate(host); err != nil {
+		t.Fatalf("loadCertificate() = %v, want nil", err)
+	}
+	before := host.certificate.Load()
+
+	if err := os.WriteFile(certPath, []byte("half-written"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server.reloadCertificates([]*Host{host}, nil)
+	if host.certificate.Load() != before {
+		t.Error("certificate replaced by a broken pair, want the previous one kept")
+	}
+	if host.Status == "" {
+		t.Error("host Status is empty, want the reload error recorded")
+	}
+
+	writeSelfSignedCert(t, dir, "a.example.com")
+	server.reloadCertificates([]*Host{host}, nil)
+	if host.certificate.Load() == before {
+		t.Error("certificate not replaced once the files are valid again")
+	}
+	if host.Status != "" {
+		t.Errorf("host Status = %q, want it cleared", host.Status)
+	}
+}
+
+// The watcher records a reload's outcome under mu, as the admin API reads
+// the hosts while holding it.
+func TestCertificateReloadHoldsLock(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeSelfSignedCert(t, dir, "a.example.com")
+	host := redirectHost("a.example.com")
+	host.CertPath, host.KeyPath = certPath, keyPath
+	server := &Server{Name: "edge", Type: "https", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+	if err := server.loadCertificate(host); err != nil {
+		t.Fatalf("loadCertificate() = %v, want nil", err)
+	}
+
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		for i := range 10 {
+			if i%2 == 0 {
+				os.WriteFile(certPath, []byte("half-written"), 0600)
+			} else {
+				writeSelfSignedCert(t, dir, "a.example.com")
+			}
+			server.reloadCertificates([]*Host{host}, nil)
+		}
+	}()
+	for {
+		select {
+		case <-reloaded:
+			return
+		default:
+		}
+		mu.Lock()
+		json.Marshal(server)
+		mu.Unlock()
+	}
+}
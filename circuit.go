@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Circuit breaker defaults, used when the host leaves the setting out.
+const (
+	circuitMaxFails     = 3
+	circuitFailTimeout  = 10 * time.Second
+	circuitMaxBackoff   = 8 // the longest ejection, in fail timeouts
+	circuitFailStatuses = "502 503 504"
+)
+
+// circuitBreaker is a host's parsed max_fails, fail_timeout and
+// fail_statuses settings.
+type circuitBreaker struct {
+	maxFails    int
+	failTimeout time.Duration
+	statuses    map[int]bool // answers counted as failures besides errors and timeouts
+}
+
+// buildCircuitBreaker validates the host's passive health check settings,
+// which its reverse_proxy upstreams are built with.
+func (host *Host) buildCircuitBreaker() error {
+	host.circuitBreaker = nil
+	if host.DisableCircuitBreaker {
+		return nil
+	}
+	breaker := &circuitBreaker{maxFails: circuitMaxFails, failTimeout: circuitFailTimeout, statuses: map[int]bool{}}
+	if host.MaxFails < 0 {
+		return fmt.Errorf("max_fails must not be negative for host: %v", host.Name)
+	}
+	if host.MaxFails > 0 {
+		breaker.maxFails = host.MaxFails
+	}
+	if host.FailTimeout != "" {
+		d, err := time.ParseDuration(host.FailTimeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid fail_timeout '%v' for host: %v", host.FailTimeout, host.Name)
+		}
+		breaker.failTimeout = d
+	}
+	failStatuses := host.FailStatuses
+	if failStatuses == "" {
+		failStatuses = circuitFailStatuses
+	}
+	for _, field := range strings.Fields(failStatuses) {
+		status, err := strconv.Atoi(field)
+		if err != nil || status < 400 || status > 599 {
+			return fmt.Errorf("invalid status '%v' in fail_statuses, want a 4xx/5xx status, for host: %v", field, host.Name)
+		}
+		breaker.statuses[status] = true
+	}
+	host.circuitBreaker = breaker
+	return nil
+}
+
+// failedStatus reports whether an answer with status counts as a failed
+// request, as the 502, 503 and 504 of an upstream that is down or overloaded
+// do by default. A 500 of one broken endpoint only does when listed.
+func (breaker *circuitBreaker) failedStatus(status int) bool {
+	return breaker != nil && breaker.statuses[status]
+}
+
+// available reports whether u can take a request at now: it passes its
+// health checks and its circuit is closed, or half-open with no trial
+// request in flight.
+func (u *upstream) available(now time.Time) bool {
+	if u.down.Load() {
+		return false
+	}
+	if u.breaker == nil {
+		return true
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.openUntil.IsZero() || (!now.Before(u.openUntil) && !u.trial)
+}
+
+// acquire is available, claiming the trial request of a half-open circuit.
+func (u *upstream) acquire(now time.Time) bool {
+	if u.down.Load() {
+		return false
+	}
+	if u.breaker == nil {
+		return true
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(u.openUntil) || u.trial {
+		return false
+	}
+	u.trial = true
+	return true
+}
+
+// succeed records a request u answered, closing its circuit. It reports
+// whether the circuit was open.
+func (u *upstream) succeed() bool {
+	if u.breaker == nil {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	wasOpen := !u.openUntil.IsZero()
+	u.fails = 0
+	u.openUntil = time.Time{}
+	u.backoff = 0
+	u.trial = false
+	return wasOpen
+}
+
+// fail records a request u failed. After max_fails failures in a row the
+// circuit opens for fail_timeout; a failed trial request opens it again for
+// twice as long as the last time, up to circuitMaxBackoff fail timeouts.
+// Failures of requests sent while the circuit was already open don't count.
+// It returns how long the circuit opened for, or 0.
+func (u *upstream) fail(now time.Time) time.Duration {
+	if u.breaker == nil {
+		return 0
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if now.Before(u.openUntil) {
+		return 0
+	}
+	u.fails++
+	switch {
+	case u.openUntil.IsZero():
+		if u.fails < u.breaker.maxFails {
+			return 0
+		}
+		u.backoff = u.breaker.failTimeout
+	default:
+		u.backoff = min(2*u.backoff, circuitMaxBackoff*u.breaker.failTimeout)
+	}
+	u.openUntil = now.Add(u.backoff)
+	u.trial = false
+	return u.backoff
+}
+
+// release ends a request that neither failed nor succeeded, such as one the
+// client cancelled, freeing the trial slot it may hold.
+func (u *upstream) release() {
+	if u.breaker == nil {
+		return
+	}
+	u.mu.Lock()
+	u.trial = false
+	u.mu.Unlock()
+}
+
+// circuit describes the state of u's circuit for the admin API.
+func (u *upstream) circuit(now time.Time) string {
+	switch {
+	case u.breaker == nil:
+		return "off"
+	case u.openUntil.IsZero():
+		return "closed"
+	case now.Before(u.openUntil):
+		return "open"
+	default:
+		return "half_open"
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingServer is an upstream answering with its name, and with a 500
+// while failing is set.
+func failingServer(t *testing.T, name string) (*httptest.Server, *atomic.Bool) {
+	t.Helper()
+	failing := new(atomic.Bool)
+	srv := echoServer(t, name, func(w http.ResponseWriter, r *http.Request) bool {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return false
+	})
+	return srv, failing
+}
+
+func TestCircuitBreakerStates(t *testing.T) {
+	u := &upstream{breaker: &circuitBreaker{maxFails: 2, failTimeout: time.Second}}
+	now := time.Now()
+
+	if got := u.fail(now); got != 0 {
+		t.Fatalf("first failure opened the circuit for %v, want it closed until max_fails", got)
+	}
+	if got := u.fail(now); got != time.Second {
+		t.Fatalf("second failure opened the circuit for %v, want fail_timeout", got)
+	}
+	if u.available(now) || u.acquire(now) || u.circuit(now) != "open" {
+		t.Fatal("an open circuit takes requests, want it ejected")
+	}
+	// failures of requests sent before the circuit opened don't extend it
+	if got := u.fail(now.Add(time.Millisecond)); got != 0 {
+		t.Errorf("failure while open reopened the circuit for %v", got)
+	}
+	if u.fails != 2 {
+		t.Errorf("fails = %v after a failure while open, want it not counted", u.fails)
+	}
+
+	later := now.Add(time.Second)
+	if u.circuit(later) != "half_open" || !u.available(later) {
+		t.Fatal("the circuit is not half-open after fail_timeout")
+	}
+	if !u.acquire(later) {
+		t.Fatal("acquire() = false, want the trial request let through")
+	}
+	if u.available(later) || u.acquire(later) {
+		t.Fatal("a second request got through with the trial in flight")
+	}
+	if got := u.fail(later); got != 2*time.Second {
+		t.Errorf("failed trial reopened the circuit for %v, want twice as long", got)
+	}
+	for range 10 {
+		later = later.Add(time.Hour)
+		u.acquire(later)
+		u.fail(later)
+	}
+	if u.backoff != circuitMaxBackoff*time.Second {
+		t.Errorf("backoff = %v, want it capped at %v fail timeouts", u.backoff, circuitMaxBackoff)
+	}
+
+	later = later.Add(time.Hour)
+	u.acquire(later)
+	u.release()
+	if !u.acquire(later) {
+		t.Fatal("a released trial is still held, want the next request let through")
+	}
+	if !u.succeed() {
+		t.Error("succeed() = false, want it to report the circuit was open")
+	}
+	if u.circuit(later) != "closed" || u.fails != 0 || !u.available(later) {
+		t.Errorf("circuit = %v with %v fails after a success, want closed", u.circuit(later), u.fails)
+	}
+}
+
+func TestCircuitBreakerEjectsFailingUpstream(t *testing.T) {
+	bad, failing := failingServer(t, "bad")
+	good, _ := failingServer(t, "good")
+	// put the failing upstream where the client's IP hash lands
+	urls := []string{good.URL, good.URL}
+	urls[hashIndex("127.0.0.1", 2)] = bad.URL
+	failing.Store(true)
+
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: strings.Join(urls, " "),
+		MaxFails: 2, FailTimeout: "100ms", FailStatuses: "500",
+	}}}
+	client := startTestServer(t, server)
+
+	for i := range 2 {
+		if got := upstreamOf(t, client, "http://proxy.example.com/"); got != "bad" {
+			t.Fatalf("request %v reached %q, want bad until max_fails", i+1, got)
+		}
+	}
+	if got := upstreamOf(t, client, "http://proxy.example.com/"); got != "good" {
+		t.Fatalf("reached %q after max_fails, want the client rerouted to good", got)
+	}
+	states := server.upstreamStates()
+	for _, state := range states {
+		if state.URL == bad.URL && (state.Circuit != "open" || state.Fails != 2) {
+			t.Errorf("state = %+v, want the circuit open after 2 fails", state)
+		}
+	}
+
+	failing.Store(false)
+	waitFor(t, "a trial request to close the circuit", func() bool {
+		return upstreamOf(t, client, "http://proxy.example.com/") == "bad"
+	})
+}
+
+func TestCircuitBreakerIgnoresStatusesNotListed(t *testing.T) {
+	bad, failing := failingServer(t, "bad")
+	good, _ := failingServer(t, "good")
+	urls := []string{good.URL, good.URL}
+	urls[hashIndex("127.0.0.1", 2)] = bad.URL
+	failing.Store(true)
+
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: strings.Join(urls, " "),
+		MaxFails: 1,
+	}}}
+	client := startTestServer(t, server)
+
+	for i := range 5 {
+		if got := upstreamOf(t, client, "http://proxy.example.com/"); got != "bad" {
+			t.Fatalf("request %v reached %q, want a 500 not in the default fail_statuses to keep the upstream", i+1, got)
+		}
+	}
+	breaker := server.Hosts[0].circuitBreaker
+	for _, status := range []int{502, 503, 504} {
+		if !breaker.failedStatus(status) {
+			t.Errorf("status %v not counted as a failure, want it in the default fail_statuses", status)
+		}
+	}
+
+	host := &Host{Name: "proxy.example.com", FailStatuses: "500"}
+	if err := host.buildCircuitBreaker(); err != nil {
+		t.Fatal(err)
+	}
+	if !host.circuitBreaker.failedStatus(500) || host.circuitBreaker.failedStatus(502) {
+		t.Errorf("fail_statuses 500 counts 500: %v, 502: %v, want it to replace the default", host.circuitBreaker.failedStatus(500), host.circuitBreaker.failedStatus(502))
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	bad, failing := failingServer(t, "bad")
+	good, _ := failingServer(t, "good")
+	urls := []string{good.URL, good.URL}
+	urls[hashIndex("127.0.0.1", 2)] = bad.URL
+	failing.Store(true)
+
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: strings.Join(urls, " "),
+		MaxFails: 1, DisableCircuitBreaker: true,
+	}}}
+	client := startTestServer(t, server)
+
+	for i := range 5 {
+		if got := upstreamOf(t, client, "http://proxy.example.com/"); got != "bad" {
+			t.Fatalf("request %v reached %q, want no ejection with the circuit breaker off", i+1, got)
+		}
+	}
+}
+
+func TestStartRejectsInvalidCircuitBreaker(t *testing.T) {
+	cases := []struct {
+		name string
+		host *Host
+		want string
+	}{
+		{"negative max_fails", &Host{MaxFails: -1}, "max_fails must not be negative"},
+		{"bad fail_timeout", &Host{FailTimeout: "soon"}, "invalid fail_timeout 'soon'"},
+		{"bad fail_statuses", &Host{FailStatuses: "502 5xx"}, "invalid status '5xx' in fail_statuses"},
+		{"not an error status", &Host{FailStatuses: "302"}, "invalid status '302' in fail_statuses"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host := c.host
+			host.Name, host.Type, host.ForwardURLs = "proxy.example.com", "reverse_proxy", "http://127.0.0.1:1"
+			server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %q, want it to mention %q", err, c.want)
+			}
+		})
+	}
+}
@@ -1,41 +1,170 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"regexp"
+	"sync/atomic"
 )
 
 type Server struct {
-	Name       string  `json:"name"`
-	Type       string  `json:"type"` // http, https, tcp
-	Listen     string  `json:"listen"`
-	Disabled   bool    `json:"disabled"`
-	AccessLog  bool    `json:"access_log"` // one record per request/connection on stdout
-	Hosts      []*Host `json:"hosts"`
-	hostMap    map[string]*Host
-	httpServer *http.Server
-	listener   net.Listener
-	Status     string `json:"status"`
+	Name                string           `json:"name"`
+	Type                string           `json:"type"`              // http, https, tcp, tls
+	Listen              string           `json:"listen"`            // space separated host:port and unix:/path/to.sock addresses
+	UnixSocketMode      string           `json:"unix_socket_mode"`  // octal permissions of the unix sockets listened on, such as 0660
+	UnixSocketOwner     string           `json:"unix_socket_owner"` // user, user:group or :group owning the unix sockets listened on
+	Disabled            bool             `json:"disabled"`
+	AccessLog           bool             `json:"access_log"`      // one record per request/connection on stdout
+	TrustedProxies      string           `json:"trusted_proxies"` // space separated IPs and CIDRs whose X-Forwarded-For, Forwarded and X-Real-IP are believed
+	ProxyProtocol       string           `json:"proxy_protocol"`  // optional or required: read a PROXY protocol v1/v2 header on every connection
+	Hosts               []*Host          `json:"hosts"`
+	DefaultHost         string           `json:"default_host"`      // name or alias of the host serving requests no host name matches
+	UnknownHost         string           `json:"unknown_host"`      // without a default host: reject (400, default), misdirected (421) or close
+	SNIRouting          bool             `json:"sni_routing"`       // tcp: pick the host by the TLS server name instead of client IP hash
+	ACMEDirectory       string           `json:"acme_directory"`    // ACME directory URL, defaults to Let's Encrypt
+	ACMEEmail           string           `json:"acme_email"`        // contact for the ACME account, optional
+	ACMEStorage         string           `json:"acme_storage"`      // directory for the account key and certificates, defaults to acme
+	ACMEChallenge       string           `json:"acme_challenge"`    // tls-alpn-01 (default) or http-01
+	ACMECAPath          string           `json:"acme_ca_path"`      // extra root CA trusted for the ACME directory, e.g. a local Pebble
+	TLSMinVersion       string           `json:"tls_min_version"`   // 1.0, 1.1, 1.2 (default) or 1.3
+	TLSMaxVersion       string           `json:"tls_max_version"`   // defaults to the newest supported
+	TLSCipherSuites     string           `json:"tls_cipher_suites"` // space separated TLS 1.0-1.2 suite names, defaults to Go's secure list
+	TLSCurves           string           `json:"tls_curves"`        // space separated key exchange groups in preference order
+	ALPN                string           `json:"alpn"`              // space separated h2 and http/1.1, defaults to both
+	OCSPResponder       string           `json:"ocsp_responder"`    // URL used instead of the responder named in the certificates
+	OCSPStorage         string           `json:"ocsp_storage"`      // directory caching OCSP responses, defaults to ocsp
+	DisableOCSPStapling bool             `json:"disable_ocsp_stapling"`
+	hostMap             map[string]*Host // exact names and aliases
+	wildcards           []wildcardHost   // longest suffix first
+	defaultHost         *Host
+	trustedProxies      trustedProxies // parsed by Start from trusted_proxies
+	done                chan struct{}  // closed by Shutdown to stop background work
+	httpServer          *http.Server
+	listener            net.Listener
+	Status              string `json:"status"`
 }
 
 type Host struct {
-	Name              string `json:"name"`
-	Type              string `json:"type"` // serve_static, 301_redirect and reverse_proxy
-	Path              string `json:"path"` // for type serve_static
-	CertPath          string `json:"cert_path"`
-	KeyPath           string `json:"key_path"`
+	Name                       string           `json:"name"`    // may be a wildcard such as *.example.com
+	Aliases                    string           `json:"aliases"` // space separated extra names, wildcards allowed
+	Type                       string           `json:"type"`    // serve_static, 301_redirect and reverse_proxy
+	Path                       string           `json:"path"`    // for type serve_static
+	CertPath                   string           `json:"cert_path"`
+	KeyPath                    string           `json:"key_path"`
+	ACME                       bool             `json:"acme"`                    // obtain and renew the certificate automatically instead of cert_path/key_path
+	ClientCAPath               string           `json:"client_ca_path"`          // PEM bundle client certificates are verified against
+	ClientAuth                 string           `json:"client_auth"`             // none, request, require or verify-if-given
+	ForwardURLs                string           `json:"forward_urls"`            // for type reverse_proxy space separated
+	RedirectURL                string           `json:"redirect_url"`            // for type 301_redirect
+	Upstream                   string           `json:"upstream"`                // for server type tcp
+	UpstreamProxyProtocol      string           `json:"upstream_proxy_protocol"` // v1 or v2: send a PROXY protocol header to the tcp upstream
+	Disabled                   bool             `json:"disabled"`
+	DisableDirListing          bool             `json:"disable_dir_listing"`
+	Status                     string           `json:"status"`
+	AllowedOrigins             string           `json:"allowed_origins"`
+	Routes                     []*Route         `json:"routes"`                // tried in order before the host's own type
+	HealthCheckPath            string           `json:"health_check_path"`     // requested on every reverse_proxy upstream; empty turns checks off
+	HealthCheckInterval        string           `json:"health_check_interval"` // such as 10s (default)
+	HealthCheckTimeout         string           `json:"health_check_timeout"`  // such as 5s (default)
+	HealthCheckStatus          int              `json:"health_check_status"`   // expected status, 0 for any 2xx
+	HealthCheckRise            int              `json:"health_check_rise"`     // passed checks bringing an upstream back, default 2
+	HealthCheckFall            int              `json:"health_check_fall"`     // failed checks taking an upstream out, default 3
+	MaxFails                   int              `json:"max_fails"`             // failed requests in a row ejecting an upstream, default 3
+	FailTimeout                string           `json:"fail_timeout"`          // how long an upstream is first ejected for, such as 10s (default)
+	FailStatuses               string           `json:"fail_statuses"`         // space separated statuses counted as failed requests besides errors and timeouts, 502 503 504 by default
+	DisableCircuitBreaker      bool             `json:"disable_circuit_breaker"`
+	LBPolicy                   string           `json:"lb_policy"`         // ip_hash (default), round_robin, least_conn, random_two, weighted, header_hash, cookie_hash or consistent_hash
+	LBKey                      string           `json:"lb_key"`            // the header of header_hash and consistent_hash, the cookie of cookie_hash
+	Retries                    int              `json:"retries"`           // attempts on other upstreams after a failed idempotent request, default 0
+	RetryOn                    string           `json:"retry_on"`          // space separated: error and/or statuses such as 502 503, default error
+	RetryBodyLimit             int64            `json:"retry_body_limit"`  // largest request body buffered to be sent again, in bytes; 0 retries only requests without one
+	StickyCookie               string           `json:"sticky_cookie"`     // name of the cookie pinning a client to an upstream, empty for none
+	StickyCookieTTL            string           `json:"sticky_cookie_ttl"` // how long the sticky cookie lasts after the last request, empty for the browser session
+	StickyCookieSecure         bool             `json:"sticky_cookie_secure"`
+	StickyCookieHTTPOnly       bool             `json:"sticky_cookie_httponly"`
+	DialTimeout                string           `json:"dial_timeout"`            // time to connect to an upstream, default 30s
+	TLSHandshakeTimeout        string           `json:"tls_handshake_timeout"`   // time for the TLS handshake with an https upstream, default 10s
+	ResponseHeaderTimeout      string           `json:"response_header_timeout"` // time an upstream may take to answer once sent the request, default none
+	ExpectContinueTimeout      string           `json:"expect_continue_timeout"` // time to wait for 100 Continue before sending the body anyway, default 1s
+	IdleConnTimeout            string           `json:"idle_conn_timeout"`       // time an unused upstream connection is kept open, default 90s
+	KeepAlive                  string           `json:"keep_alive"`              // TCP keep-alive period of upstream connections, default 30s
+	MaxIdleConns               int              `json:"max_idle_conns"`          // idle connections kept per upstream, default 32
+	MaxConns                   int              `json:"max_conns"`               // connections per upstream, default unlimited
+	UpstreamCAPath             string           `json:"upstream_ca_path"`        // PEM bundle of the CAs https upstreams must chain to, instead of the system roots
+	UpstreamCertPath           string           `json:"upstream_cert_path"`      // client certificate presented to https upstreams
+	UpstreamKeyPath            string           `json:"upstream_key_path"`
+	UpstreamServerName         string           `json:"upstream_server_name"`          // server name sent and verified instead of the forward URL's
+	UpstreamInsecureSkipVerify bool             `json:"upstream_insecure_skip_verify"` // don't verify upstream certificates, for testing only
+	RequestHeaders             []*HeaderRule    `json:"request_headers"`               // applied in order to requests sent to reverse_proxy upstreams
+	ResponseHeaders            []*HeaderRule    `json:"response_headers"`              // applied in order to every response of the host
+	StripPrefix                string           `json:"strip_prefix"`                  // for type reverse_proxy, removed from the path sent upstream
+	AddPrefix                  string           `json:"add_prefix"`                    // for type reverse_proxy, put before the path sent upstream
+	Rewrite                    string           `json:"rewrite"`                       // for type reverse_proxy, a regular expression and its replacement for the path sent upstream
+	MirrorURLs                 string           `json:"mirror_urls"`                   // space separated upstreams sent a copy of proxied requests, whose responses are discarded
+	MirrorPercent              int              `json:"mirror_percent"`                // share of proxied requests mirrored, default 100
+	MirrorBodyLimit            int64            `json:"mirror_body_limit"`             // largest request body copied, in bytes; 0 mirrors only requests without one
+	UpstreamGroups             []*UpstreamGroup `json:"upstream_groups"`               // for type reverse_proxy instead of forward_urls, splitting requests by weight
+	GroupHeader                string           `json:"group_header"`                  // request header naming the upstream group to use, overriding the weights
+	GroupCookie                string           `json:"group_cookie"`                  // cookie naming the upstream group to use, overriding the weights
+
+	certificate    atomic.Pointer[tls.Certificate] // loaded by Start for https and tls servers, swapped on renewal
+	fileServer     http.Handler                    // built by Start for type serve_static
+	forwardPool    *upstreamPool                   // built by Start for type reverse_proxy
+	ownRoute       *Route                          // the host's own settings, serving what no route matches
+	certStamp      string                          // version of cert_path/key_path last loaded, see watchCertificates
+	tlsConfig      *tls.Config                     // built by Start for https hosts with client_auth
+	healthCheck    *healthCheck                    // built by Start from the health_check_* settings, nil when off
+	circuitBreaker *circuitBreaker                 // built by Start from max_fails and fail_timeout, nil when off
+	retryPolicy    *retryPolicy                    // built by Start from retries, retry_on and retry_body_limit, nil when off
+	transport      *http.Transport                 // built by Start from the upstream timeout and connection settings
+	stickyCookie   *stickyCookie                   // built by Start from the sticky_cookie settings, nil when off
+	mirror         *mirror                         // built by Start from the mirror_* settings, nil when off
+	upstreamGroups *upstreamGroups                 // built by Start from upstream_groups, nil when off
+	requestRules   []headerRule                    // built by Start from request_headers
+	responseRules  []headerRule                    // built by Start from response_headers
+}
+
+// Route serves the requests of a host whose path, and optionally method,
+// match, with its own type and type-specific settings. Exactly one of Prefix,
+// Exact and Regex is set.
+type Route struct {
+	Prefix            string `json:"prefix"`       // path prefix such as /api/
+	Exact             string `json:"exact"`        // whole path such as /favicon.ico
+	Regex             string `json:"regex"`        // regular expression matched against the path
+	Methods           string `json:"methods"`      // space separated, empty for any method
+	Type              string `json:"type"`         // serve_static, 301_redirect and reverse_proxy
+	Path              string `json:"path"`         // for type serve_static
 	ForwardURLs       string `json:"forward_urls"` // for type reverse_proxy space separated
 	RedirectURL       string `json:"redirect_url"` // for type 301_redirect
-	Upstream          string `json:"upstream"`     // for server type tcp
-	Disabled          bool   `json:"disabled"`
 	DisableDirListing bool   `json:"disable_dir_listing"`
-	Status            string `json:"status"`
-	AllowedOrigins    string `json:"allowed_origins"`
+	StripPrefix       string `json:"strip_prefix"` // for type reverse_proxy, removed from the path sent upstream
+	AddPrefix         string `json:"add_prefix"`   // for type reverse_proxy, put before the path sent upstream
+	Rewrite           string `json:"rewrite"`      // for type reverse_proxy, a regular expression and, after a space, its replacement such as ^/old/(.*) /new/${1}
+
+	regex        *regexp.Regexp
+	fileServer   http.Handler
+	forwardPool  *upstreamPool
+	groups       *upstreamGroups // the host's upstream groups, used instead of forwardPool
+	rewriteRegex *regexp.Regexp  // from rewrite
+	rewriteTo    string
+}
+
+// HeaderRule adds, sets or removes a header of the requests a host sends
+// upstream, or of the responses it sends to clients.
+type HeaderRule struct {
+	Op    string `json:"op"`    // add, set or remove
+	Name  string `json:"name"`  // header name, case insensitive
+	Value string `json:"value"` // for add and set, with variables such as {client_ip}, see headerVariables
+}
 
-	fileServer     http.Handler             // built by Start for type serve_static
-	forwardProxies []*httputil.ReverseProxy // built by Start for type reverse_proxy
+// UpstreamGroup is a named set of a reverse_proxy host's upstreams, sent its
+// weight's share of the host's requests.
+type UpstreamGroup struct {
+	Name        string `json:"name"`
+	ForwardURLs string `json:"forward_urls"` // space separated, as the host's
+	Weight      int    `json:"weight"`       // relative to the other groups', such as 95 and 5
 }
 
 func NewConfig(confBytes []byte) ([]*Server, error) {
@@ -129,13 +129,41 @@ func TestConfigFieldNames(t *testing.T) {
 		{
 			name:  "Server",
 			value: Server{},
-			want:  []string{"name", "type", "listen", "disabled", "access_log", "hosts", "status"},
+			want: []string{"name", "type", "listen", "unix_socket_mode", "unix_socket_owner", "disabled", "access_log", "trusted_proxies", "proxy_protocol", "hosts", "default_host",
+				"unknown_host", "sni_routing", "acme_directory", "acme_email", "acme_storage", "acme_challenge", "acme_ca_path",
+				"tls_min_version", "tls_max_version", "tls_cipher_suites", "tls_curves", "alpn",
+				"ocsp_responder", "ocsp_storage", "disable_ocsp_stapling", "status"},
 		},
 		{
 			name:  "Host",
 			value: Host{},
-			want: []string{"name", "type", "path", "cert_path", "key_path", "forward_urls",
-				"redirect_url", "upstream", "disabled", "disable_dir_listing", "status", "allowed_origins"},
+			want: []string{"name", "aliases", "type", "path", "cert_path", "key_path", "acme", "client_ca_path",
+				"client_auth", "forward_urls", "redirect_url", "upstream", "upstream_proxy_protocol", "disabled", "disable_dir_listing", "status",
+				"allowed_origins", "routes", "health_check_path", "health_check_interval", "health_check_timeout",
+				"health_check_status", "health_check_rise", "health_check_fall", "max_fails", "fail_timeout", "fail_statuses",
+				"disable_circuit_breaker", "lb_policy", "lb_key", "retries", "retry_on", "retry_body_limit",
+				"sticky_cookie", "sticky_cookie_ttl", "sticky_cookie_secure", "sticky_cookie_httponly",
+				"dial_timeout", "tls_handshake_timeout", "response_header_timeout", "expect_continue_timeout",
+				"idle_conn_timeout", "keep_alive", "max_idle_conns", "max_conns",
+				"upstream_ca_path", "upstream_cert_path", "upstream_key_path", "upstream_server_name", "upstream_insecure_skip_verify",
+				"request_headers", "response_headers", "strip_prefix", "add_prefix", "rewrite",
+				"mirror_urls", "mirror_percent", "mirror_body_limit", "upstream_groups", "group_header", "group_cookie"},
+		},
+		{
+			name:  "Route",
+			value: Route{},
+			want: []string{"prefix", "exact", "regex", "methods", "type", "path", "forward_urls", "redirect_url",
+				"disable_dir_listing", "strip_prefix", "add_prefix", "rewrite"},
+		},
+		{
+			name:  "HeaderRule",
+			value: HeaderRule{},
+			want:  []string{"op", "name", "value"},
+		},
+		{
+			name:  "UpstreamGroup",
+			value: UpstreamGroup{},
+			want:  []string{"name", "forward_urls", "weight"},
 		},
 	}
 	for _, c := range cases {
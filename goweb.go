@@ -7,7 +7,6 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"hash/fnv"
 	"io"
 	"log/slog"
 	"net"
@@ -17,6 +16,8 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -34,6 +35,7 @@ const (
 var secret = getEnv("GOWEB_ADMIN_TOKEN", "")
 var host = getEnv("GOWEB_ADMIN_HOST", "localhost")
 var port = getEnv("GOWEB_ADMIN_PORT", "13579")
+var adminTrustedProxies = getEnv("GOWEB_ADMIN_TRUSTED_PROXIES", "")
 
 var mu sync.Mutex
 var servers []*Server
@@ -88,6 +90,10 @@ func main() {
 }
 
 func (this *Server) Shutdown() error {
+	if this.done != nil {
+		close(this.done)
+		this.done = nil
+	}
 	switch this.Type {
 	case "https", "http":
 		var err error
@@ -101,13 +107,16 @@ func (this *Server) Shutdown() error {
 			}
 			slog.Info("Server stopped", "server", this.Name, "type", this.Type, "listen", this.Listen)
 		}
+		for _, host := range this.Hosts {
+			host.closeIdleConnections()
+		}
 		if this.listener != nil {
 			// usually already closed by httpServer.Shutdown; this covers the
 			// window where the serve goroutine has not picked it up yet
 			this.listener.Close()
 		}
 		return err
-	case "tcp":
+	case "tcp", "tls":
 		if this.listener != nil {
 			this.listener.Close()
 			slog.Info("Server stopped", "server", this.Name, "type", this.Type, "listen", this.Listen)
@@ -116,6 +125,17 @@ func (this *Server) Shutdown() error {
 	return nil
 }
 
+// stopped reports whether done, closed by Shutdown, is. Checked under mu, it
+// tells a server's goroutines whether they may still write to its hosts.
+func stopped(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
 func indexFileNotExists(dir string) bool {
 	indexPath := path.Join(dir, "index.html")
 	stats, err := os.Stat(indexPath)
@@ -136,7 +156,7 @@ func (this *Server) Start() error {
 	switch this.Type {
 	case "http", "https":
 		return this.startHTTP()
-	case "tcp":
+	case "tcp", "tls":
 		return this.startTCP()
 	default:
 		this.Status = fmt.Sprintf("Unknown server type '%v' for server: %v, %v", this.Type, this.Name, this.Listen)
@@ -145,75 +165,90 @@ func (this *Server) Start() error {
 }
 
 func (this *Server) startHTTP() error {
-	var tlsConfig *tls.Config
-	if this.Type == "https" {
-		tlsConfig = &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		}
+	switch this.UnknownHost {
+	case "", "reject", "misdirected", "close":
+	default:
+		this.Status = fmt.Sprintf("Invalid unknown_host '%v' for server: %v, %v", this.UnknownHost, this.Name, this.Listen)
+		return errors.New(this.Status)
+	}
+	trusted, err := parseTrustedProxies(this.TrustedProxies)
+	if err != nil {
+		this.Status = fmt.Sprintf("%v for server: %v, %v", err, this.Name, this.Listen)
+		return errors.New(this.Status)
+	}
+	this.trustedProxies = trusted
+	if err := this.checkProxyProtocol(); err != nil {
+		this.Status = fmt.Sprintf("%v for server: %v, %v", err, this.Name, this.Listen)
+		return errors.New(this.Status)
 	}
 
 	this.hostMap = make(map[string]*Host, len(this.Hosts))
+	this.wildcards = nil
+	this.defaultHost = nil
 	for _, host := range this.Hosts {
 		if host.Name == "" {
 			host.Status = fmt.Sprintf("Host name is required, server: %v, %v", this.Name, this.Listen)
 			return errors.New(host.Status)
 		}
+		for _, name := range host.names() {
+			if err := validateHostName(name); err != nil {
+				host.Status = fmt.Sprintf("%v for host: %v, server: %v, %v", err, host.Name, this.Name, this.Listen)
+				return errors.New(host.Status)
+			}
+		}
 		if !host.Disabled {
-			switch host.Type {
-			case "serve_static":
-				host.fileServer = http.FileServer(http.Dir(host.Path))
-			case "301_redirect":
-				// nothing to prepare
-			case "reverse_proxy":
-				if err := host.buildProxies(); err != nil {
+			// the reverse_proxy upstreams are built with the transport, the
+			// circuit breaker, the retry policy, the sticky cookie and the
+			// mirror, and the routes with the upstreams
+			for _, build := range []func() error{
+				host.buildTransport,
+				host.buildCircuitBreaker,
+				host.buildRetryPolicy,
+				host.buildStickyCookie,
+				host.buildMirror,
+				host.buildHeaderRules,
+				host.buildUpstreamGroups,
+				host.buildHandler,
+				host.buildRoutes,
+				host.buildHealthCheck,
+			} {
+				if err := build(); err != nil {
 					host.Status = fmt.Sprintf("%v, server: %v, %v", err, this.Name, this.Listen)
 					return errors.New(host.Status)
 				}
-			default:
-				host.Status = fmt.Sprintf("Unknown host type '%v' for host: %v, server: %v, %v", host.Type, host.Name, this.Name, this.Listen)
-				return errors.New(host.Status)
 			}
 		}
-		if this.Type == "https" {
-			keyPair, err := tls.LoadX509KeyPair(host.CertPath, host.KeyPath)
-			if err != nil {
-				// Certificate files drift at runtime — a renewal can remove
-				// them with no config change — so an unloadable pair degrades
-				// this one host instead of failing the whole server. Every
-				// other host on the listener keeps working; TLS for this name
-				// fails until its files are fixed, unless another host's
-				// certificate happens to cover it.
-				host.Status = fmt.Sprintf("%v for host: %v, server: %v, %v", err, host.Name, this.Name, this.Listen)
-				level := slog.LevelError
-				if host.Disabled {
-					level = slog.LevelWarn
-				}
-				slog.Log(context.Background(), level, "Failed to load certificate, serving remaining hosts",
-					"host", host.Name, "server", this.Name, "listen", this.Listen, "err", err)
-			} else {
-				tlsConfig.Certificates = append(tlsConfig.Certificates, keyPair)
-			}
+		this.addHost(host)
+		if this.DefaultHost != "" && host.answersTo(this.DefaultHost) {
+			this.defaultHost = host
 		}
-		this.hostMap[normalizeHost(host.Name)] = host
 	}
-
-	// With no certificate at all there is nothing TLS can serve, and
-	// http.Server.ServeTLS would only fail after the port is bound, leaving
-	// clients to hang in the accept backlog. Fail while the port is still
-	// closed instead.
-	if this.Type == "https" && len(tlsConfig.Certificates) == 0 {
-		this.Status = fmt.Sprintf("No usable certificate for server: %v, %v", this.Name, this.Listen)
+	sortWildcards(this.wildcards)
+	if this.DefaultHost != "" && this.defaultHost == nil {
+		this.Status = fmt.Sprintf("Default host '%v' not found for server: %v, %v", this.DefaultHost, this.Name, this.Listen)
 		return errors.New(this.Status)
 	}
 
+	var setup *tlsSetup
+	if this.Type == "https" {
+		var err error
+		if setup, err = this.buildTLS(this.Hosts); err != nil {
+			return err
+		}
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", this.handle)
 	var handler http.Handler = mux
 	if this.AccessLog {
 		handler = this.logAccess(mux)
 	}
+	if len(this.trustedProxies) > 0 {
+		// outermost, so the access log sees the client behind the proxies
+		handler = this.trustedProxies.realClient(handler)
+	}
 
-	listener, err := net.Listen("tcp", this.Listen)
+	listener, err := this.listen()
 	if err != nil {
 		this.Status = fmt.Sprintf("%v for server: %v, %v", err, this.Name, this.Listen)
 		return errors.New(this.Status)
@@ -222,12 +257,20 @@ func (this *Server) startHTTP() error {
 
 	srv := &http.Server{
 		Handler:           handler,
-		TLSConfig:         tlsConfig,
 		ReadHeaderTimeout: readHeaderTimeout,
 		IdleTimeout:       idleTimeout,
 		ErrorLog:          httpErrorLog(),
 	}
+	if setup != nil {
+		srv.TLSConfig = setup.config
+		srv.Protocols = setup.protocols
+	}
 	this.httpServer = srv
+	this.done = make(chan struct{})
+	if setup != nil {
+		this.runTLS(setup, this.done)
+	}
+	this.startHealthChecks(this.done)
 
 	go func() {
 		var err error
@@ -247,11 +290,23 @@ func (this *Server) startHTTP() error {
 
 func (this *Server) handle(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Server", "goweb")
+	if serveACMEChallenge(w, r) {
+		return
+	}
 	requestedHost := normalizeHost(r.Host)
-	host := this.hostMap[requestedHost]
+	host := this.routeHost(requestedHost)
 	if host == nil {
+		status := http.StatusBadRequest
+		switch this.UnknownHost {
+		case "close":
+			// drops the connection (HTTP/1) or resets the stream (HTTP/2)
+			// without writing a response
+			panic(http.ErrAbortHandler)
+		case "misdirected":
+			status = http.StatusMisdirectedRequest
+		}
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(status)
 		json.NewEncoder(w).Encode(map[string]string{"err": fmt.Sprintf("Host '%v' not found", requestedHost)})
 		return
 	}
@@ -262,66 +317,153 @@ func (this *Server) handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if this.misdirected(host, r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusMisdirectedRequest)
+		json.NewEncoder(w).Encode(map[string]string{"err": fmt.Sprintf("Host '%v' requires a TLS connection made for its own name", requestedHost)})
+		return
+	}
+
 	if host.AllowedOrigins != "" {
 		w.Header().Set("Access-Control-Allow-Origin", host.AllowedOrigins)
 	}
+	if len(host.requestRules) > 0 || len(host.responseRules) > 0 {
+		r = withRequestID(r)
+	}
+	if len(host.responseRules) > 0 {
+		hw := &headerWriter{ResponseWriter: w, r: r, rules: host.responseRules}
+		defer hw.apply()
+		w = hw
+		r = r.WithContext(context.WithValue(r.Context(), headerWriterKey{}, hw))
+	}
 
-	switch host.Type {
+	route := host.matchRoute(r)
+	switch route.Type {
 	case "301_redirect":
-		http.Redirect(w, r, fmt.Sprintf("%v%v", host.RedirectURL, r.RequestURI), http.StatusMovedPermanently)
+		http.Redirect(w, r, fmt.Sprintf("%v%v", route.RedirectURL, r.RequestURI), http.StatusMovedPermanently)
 	case "serve_static":
-		dirPath := path.Join(host.Path, r.URL.Path)
-		if host.DisableDirListing && strings.HasSuffix(r.URL.Path, "/") && indexFileNotExists(dirPath) {
+		dirPath := path.Join(route.Path, r.URL.Path)
+		if route.DisableDirListing && strings.HasSuffix(r.URL.Path, "/") && indexFileNotExists(dirPath) {
 			w.Header().Set("Content-Type", "application/json; charset=utf-8")
 			w.WriteHeader(http.StatusNotFound)
 			fmt.Fprint(w, `{"err":"404 page not found"}`)
 			return
 		}
-		host.fileServer.ServeHTTP(w, r)
+		route.fileServer.ServeHTTP(w, r)
 	case "reverse_proxy":
-		proxy := host.forwardProxies[hashIndex(clientIP(r.RemoteAddr), len(host.forwardProxies))]
-		proxy.ServeHTTP(w, r)
+		pool := route.forwardPool
+		if route.groups != nil {
+			pool = route.groups.choose(w, r)
+		}
+		pool.ServeHTTP(w, route.rewritePath(r))
 	default:
-		// unreachable: host types are validated in startHTTP
+		// unreachable: host and route types are validated in startHTTP
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"err": fmt.Sprintf("Unknown host type '%v'", host.Type)})
+		json.NewEncoder(w).Encode(map[string]string{"err": fmt.Sprintf("Unknown host type '%v'", route.Type)})
 	}
 }
 
+// buildHandler prepares what the host serves requests with, by its type.
+func (host *Host) buildHandler() error {
+	switch host.Type {
+	case "serve_static":
+		host.fileServer = http.FileServer(http.Dir(host.Path))
+	case "301_redirect":
+		// nothing to prepare
+	case "reverse_proxy":
+		return host.buildProxies()
+	default:
+		return fmt.Errorf("Unknown host type '%v' for host: %v", host.Type, host.Name)
+	}
+	return nil
+}
+
 // buildProxies parses the space separated forward URLs and builds one reverse
 // proxy per upstream. The proxies stream request and response bodies, strip
 // hop-by-hop headers, set X-Forwarded-For/Host/Proto and support upgrades
-// such as websockets.
+// such as websockets. Hosts with upstream groups have a pool per group
+// instead.
 func (host *Host) buildProxies() error {
-	forwardURLs := strings.Fields(host.ForwardURLs)
-	if len(forwardURLs) == 0 {
-		return fmt.Errorf("no forward URLs configured for host: %v", host.Name)
+	if host.upstreamGroups != nil {
+		host.forwardPool = nil
+		return nil
+	}
+	pool, err := host.newProxies(host.ForwardURLs)
+	if err != nil {
+		return err
 	}
-	proxies := make([]*httputil.ReverseProxy, 0, len(forwardURLs))
-	for _, forwardURL := range forwardURLs {
-		target, err := url.Parse(forwardURL)
+	host.forwardPool = pool
+	return nil
+}
+
+// newProxies builds the proxies for a space separated list of forward URLs,
+// either the host's own or one of its routes'.
+func (host *Host) newProxies(forwardURLs string) (*upstreamPool, error) {
+	urls := strings.Fields(forwardURLs)
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no forward URLs configured for host: %v", host.Name)
+	}
+	pool := &upstreamPool{upstreams: make([]*upstream, 0, len(urls)), policy: host.LBPolicy, key: host.LBKey,
+		retry: host.retryPolicy, sticky: host.stickyCookie, mirror: host.mirror}
+	weighted := false
+	targets := make([]string, 0, len(urls))
+	for _, entry := range urls {
+		forwardURL, weight, err := parseForwardURL(entry)
 		if err != nil {
-			return fmt.Errorf("invalid forward URL '%v' for host: %v: %v", forwardURL, host.Name, err)
+			return nil, fmt.Errorf("%v in forward URL '%v' for host: %v", err, entry, host.Name)
 		}
-		if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
-			return fmt.Errorf("invalid forward URL '%v' for host: %v", forwardURL, host.Name)
+		weighted = weighted || weight != 1
+		u := &upstream{breaker: host.circuitBreaker, weight: weight}
+		target, address, transport, err := host.upstreamURL(forwardURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forward URL '%v' for host: %v: %v", forwardURL, host.Name, err)
 		}
-		proxies = append(proxies, &httputil.ReverseProxy{
+		u.target, u.address, u.transport = target, address, transport
+		u.stickyID = stickyID(target.String())
+		targets = append(targets, target.String())
+		u.proxy = &httputil.ReverseProxy{
+			Transport: u.transport,
 			Rewrite: func(r *httputil.ProxyRequest) {
-				r.SetURL(target)
-				r.SetXForwarded()
-				r.Out.Host = r.In.Host
+				host.rewriteRequest(r, address)
 			},
 			ModifyResponse: func(res *http.Response) error {
-				rewriteLocation(res, target)
+				if u.breaker.failedStatus(res.StatusCode) {
+					host.upstreamFailed(u, fmt.Errorf("status %v", res.StatusCode))
+				} else if u.succeed() {
+					slog.Info("Upstream restored", "host", host.Name, "upstream", target.String())
+				}
+				if err := host.retryPolicy.retryResponse(res); err != nil {
+					return err
+				}
+				if address != unixAddress {
+					// a unix socket has no host of its own for a Location
+					// to point back at, localhost is only a stand-in
+					rewriteLocation(res, address)
+				}
+				restoreLocation(res)
+				if res.StatusCode == http.StatusSwitchingProtocols {
+					if hw, ok := res.Request.Context().Value(headerWriterKey{}).(*headerWriter); ok {
+						hw.upgrade(res.Header)
+					}
+				}
 				return nil
 			},
 			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
 				level := slog.LevelError
-				if errors.Is(err, context.Canceled) {
+				var statusErr *retryStatusError
+				switch {
+				case errors.Is(err, context.Canceled):
 					// the client went away mid-request, not an upstream failure
 					level = slog.LevelDebug
+					u.release()
+				case !errors.As(err, &statusErr):
+					// a retried status was judged by fail_statuses when it arrived
+					host.upstreamFailed(u, err)
+				}
+				retrying := host.retryPolicy.retryError(r, err)
+				if retrying {
+					level = slog.LevelWarn
 				}
 				slog.Log(r.Context(), level, "Proxy error",
 					"host", host.Name,
@@ -329,15 +471,67 @@ func (host *Host) buildProxies() error {
 					"method", r.Method,
 					"uri", r.RequestURI,
 					"client", clientIP(r.RemoteAddr),
+					"retrying", retrying,
 					"err", err)
-				w.Header().Set("Content-Type", "application/json; charset=utf-8")
-				w.WriteHeader(http.StatusBadGateway)
-				fmt.Fprint(w, `{"err":"bad gateway"}`)
+				if !retrying {
+					writeProxyError(w, err)
+				}
 			},
-		})
+		}
+		pool.upstreams = append(pool.upstreams, u)
+	}
+	pool.stickyID = stickyID(strings.Join(targets, " "))
+	if err := host.checkLBPolicy(weighted); err != nil {
+		return nil, err
+	}
+	if pool.policy == "consistent_hash" {
+		pool.buildRing()
+	}
+	return pool, nil
+}
+
+// upstreamURL parses a forward URL, an http, https or unix socket URL, into
+// the upstream's target, the address its requests are sent to and the
+// transport reaching it, nil for the default.
+func (host *Host) upstreamURL(rawURL string) (target, address *url.URL, transport http.RoundTripper, err error) {
+	target, err = url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	switch {
+	case target.Scheme == "unix" && target.Host == "" && strings.HasPrefix(target.Path, "/"):
+		return target, unixAddress, host.unixTransport(target.Path), nil
+	case (target.Scheme != "http" && target.Scheme != "https") || target.Host == "":
+		return nil, nil, nil, errors.New("want an http, https or unix socket URL")
+	}
+	// the default transport serves hosts built outside Start
+	if host.transport != nil {
+		transport = host.transport
+	}
+	return target, target, transport, nil
+}
+
+// rewriteRequest prepares the outgoing request of a proxy sending to
+// address.
+func (host *Host) rewriteRequest(r *httputil.ProxyRequest, address *url.URL) {
+	r.SetURL(address)
+	r.SetXForwarded()
+	setTrustedForwarded(r)
+	r.Out.Host = r.In.Host
+	setClientCertHeaders(r.Out.Header, r.In)
+	applyHeaderRules(r.Out.Header, host.requestRules, r.In)
+	// a rule setting Host changes the request's host
+	if values, ok := r.Out.Header["Host"]; ok {
+		r.Out.Host = values[0]
+		delete(r.Out.Header, "Host")
+	}
+}
+
+// upstreamFailed records a failed request to u, logging when that ejects it.
+func (host *Host) upstreamFailed(u *upstream, err error) {
+	if backoff := u.fail(time.Now()); backoff > 0 {
+		slog.Warn("Upstream ejected", "host", host.Name, "upstream", u.target.String(), "for", backoff.String(), "err", err)
 	}
-	host.forwardProxies = proxies
-	return nil
 }
 
 // rewriteLocation makes upstream Location headers relative when they point
@@ -389,6 +583,79 @@ func normalizeHost(hostport string) string {
 	return strings.ToLower(host)
 }
 
+// names returns every name the host answers to: its name and its aliases.
+func (host *Host) names() []string {
+	return append([]string{host.Name}, strings.Fields(host.Aliases)...)
+}
+
+// answersTo reports whether name is the host's name or one of its aliases.
+func (host *Host) answersTo(name string) bool {
+	name = normalizeHost(name)
+	return slices.ContainsFunc(host.names(), func(n string) bool { return normalizeHost(n) == name })
+}
+
+// validateHostName accepts a plain name or a wildcard whose only asterisk is
+// the whole leftmost label, such as *.example.com.
+func validateHostName(name string) error {
+	rest, wildcard := strings.CutPrefix(name, "*.")
+	if strings.Contains(rest, "*") || (wildcard && rest == "") {
+		return fmt.Errorf("Invalid host name '%v'", name)
+	}
+	return nil
+}
+
+// wildcardHost is a host reachable through a *.suffix name, stored with the
+// leading asterisk removed so matching is a plain suffix comparison.
+type wildcardHost struct {
+	suffix string // such as .example.com
+	host   *Host
+}
+
+// sortWildcards orders wildcards longest suffix first, so the most specific
+// wildcard wins when several match.
+func sortWildcards(wildcards []wildcardHost) {
+	sort.SliceStable(wildcards, func(i, j int) bool {
+		return len(wildcards[i].suffix) > len(wildcards[j].suffix)
+	})
+}
+
+// addHost registers every name of host, exact names in hostMap and wildcards
+// in wildcards. The caller sorts wildcards once all hosts are added.
+func (this *Server) addHost(host *Host) {
+	for _, name := range host.names() {
+		name = normalizeHost(name)
+		if suffix, ok := strings.CutPrefix(name, "*"); ok {
+			this.wildcards = append(this.wildcards, wildcardHost{suffix: suffix, host: host})
+		} else {
+			this.hostMap[name] = host
+		}
+	}
+}
+
+// lookupHost finds the host for a normalized name: an exact name or alias
+// first, then the longest matching wildcard. A wildcard covers any depth of
+// subdomain but never its bare suffix: *.example.com matches a.example.com
+// and a.b.example.com, not example.com.
+func (this *Server) lookupHost(name string) *Host {
+	if host := this.hostMap[name]; host != nil {
+		return host
+	}
+	for _, wildcard := range this.wildcards {
+		if len(name) > len(wildcard.suffix) && strings.HasSuffix(name, wildcard.suffix) {
+			return wildcard.host
+		}
+	}
+	return nil
+}
+
+// routeHost is lookupHost falling back to the server's default host, if any.
+func (this *Server) routeHost(name string) *Host {
+	if host := this.lookupHost(name); host != nil {
+		return host
+	}
+	return this.defaultHost
+}
+
 // clientIP returns the IP part of an ip:port remote address, so load
 // balancing is sticky per client instead of per connection.
 func clientIP(remoteAddr string) string {
@@ -402,9 +669,7 @@ func clientIP(remoteAddr string) string {
 // hashIndex maps s onto [0, n) with an fnv-1a hash. The modulo is done in
 // uint32 so the result is valid on 32-bit platforms too.
 func hashIndex(s string, n int) int {
-	h := fnv.New32a()
-	h.Write([]byte(s))
-	return int(h.Sum32() % uint32(n))
+	return int(hash32(s) % uint32(n))
 }
 
 func (this *Server) startTCP() error {
@@ -419,13 +684,42 @@ func (this *Server) startTCP() error {
 		return errors.New(this.Status)
 	}
 	for _, host := range enabledHosts {
-		if _, _, err := net.SplitHostPort(host.Upstream); err != nil {
+		if _, _, err := upstreamAddr(host.Upstream); err != nil {
 			host.Status = fmt.Sprintf("Invalid upstream '%v' for host: %v, server: %v: %v", host.Upstream, host.Name, this.Name, err)
 			return errors.New(host.Status)
 		}
+		if err := host.checkUpstreamProxyProtocol(); err != nil {
+			host.Status = fmt.Sprintf("%v, server: %v, %v", err, this.Name, this.Listen)
+			return errors.New(host.Status)
+		}
+	}
+	// trusted_proxies of a tcp server are the peers allowed to send a
+	// PROXY header
+	trusted, err := parseTrustedProxies(this.TrustedProxies)
+	if err != nil {
+		this.Status = fmt.Sprintf("%v for server: %v, %v", err, this.Name, this.Listen)
+		return errors.New(this.Status)
+	}
+	this.trustedProxies = trusted
+	if err := this.checkProxyProtocol(); err != nil {
+		this.Status = fmt.Sprintf("%v for server: %v, %v", err, this.Name, this.Listen)
+		return errors.New(this.Status)
+	}
+	// a tls server always routes by server name, which it learns from
+	// its own handshake instead of a peeked ClientHello
+	if this.SNIRouting || this.Type == "tls" {
+		if err := this.buildSNIRoutes(enabledHosts); err != nil {
+			return err
+		}
+	}
+	var setup *tlsSetup
+	if this.Type == "tls" {
+		if setup, err = this.buildTLS(enabledHosts); err != nil {
+			return err
+		}
 	}
 
-	listener, err := net.Listen("tcp", this.Listen)
+	listener, err := this.listen()
 	if err != nil {
 		this.Status = fmt.Sprintf("%v for server: %v, %v", err, this.Name, this.Listen)
 		return errors.New(this.Status)
@@ -433,6 +727,11 @@ func (this *Server) startTCP() error {
 	this.listener = listener
 	slog.Info("Server listening", "server", this.Name, "type", this.Type, "listen", this.Listen)
 
+	if setup != nil {
+		this.done = make(chan struct{})
+		this.runTLS(setup, this.done)
+		listener = tls.NewListener(listener, setup.config)
+	}
 	go this.acceptTCP(listener, enabledHosts)
 	return nil
 }
@@ -462,20 +761,70 @@ func (this *Server) acceptTCP(listener net.Listener, enabledHosts []*Host) {
 		delay = 0
 
 		go func() {
+			if conn, ok := connLocal.(*proxyConn); ok && conn.readHeader() != nil {
+				// logged by readHeader
+				connLocal.Close()
+				return
+			}
 			client := connLocal.RemoteAddr().String()
-			enabledHost := enabledHosts[hashIndex(clientIP(client), len(enabledHosts))]
+			var enabledHost *Host
+			var tlsAttrs []any
+			if conn, ok := connLocal.(*tls.Conn); ok {
+				// handshake here rather than on the first read, so the
+				// server name is known before picking the upstream
+				ctx, cancel := context.WithTimeout(context.Background(), readHeaderTimeout)
+				err := conn.HandshakeContext(ctx)
+				cancel()
+				if err != nil {
+					logger.Debug("TLS handshake failed", "client", client, "err", err)
+					connLocal.Close()
+					return
+				}
+				state := conn.ConnectionState()
+				tlsAttrs = []any{"sni", state.ServerName, "alpn", state.NegotiatedProtocol}
+				enabledHost = this.routeHost(normalizeHost(state.ServerName))
+				if enabledHost == nil {
+					logger.Debug("No host for TLS server name", append([]any{"client", client}, tlsAttrs...)...)
+					connLocal.Close()
+					return
+				}
+			} else if this.SNIRouting {
+				hello, peeked, err := peekClientHello(connLocal, readHeaderTimeout)
+				if err != nil {
+					logger.Debug("No TLS ClientHello", "client", client, "err", err)
+					connLocal.Close()
+					return
+				}
+				connLocal = peeked
+				tlsAttrs = []any{"sni", hello.ServerName, "alpn", strings.Join(hello.SupportedProtos, " ")}
+				enabledHost = this.routeHost(normalizeHost(hello.ServerName))
+				if enabledHost == nil {
+					logger.Debug("No host for TLS server name", append([]any{"client", client}, tlsAttrs...)...)
+					connLocal.Close()
+					return
+				}
+			} else {
+				enabledHost = enabledHosts[hashIndex(clientIP(client), len(enabledHosts))]
+			}
 			connLogger := logger.With("host", enabledHost.Name, "upstream", enabledHost.Upstream, "client", client)
-			connDst, err := net.Dial("tcp", enabledHost.Upstream)
+			network, address, _ := upstreamAddr(enabledHost.Upstream)
+			connDst, err := net.Dial(network, address)
 			if err != nil {
 				connLogger.Error("Failed to connect to upstream", "err", err)
 				connLocal.Close()
 				return
 			}
+			if err := writeProxyHeader(connDst, enabledHost.UpstreamProxyProtocol, connLocal.RemoteAddr(), connLocal.LocalAddr()); err != nil {
+				connLogger.Error("Failed to send PROXY header to upstream", "err", err)
+				connDst.Close()
+				connLocal.Close()
+				return
+			}
 			connLogger.Debug("Connection opened")
 			start := time.Now()
 			sent, received := pipe(connLocal, connDst, connLogger)
 			if this.AccessLog {
-				accessLog.Info("connection",
+				accessLog.Info("connection", append([]any{
 					"server", this.Name,
 					"host", enabledHost.Name,
 					"client", client,
@@ -483,7 +832,7 @@ func (this *Server) acceptTCP(listener net.Listener, enabledHosts []*Host) {
 					"duration_ms", durationMs(start),
 					"bytes_sent", sent,
 					"bytes_received", received,
-				)
+				}, tlsAttrs...)...)
 			}
 		}()
 	}
@@ -531,14 +880,20 @@ func copyHalf(dst, src net.Conn, logger *slog.Logger) int64 {
 			logger.Warn("Copy failed", "err", err)
 		}
 	}
-	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
-		cw.CloseWrite()
-	} else {
-		dst.Close()
-	}
+	closeWrite(dst)
 	return n
 }
 
+// closeWrite half-closes conn when it can, closing it entirely otherwise.
+// Connection wrappers call it for their CloseWrite, so that pipe's
+// half-close works through them.
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
+
 func getEnv(key, def string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value
@@ -317,6 +317,44 @@ func TestHTTPSStartsWithDisabledHostMissingCertificate(t *testing.T) {
 	server.Shutdown()
 }
 
+// The certificate is chosen with the same precedence as the request routing,
+// so a wildcard host serves its own certificate for every subdomain it covers
+// while an exact host keeps its own.
+func TestHTTPSPicksCertificateByHostMatch(t *testing.T) {
+	dir := t.TempDir()
+	wildCert, wildKey := writeSelfSignedCert(t, dir, "wildcard.example.com")
+	exactCert, exactKey := writeSelfSignedCert(t, dir, "www.example.com")
+	server := &Server{
+		Name:   "test-https",
+		Type:   "https",
+		Listen: "127.0.0.1:0",
+		Hosts: []*Host{
+			{Name: "*.example.com", Type: "301_redirect", RedirectURL: "https://elsewhere.example.com", CertPath: wildCert, KeyPath: wildKey},
+			{Name: "www.example.com", Type: "301_redirect", RedirectURL: "https://elsewhere.example.com", CertPath: exactCert, KeyPath: exactKey},
+		},
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() = %v, want nil", err)
+	}
+	defer server.Shutdown()
+
+	for serverName, want := range map[string]string{
+		"tenant1.example.com": "wildcard.example.com",
+		"a.b.example.com":     "wildcard.example.com",
+		"www.example.com":     "www.example.com",
+	} {
+		conn, err := tls.Dial("tcp", server.listener.Addr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("%v: handshake failed: %v", serverName, err)
+		}
+		got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		conn.Close()
+		if got != want {
+			t.Errorf("%v: served the certificate for %q, want %q", serverName, got, want)
+		}
+	}
+}
+
 // ---- host and address helpers ----------------------------------------------
 
 func TestNormalizeHost(t *testing.T) {
@@ -541,6 +579,8 @@ func TestStartRejectsInvalidHosts(t *testing.T) {
 	}{
 		{"no name", &Host{Type: "serve_static", Path: "."}, "name is required"},
 		{"unknown type", &Host{Name: "a.example.com", Type: "carrier_pigeon"}, "Unknown host type"},
+		{"asterisk inside a name", &Host{Name: "a.*.example.com", Type: "301_redirect"}, "Invalid host name"},
+		{"bare wildcard alias", &Host{Name: "a.example.com", Aliases: "*.", Type: "301_redirect"}, "Invalid host name"},
 		{"reverse proxy without upstreams", &Host{Name: "a.example.com", Type: "reverse_proxy"}, "no forward URLs"},
 		{"reverse proxy with an unusable upstream", &Host{Name: "a.example.com", Type: "reverse_proxy", ForwardURLs: "ftp://files.example.com"}, "invalid forward URL"},
 	}
@@ -677,6 +717,78 @@ func TestHandleUnknownHost(t *testing.T) {
 	}
 }
 
+func TestHandleUnknownHostActions(t *testing.T) {
+	t.Run("misdirected", func(t *testing.T) {
+		server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", UnknownHost: "misdirected",
+			Hosts: []*Host{redirectHost("known.example.com")}}
+		client := startTestServer(t, server)
+		resp := get(t, client, "http://unknown.example.com/")
+		if resp.StatusCode != http.StatusMisdirectedRequest {
+			t.Errorf("status = %v, want %v", resp.StatusCode, http.StatusMisdirectedRequest)
+		}
+	})
+	t.Run("close", func(t *testing.T) {
+		server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", UnknownHost: "close",
+			Hosts: []*Host{redirectHost("known.example.com")}}
+		client := startTestServer(t, server)
+		if resp, err := client.Get("http://unknown.example.com/"); err == nil {
+			resp.Body.Close()
+			t.Errorf("got status %v, want the connection closed without a response", resp.StatusCode)
+		}
+		// known hosts are unaffected
+		if resp := get(t, client, "http://known.example.com/"); resp.StatusCode != http.StatusMovedPermanently {
+			t.Errorf("status = %v, want %v", resp.StatusCode, http.StatusMovedPermanently)
+		}
+	})
+}
+
+// Health checkers and clients connecting by IP send a Host header no host
+// name matches; with a default host they are served instead of rejected.
+func TestHandleDefaultHost(t *testing.T) {
+	fallback := &Host{Name: "fallback.example.com", Aliases: "fallback.example.org", Type: "301_redirect", RedirectURL: "https://fallback.example.net"}
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", DefaultHost: "Fallback.example.org", UnknownHost: "close",
+		Hosts: []*Host{redirectHost("known.example.com"), fallback}}
+	client := startTestServer(t, server)
+
+	resp := get(t, client, "http://"+server.listener.Addr().String()+"/health")
+	if got, want := resp.Header.Get("Location"), "https://fallback.example.net/health"; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+	resp = get(t, client, "http://known.example.com/")
+	if got, want := resp.Header.Get("Location"), "https://elsewhere.example.com/"; got != want {
+		t.Errorf("Location = %q, want %q: named hosts still win over the default", got, want)
+	}
+}
+
+func TestStartRejectsInvalidHostFallback(t *testing.T) {
+	cases := []struct {
+		name   string
+		server *Server
+		want   string
+	}{
+		{"default host not among the hosts", &Server{DefaultHost: "missing.example.com"}, "Default host 'missing.example.com' not found"},
+		{"unknown action", &Server{UnknownHost: "shrug"}, "Invalid unknown_host"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := c.server
+			server.Name, server.Type, server.Listen = "edge", "http", "127.0.0.1:0"
+			server.Hosts = []*Host{redirectHost("known.example.com")}
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %q, want it to mention %q", err, c.want)
+			}
+			if server.listener != nil {
+				t.Error("listener is non-nil, want no port bound for an invalid server")
+			}
+		})
+	}
+}
+
 func TestHandleDisabledHost(t *testing.T) {
 	server := &Server{
 		Name:   "edge",
@@ -718,6 +830,58 @@ func TestHandleMatchesHostIgnoringCaseAndPort(t *testing.T) {
 	}
 }
 
+func TestLookupHost(t *testing.T) {
+	exact := &Host{Name: "api.example.com", Aliases: "api.example.net"}
+	wide := &Host{Name: "*.example.com"}
+	narrow := &Host{Name: "*.eu.example.com", Aliases: "*.Example.ORG"}
+	server := &Server{hostMap: map[string]*Host{}}
+	for _, host := range []*Host{wide, narrow, exact} {
+		server.addHost(host)
+	}
+	sortWildcards(server.wildcards)
+
+	cases := []struct {
+		name string
+		want *Host
+	}{
+		{"api.example.com", exact},
+		{"api.example.net", exact},
+		{"www.example.com", wide},
+		{"a.b.example.com", wide},
+		{"shop.eu.example.com", narrow}, // longest wildcard wins
+		{"eu.example.com", wide},        // a wildcard never covers its bare suffix
+		{"www.example.org", narrow},
+		{"example.com", nil},
+		{"example.org", nil},
+		{"elsewhere.com", nil},
+	}
+	for _, c := range cases {
+		if got := server.lookupHost(c.name); got != c.want {
+			t.Errorf("lookupHost(%q) = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestHandleWildcardHost(t *testing.T) {
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{
+		{Name: "*.example.com", Aliases: "example.com", Type: "301_redirect", RedirectURL: "https://wildcard.example.net"},
+		{Name: "www.example.com", Type: "301_redirect", RedirectURL: "https://exact.example.net"},
+	}}
+	client := startTestServer(t, server)
+
+	for url, want := range map[string]string{
+		"http://tenant1.example.com/": "https://wildcard.example.net/",
+		"http://Tenant2.Example.com/": "https://wildcard.example.net/",
+		"http://example.com/":         "https://wildcard.example.net/",
+		"http://www.example.com/":     "https://exact.example.net/",
+	} {
+		resp := get(t, client, url)
+		if got := resp.Header.Get("Location"); got != want {
+			t.Errorf("%v: Location = %q, want %q", url, got, want)
+		}
+	}
+}
+
 func TestHandleRedirect(t *testing.T) {
 	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{
 		{Name: "old.example.com", Type: "301_redirect", RedirectURL: "https://new.example.com"},
@@ -841,10 +1005,16 @@ func TestHandleAllowedOrigins(t *testing.T) {
 // ---- reverse proxy ---------------------------------------------------------
 
 // echoServer reports what it received, so proxy behaviour can be asserted from
-// the upstream's point of view.
-func echoServer(t *testing.T, name string) *httptest.Server {
+// the upstream's point of view. A hook, if given, sees each request first and
+// reports whether it answered it itself.
+func echoServer(t *testing.T, name string, hook ...func(w http.ResponseWriter, r *http.Request) bool) *httptest.Server {
 	t.Helper()
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range hook {
+			if h(w, r) {
+				return
+			}
+		}
 		json.NewEncoder(w).Encode(map[string]string{
 			"upstream": name,
 			"host":     r.Host,
@@ -853,12 +1023,56 @@ func echoServer(t *testing.T, name string) *httptest.Server {
 			"xff":      r.Header.Get("X-Forwarded-For"),
 			"xfh":      r.Header.Get("X-Forwarded-Host"),
 			"xfp":      r.Header.Get("X-Forwarded-Proto"),
+			"subject":  r.Header.Get(clientCertSubjectHeader),
+			"sha256":   r.Header.Get(clientCertFingerprintHeader),
 		})
 	}))
 	t.Cleanup(srv.Close)
 	return srv
 }
 
+// upstreamOf reports which echoServer answered a request through client,
+// changed by prepare if given.
+func upstreamOf(t *testing.T, client *http.Client, url string, prepare ...func(*http.Request)) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range prepare {
+		p(req)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err.Error()
+	}
+	return answeredBy(t, resp)
+}
+
+// answeredBy is the name of the echoServer resp came from.
+func answeredBy(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	var body map[string]string
+	json.Unmarshal([]byte(bodyString(t, resp)), &body)
+	return body["upstream"]
+}
+
+// cutShortServer is an upstream that promises a body of 100 bytes and hangs
+// up after a few, so copying its response fails halfway.
+func cutShortServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	return echoServer(t, "", func(w http.ResponseWriter, r *http.Request) bool {
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+			conn.Close()
+		}
+		return true
+	})
+}
+
 func TestBuildProxiesRejectsBadForwardURLs(t *testing.T) {
 	cases := []struct {
 		name, forwardURLs, want string
@@ -892,12 +1106,12 @@ func TestBuildProxiesOneProxyPerUpstream(t *testing.T) {
 	if err := host.buildProxies(); err != nil {
 		t.Fatalf("buildProxies() = %v, want nil", err)
 	}
-	if got, want := len(host.forwardProxies), 2; got != want {
+	if got, want := len(host.forwardPool.upstreams), 2; got != want {
 		t.Fatalf("built %v proxies, want %v", got, want)
 	}
 	for i, want := range []string{"one", "two"} {
 		rec := httptest.NewRecorder()
-		host.forwardProxies[i].ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		host.forwardPool.upstreams[i].proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
 		var body map[string]string
 		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
 			t.Fatalf("proxy %v: decoding response: %v", i, err)
@@ -97,11 +97,19 @@ function normalize(s) {
   return n;
 }
 
+// tcp and tls servers pipe connections to upstreams instead of serving
+// HTTP; https and tls servers terminate TLS with per-host certificates.
+const isStream = type => type === 'tcp' || type === 'tls';
+const terminatesTLS = type => type === 'https' || type === 'tls';
+
 function cleanHost(server, host) {
   const h = { name: host.name || '' };
-  if (server.type === 'tcp') {
+  if (isStream(server.type)) {
+    if ((server.type === 'tls' || server.sni_routing) && host.aliases) h.aliases = host.aliases;
     h.upstream = host.upstream || '';
+    if (host.upstream_proxy_protocol) h.upstream_proxy_protocol = host.upstream_proxy_protocol;
   } else {
+    if (host.aliases) h.aliases = host.aliases;
     h.type = host.type || 'serve_static';
     if (h.type === 'serve_static') {
       h.path = host.path || '';
@@ -110,12 +118,72 @@ function cleanHost(server, host) {
       h.redirect_url = host.redirect_url || '';
     } else if (h.type === 'reverse_proxy') {
       h.forward_urls = host.forward_urls || '';
+      for (const f of ['strip_prefix', 'add_prefix', 'rewrite']) {
+        if (host[f]) h[f] = host[f];
+      }
+    }
+    // load balancing, health checks and the circuit breaker cover the
+    // upstreams of reverse_proxy routes too
+    if (host.lb_policy) h.lb_policy = host.lb_policy;
+    if (host.lb_key) h.lb_key = host.lb_key;
+    if (+host.max_fails) h.max_fails = +host.max_fails;
+    if (host.fail_timeout) h.fail_timeout = host.fail_timeout;
+    if (host.fail_statuses) h.fail_statuses = host.fail_statuses;
+    if (host.disable_circuit_breaker) h.disable_circuit_breaker = true;
+    if (+host.retries) {
+      h.retries = +host.retries;
+      if (host.retry_on) h.retry_on = host.retry_on;
+      if (+host.retry_body_limit) h.retry_body_limit = +host.retry_body_limit;
+    }
+    if (host.sticky_cookie) {
+      h.sticky_cookie = host.sticky_cookie;
+      if (host.sticky_cookie_ttl) h.sticky_cookie_ttl = host.sticky_cookie_ttl;
+      if (host.sticky_cookie_secure) h.sticky_cookie_secure = true;
+      if (host.sticky_cookie_httponly) h.sticky_cookie_httponly = true;
+    }
+    if (host.group_header) h.group_header = host.group_header;
+    if (host.group_cookie) h.group_cookie = host.group_cookie;
+    if (host.mirror_urls) {
+      h.mirror_urls = host.mirror_urls;
+      if (+host.mirror_percent) h.mirror_percent = +host.mirror_percent;
+      if (+host.mirror_body_limit) h.mirror_body_limit = +host.mirror_body_limit;
     }
-    if (server.type === 'https') {
+    for (const f of ['dial_timeout', 'tls_handshake_timeout', 'response_header_timeout',
+      'expect_continue_timeout', 'idle_conn_timeout', 'keep_alive']) {
+      if (host[f]) h[f] = host[f];
+    }
+    for (const f of ['max_idle_conns', 'max_conns']) {
+      if (+host[f]) h[f] = +host[f];
+    }
+    for (const f of ['upstream_ca_path', 'upstream_cert_path', 'upstream_key_path', 'upstream_server_name']) {
+      if (host[f]) h[f] = host[f];
+    }
+    if (host.upstream_insecure_skip_verify) h.upstream_insecure_skip_verify = true;
+    if (host.health_check_path) {
+      h.health_check_path = host.health_check_path;
+      for (const f of ['health_check_interval', 'health_check_timeout']) {
+        if (host[f]) h[f] = host[f];
+      }
+      for (const f of ['health_check_status', 'health_check_rise', 'health_check_fall']) {
+        if (+host[f]) h[f] = +host[f];
+      }
+    }
+    if (host.allowed_origins) h.allowed_origins = host.allowed_origins;
+    // routes, header rules and upstream groups are edited in the JSON view
+    // and passed through as they are
+    if (Array.isArray(host.routes) && host.routes.length) h.routes = host.routes.map(r => ({ ...r }));
+    for (const f of ['request_headers', 'response_headers', 'upstream_groups']) {
+      if (Array.isArray(host[f]) && host[f].length) h[f] = host[f].map(r => ({ ...r }));
+    }
+  }
+  if (terminatesTLS(server.type)) {
+    if (host.acme) h.acme = true;
+    else {
       h.cert_path = host.cert_path || '';
       h.key_path = host.key_path || '';
     }
-    if (host.allowed_origins) h.allowed_origins = host.allowed_origins;
+    if (host.client_auth && host.client_auth !== 'none') h.client_auth = host.client_auth;
+    if (host.client_ca_path) h.client_ca_path = host.client_ca_path;
   }
   if (host.disabled) h.disabled = true;
   return h;
@@ -123,8 +191,31 @@ function cleanHost(server, host) {
 
 function cleanServer(s) {
   const out = { name: s.name || '', type: s.type || 'http', listen: s.listen || '' };
+  // socket settings only apply to unix: addresses
+  if (/(^|\s)unix:/.test(out.listen)) {
+    if (s.unix_socket_mode) out.unix_socket_mode = s.unix_socket_mode;
+    if (s.unix_socket_owner) out.unix_socket_owner = s.unix_socket_owner;
+  }
   if (s.disabled) out.disabled = true;
   if (s.access_log) out.access_log = true;
+  if (s.trusted_proxies) out.trusted_proxies = s.trusted_proxies;
+  if (s.proxy_protocol) out.proxy_protocol = s.proxy_protocol;
+  if (!isStream(s.type)) {
+    if (s.default_host) out.default_host = s.default_host;
+    if (s.unknown_host) out.unknown_host = s.unknown_host;
+  } else if (s.type === 'tls') {
+    if (s.default_host) out.default_host = s.default_host;
+  } else if (s.sni_routing) {
+    out.sni_routing = true;
+    if (s.default_host) out.default_host = s.default_host;
+  }
+  if (terminatesTLS(s.type)) {
+    for (const f of ['acme_directory', 'acme_email', 'acme_storage', 'acme_challenge', 'acme_ca_path',
+      'tls_min_version', 'tls_max_version', 'tls_cipher_suites', 'tls_curves', 'alpn', 'ocsp_responder', 'ocsp_storage']) {
+      if (s[f]) out[f] = s[f];
+    }
+    if (s.disable_ocsp_stapling) out.disable_ocsp_stapling = true;
+  }
   out.hosts = (s.hosts || []).map(h => cleanHost(s, h));
   return out;
 }
@@ -132,7 +223,7 @@ function cleanServer(s) {
 const serializeAll = () => servers.map(cleanServer);
 
 function newHost(serverType) {
-  return serverType === 'tcp'
+  return isStream(serverType)
     ? { name: '', upstream: '' }
     : { name: '', type: 'serve_static', path: '' };
 }
@@ -220,14 +311,15 @@ function options(list, current) {
 }
 
 function openURL(s, h) {
-  const m = (s.listen || '').match(/:(\d+)\s*$/);
+  const tcp = (s.listen || '').split(/\s+/).find(a => a && !a.startsWith('unix:')) || '';
+  const m = tcp.match(/:(\d+)$/);
   const port = m ? m[1] : '';
   const std = (s.type === 'http' && port === '80') || (s.type === 'https' && port === '443');
   return `${s.type}://${h.name}${port && !std ? ':' + port : ''}`;
 }
 
 function hostTypeMeta(s, h) {
-  if (s.type === 'tcp') return { label: 'tcp upstream', icon: 'ui-icon-plug', badge: 'secondary' };
+  if (isStream(s.type)) return { label: `${s.type} upstream`, icon: 'ui-icon-plug', badge: 'secondary' };
   return {
     serve_static: { label: 'static files', icon: 'ui-icon-folder', badge: '' },
     '301_redirect': { label: 'redirect', icon: 'ui-icon-corner-up-right', badge: 'warning' },
@@ -236,7 +328,7 @@ function hostTypeMeta(s, h) {
 }
 
 function hostSummary(s, h) {
-  if (s.type === 'tcp') return h.upstream || 'no upstream set';
+  if (isStream(s.type)) return h.upstream || 'no upstream set';
   if (h.type === '301_redirect') return h.redirect_url || 'no redirect URL set';
   if (h.type === 'reverse_proxy') return h.forward_urls || 'no forward URLs set';
   return h.path || 'no web root set';
@@ -269,7 +361,7 @@ function serverDot(s) {
 }
 
 function serverRow(s, si) {
-  const typeBadge = { https: 'success', http: '', tcp: 'secondary' }[s.type] ?? 'danger';
+  const typeBadge = { https: 'success', http: '', tcp: 'secondary', tls: 'secondary' }[s.type] ?? 'danger';
   const n = (s.hosts || []).length;
   const nErr = ((s.hosts || []).filter(h => !h.disabled && h.status).length) + (s.status ? 1 : 0);
   return `
@@ -324,7 +416,7 @@ function viewServers() {
 
 function hostRow(s, h, si, hi) {
   const meta = hostTypeMeta(s, h);
-  const openable = s.type !== 'tcp' && h.name;
+  const openable = !isStream(s.type) && h.name;
   const dot = h.disabled ? 'ui-dot' : (h.status ? 'ui-dot danger pulse' : 'ui-dot success');
   return `
   <div class="row ${h.disabled ? 'off' : ''}" data-hi="${hi}" data-nav="${hostHash(si, hi)}" role="link" tabindex="0">
@@ -370,15 +462,73 @@ function viewServer(si) {
       <div class="grid">
         ${field('Server name', textInput('name', s.name, 'my-server'))}
         ${field('Server type', `<select class="ui-select" data-f="type">${options([
-          ['http', 'http'], ['https', 'https'], ['tcp', 'tcp'],
+          ['http', 'http'], ['https', 'https'], ['tcp', 'tcp'], ['tls', 'tls'],
         ], s.type)}</select>`)}
-        ${field('Listen on', textInput('listen', s.listen, '[::]:443'), 'host:port; use [::] for all interfaces.')}
+        ${field('Listen on', textInput('listen', s.listen, '[::]:443'),
+          'Space separated host:port or unix:/path/to.sock addresses; use [::] for all interfaces.')}
+        ${field('Unix socket mode', textInput('unix_socket_mode', s.unix_socket_mode, '0660'),
+          'Permissions of unix: sockets. Empty for the umask default.')}
+        ${field('Unix socket owner', textInput('unix_socket_owner', s.unix_socket_owner, 'www-data:www-data'),
+          'user, user:group or :group owning unix: sockets.')}
+        ${!isStream(s.type) ? field('Default host', textInput('default_host', s.default_host, 'example.com'),
+          'Name or alias of the host serving requests no host name matches.')
+        + field('Unknown hosts', `<select class="ui-select" data-f="unknown_host">${options([
+          ['', 'Reject (400)'], ['misdirected', 'Misdirected (421)'], ['close', 'Close connection'],
+        ], s.unknown_host || '')}</select>`, 'Used when there is no default host.') : ''}
+        ${field('Trusted proxies', textInput('trusted_proxies', s.trusted_proxies, '10.0.0.0/8 192.0.2.7'),
+          isStream(s.type) ? 'Space separated IPs and CIDRs allowed to send a PROXY protocol header.'
+            : 'Space separated IPs and CIDRs whose X-Forwarded-For, Forwarded, X-Real-IP and PROXY protocol header give the client address.')}
+        ${field('PROXY protocol', `<select class="ui-select" data-f="proxy_protocol">${options([
+          ['', 'Off'], ['optional', 'Optional'], ['required', 'Required'],
+        ], s.proxy_protocol || '')}</select>`, 'Read the v1 or v2 header a load balancer such as HAProxy or NLB sends before each connection; needs trusted proxies.')}
+        ${s.type === 'tls' || (s.type === 'tcp' && s.sni_routing) ? field('Default host', textInput('default_host', s.default_host, 'example.com'),
+          'Name or alias of the host taking connections no TLS server name matches; others are closed.') : ''}
         <div class="field-toggles">
           ${toggle('enabled', !s.disabled, 'Enabled')}
+          ${s.type === 'tcp' ? toggle('sni_routing', !!s.sni_routing, 'Route by TLS server name',
+            'Pass TLS connections through to the host matching the SNI name') : ''}
           ${toggle('access_log', !!s.access_log, 'Access log',
             'Write one record per request or connection to stdout')}
         </div>
       </div>
+      ${terminatesTLS(s.type) ? `<h3 class="pane-title">ACME</h3>
+      <div class="grid">
+        ${field('Directory URL', textInput('acme_directory', s.acme_directory, 'https://acme-v02.api.letsencrypt.org/directory'),
+          'Leave empty for Let\'s Encrypt.')}
+        ${field('Account email', textInput('acme_email', s.acme_email, 'admin@example.com'))}
+        ${field('Storage directory', textInput('acme_storage', s.acme_storage, 'acme'))}
+        ${field('Challenge', `<select class="ui-select" data-f="acme_challenge">${options([
+          ['', 'TLS-ALPN-01'], ['http-01', 'HTTP-01'],
+        ], s.acme_challenge || '')}</select>`, 'HTTP-01 is answered by the http server on port 80.')}
+        ${field('Directory CA path', textInput('acme_ca_path', s.acme_ca_path, '/path/to/pebble.minica.pem'),
+          'Extra root CA to trust for the directory, e.g. a local Pebble.')}
+      </div>
+      <h3 class="pane-title">TLS policy</h3>
+      <div class="grid">
+        ${field('Minimum version', `<select class="ui-select" data-f="tls_min_version">${options([
+          ['1.0', 'TLS 1.0'], ['1.1', 'TLS 1.1'], ['', 'TLS 1.2'], ['1.3', 'TLS 1.3'],
+        ], s.tls_min_version || '')}</select>`)}
+        ${field('Maximum version', `<select class="ui-select" data-f="tls_max_version">${options([
+          ['', 'Newest'], ['1.2', 'TLS 1.2'], ['1.3', 'TLS 1.3'],
+        ], s.tls_max_version || '')}</select>`)}
+        ${field('Cipher suites', textInput('tls_cipher_suites', s.tls_cipher_suites, 'TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256'),
+          'Space separated TLS 1.0–1.2 suites; empty for Go\'s secure defaults.')}
+        ${field('Curves', textInput('tls_curves', s.tls_curves, 'X25519MLKEM768 X25519 P256'),
+          'Space separated, in order of preference.')}
+        ${s.type === 'tls'
+          ? field('ALPN', textInput('alpn', s.alpn, 'h2 http/1.1'), 'Protocols the upstreams speak; empty to offer none.')
+          : field('ALPN', textInput('alpn', s.alpn, 'h2 http/1.1'), 'Set to http/1.1 to turn HTTP/2 off.')}
+      </div>
+      <h3 class="pane-title">OCSP stapling</h3>
+      <div class="grid">
+        ${field('Responder URL', textInput('ocsp_responder', s.ocsp_responder, 'http://ocsp.example.com'),
+          'Leave empty to use the responder named in each certificate.')}
+        ${field('Cache directory', textInput('ocsp_storage', s.ocsp_storage, 'ocsp'))}
+        <div class="field-toggles">
+          ${toggle('ocsp', !s.disable_ocsp_stapling, 'Staple OCSP responses',
+            'Needs the issuer certificate in each cert file')}
+        </div>
+      </div>` : ''}
       ${s.status ? `<div class="ui-alert danger">${esc(s.status)}</div>` : ''}
     </section>
     <section class="ui-card elevated rows-card">
@@ -400,13 +550,18 @@ function viewServer(si) {
 function viewHost(si, hi) {
   const s = servers[si];
   const h = s.hosts[hi];
-  const isWeb = s.type !== 'tcp';
+  const isWeb = !isStream(s.type);
   const openable = isWeb && h.name;
 
-  let fields = field('Host name', textInput('name', h.name, isWeb ? 'example.com' : 'upstream-1'),
-    isWeb ? 'Domain name matched against the request Host header.' : 'A label for this upstream.');
+  const byName = isWeb || s.type === 'tls' || !!s.sni_routing;
+  let fields = field('Host name', textInput('name', h.name, byName ? 'example.com' : 'upstream-1'),
+    isWeb ? 'Domain name matched against the request Host header; *.example.com matches any subdomain.'
+      : byName ? 'Domain name matched against the TLS server name; *.example.com matches any subdomain.'
+      : 'A label for this upstream.');
   let toggles = toggle('enabled', !h.disabled, 'Enabled');
   if (isWeb) {
+    fields += field('Aliases', textInput('aliases', h.aliases, 'www.example.com *.example.net'),
+      'Space separated extra names; exact names win over wildcards, longer wildcards over shorter.');
     fields += field('Host type', `<select class="ui-select" data-f="type">${options([
       ['serve_static', 'Static files'],
       ['301_redirect', '301 redirect'],
@@ -417,23 +572,136 @@ function viewHost(si, hi) {
         'The request path and query are appended.');
     } else if (h.type === 'reverse_proxy') {
       fields += field('Forward URLs', textInput('forward_urls', h.forward_urls, 'http://10.0.0.1:8080 http://10.0.0.2:8080'),
-        'Space separated upstreams; clients stick to one by IP hash.');
+        'Space separated http://, https:// or unix:///path/to.sock upstreams; append ;weight=N for the weighted and consistent hash policies.');
+      if (Array.isArray(h.upstream_groups) && h.upstream_groups.length) {
+        fields += field('Upstream groups', `<p class="ui-text-muted">${h.upstream_groups.length} group${h.upstream_groups.length === 1 ? '' : 's'}`
+          + ' splitting requests by weight instead of forward URLs; edit them in the JSON view.</p>');
+        fields += field('Group header', textInput('group_header', h.group_header, 'X-Upstream-Group'),
+          'Request header naming the group to use, overriding the weights.');
+        fields += field('Group cookie', textInput('group_cookie', h.group_cookie, 'upstream_group'),
+          'Cookie naming the group to use, overriding the weights.');
+      }
+      fields += field('Strip prefix', textInput('strip_prefix', h.strip_prefix, '/app'),
+        'Removed from the path sent upstream, and put back on its redirects.');
+      fields += field('Add prefix', textInput('add_prefix', h.add_prefix, '/v2'),
+        'Put before the path sent upstream.');
+      fields += field('Rewrite', textInput('rewrite', h.rewrite, '^/old/(.*) /new/$1'),
+        'Regular expression, a space and the replacement for the path sent upstream, after strip prefix. Write ${1}x for group 1 followed by x.');
+      fields += field('Load balancing', `<select class="ui-select" data-f="lb_policy">${options([
+        ['', 'Client IP hash'],
+        ['round_robin', 'Round robin'],
+        ['least_conn', 'Least connections'],
+        ['random_two', 'Random of two, fewer connections'],
+        ['weighted', 'Weighted round robin'],
+        ['header_hash', 'Header hash'],
+        ['cookie_hash', 'Cookie hash'],
+        ['consistent_hash', 'Consistent hash'],
+      ], h.lb_policy || '')}</select>`);
+      if (['header_hash', 'cookie_hash', 'consistent_hash'].includes(h.lb_policy)) {
+        fields += field(h.lb_policy === 'cookie_hash' ? 'Cookie' : 'Header', textInput('lb_key', h.lb_key,
+          h.lb_policy === 'cookie_hash' ? 'session' : 'X-User-ID'),
+          h.lb_policy === 'consistent_hash' ? 'Optional; clients hash by IP without it.' : 'Clients without it hash by IP.');
+      }
+      fields += field('Health check path', textInput('health_check_path', h.health_check_path, '/healthz'),
+        'Requested on every upstream; failing upstreams leave the rotation. Empty to turn checks off.');
+      fields += field('Check interval', textInput('health_check_interval', h.health_check_interval, '10s'));
+      fields += field('Check timeout', textInput('health_check_timeout', h.health_check_timeout, '5s'));
+      fields += field('Expected status', textInput('health_check_status', h.health_check_status, '200'),
+        'Empty for any 2xx.');
+      fields += field('Checks to rise', textInput('health_check_rise', h.health_check_rise, '2'),
+        'Passed checks bringing an upstream back.');
+      fields += field('Checks to fall', textInput('health_check_fall', h.health_check_fall, '3'),
+        'Failed checks taking an upstream out.');
+      fields += field('Max fails', textInput('max_fails', h.max_fails, '3'),
+        'Failed requests in a row (errors, timeouts and fail statuses) ejecting an upstream.');
+      fields += field('Fail timeout', textInput('fail_timeout', h.fail_timeout, '10s'),
+        'How long an upstream is first ejected for; it doubles while trial requests fail.');
+      fields += field('Fail statuses', textInput('fail_statuses', h.fail_statuses, '502 503 504'),
+        'Answers counted as failed requests besides errors and timeouts, space separated. Empty for 502 503 504.');
+      fields += field('Retries', textInput('retries', h.retries, '0'),
+        'Other upstreams tried after a failed GET, HEAD, OPTIONS, TRACE, PUT or DELETE.');
+      fields += field('Retry on', textInput('retry_on', h.retry_on, 'error'),
+        'error and/or statuses such as 502 503, space separated.');
+      fields += field('Retry body limit', textInput('retry_body_limit', h.retry_body_limit, '0'),
+        'Largest request body, in bytes, kept to be sent again; 0 retries only requests without one.');
+      fields += field('Sticky cookie', textInput('sticky_cookie', h.sticky_cookie, 'goweb_upstream'),
+        'Cookie pinning a browser to its upstream. Empty for none.');
+      fields += field('Sticky cookie TTL', textInput('sticky_cookie_ttl', h.sticky_cookie_ttl, '24h'),
+        'Renewed on every response; empty for the browser session.');
+      fields += field('Mirror URLs', textInput('mirror_urls', h.mirror_urls, 'http://localhost:9090'),
+        'Space separated upstreams sent a copy of each request; their responses are discarded.');
+      fields += field('Mirror percent', textInput('mirror_percent', h.mirror_percent, '100'),
+        'Share of requests mirrored.');
+      fields += field('Mirror body limit', textInput('mirror_body_limit', h.mirror_body_limit, '0'),
+        'Largest request body, in bytes, copied; 0 mirrors only requests without one.');
+      fields += field('Dial timeout', textInput('dial_timeout', h.dial_timeout, '30s'));
+      fields += field('TLS handshake timeout', textInput('tls_handshake_timeout', h.tls_handshake_timeout, '10s'));
+      fields += field('Response header timeout', textInput('response_header_timeout', h.response_header_timeout, 'none'),
+        'Time an upstream may take to answer; a timeout is a 504.');
+      fields += field('Expect continue timeout', textInput('expect_continue_timeout', h.expect_continue_timeout, '1s'));
+      fields += field('Idle connection timeout', textInput('idle_conn_timeout', h.idle_conn_timeout, '90s'));
+      fields += field('TCP keep-alive', textInput('keep_alive', h.keep_alive, '30s'));
+      fields += field('Max idle connections', textInput('max_idle_conns', h.max_idle_conns, '32'),
+        'Idle connections kept per upstream.');
+      fields += field('Max connections', textInput('max_conns', h.max_conns, 'unlimited'),
+        'Connections per upstream; requests wait for a free one.');
+      fields += field('Upstream CA path', textInput('upstream_ca_path', h.upstream_ca_path, '/path/to/internal-ca.pem'),
+        'CAs https upstreams must chain to. Empty for the system roots.');
+      fields += field('Upstream client certificate', textInput('upstream_cert_path', h.upstream_cert_path, '/path/to/client.crt'),
+        'Presented to https upstreams requiring one.');
+      fields += field('Upstream client key', textInput('upstream_key_path', h.upstream_key_path, '/path/to/client.key'));
+      fields += field('Upstream server name', textInput('upstream_server_name', h.upstream_server_name, 'backend.internal'),
+        'Sent and verified instead of the forward URL host.');
+      toggles += toggle('upstream_insecure_skip_verify', !!h.upstream_insecure_skip_verify, 'Skip upstream verification',
+        'Accept any upstream certificate. Insecure, for testing only');
+      toggles += toggle('sticky_cookie_secure', !!h.sticky_cookie_secure, 'Secure sticky cookie',
+        'Send the sticky cookie over https only');
+      toggles += toggle('sticky_cookie_httponly', !!h.sticky_cookie_httponly, 'HttpOnly sticky cookie',
+        'Hide the sticky cookie from scripts');
+      toggles += toggle('circuit', !h.disable_circuit_breaker, 'Circuit breaker',
+        'Eject upstreams failing requests until a trial request succeeds');
     } else {
       fields += field('Web root path', textInput('path', h.path, '/path/to/webroot'));
     }
-    if (s.type === 'https') {
-      fields += field('Certificate path', textInput('cert_path', h.cert_path, '/path/to/cert.pem'));
-      fields += field('Private key path', textInput('key_path', h.key_path, '/path/to/key.pem'));
-    }
     fields += field('Allowed origins', textInput('allowed_origins', h.allowed_origins, '*'),
       'Access-Control-Allow-Origin header; empty to omit.');
+    if (Array.isArray(h.routes) && h.routes.length) {
+      fields += field('Routes', `<p class="ui-text-muted">${h.routes.length} route${h.routes.length === 1 ? '' : 's'}`
+        + ' tried before the host type; edit them in the JSON view.</p>');
+    }
     if (h.type === 'serve_static' || !h.type) {
       toggles += toggle('dirlist', !h.disable_dir_listing, 'Directory listing',
         'Show a directory listing when no index.html is present');
     }
   } else {
+    if (s.type === 'tls' || s.sni_routing) {
+      fields += field('Aliases', textInput('aliases', h.aliases, 'www.example.com *.example.net'),
+        'Space separated extra names; exact names win over wildcards, longer wildcards over shorter.');
+    }
     fields += field('Upstream', textInput('upstream', h.upstream, '10.0.0.1:5432'),
-      'TCP address (host:port) to forward connections to.');
+      'TCP address (host:port) or unix:///path/to.sock to forward connections to.');
+    fields += field('Upstream PROXY protocol', `<select class="ui-select" data-f="upstream_proxy_protocol">${options([
+      ['', 'Off'], ['v1', 'v1 (text)'], ['v2', 'v2 (binary)'],
+    ], h.upstream_proxy_protocol || '')}</select>`, 'Header sent to the upstream first so it sees the client address.');
+  }
+  if (terminatesTLS(s.type) && !h.acme) {
+    fields += field('Certificate path', textInput('cert_path', h.cert_path, '/path/to/cert.pem'));
+    fields += field('Private key path', textInput('key_path', h.key_path, '/path/to/key.pem'));
+  }
+  if (terminatesTLS(s.type)) {
+    fields += field('Client certificates', `<select class="ui-select" data-f="client_auth">${options([
+      ['', 'Not requested'],
+      ['request', 'Requested, not verified'],
+      ['require', 'Required and verified'],
+      ['verify-if-given', 'Verified if given'],
+    ], h.client_auth || '')}</select>`, isWeb ? 'Verified certificates are forwarded to upstreams as X-Client-Cert-* headers.'
+      : 'Checked before the connection is passed to the upstream.');
+    if (h.client_auth) {
+      fields += field('Client CA path', textInput('client_ca_path', h.client_ca_path, '/path/to/client-ca.pem'),
+        'PEM bundle of the CAs client certificates must chain to.');
+    }
+    toggles += toggle('acme', !!h.acme, 'ACME certificate',
+      'Obtain and renew the certificate automatically');
   }
   fields += `<div class="field-toggles">${toggles}</div>`;
 
@@ -672,10 +940,12 @@ function setField(s, h, f, el) {
   const v = el.type === 'checkbox' ? el.checked : el.value;
   if (!h) {
     if (f === 'enabled') s.disabled = !v;
+    else if (f === 'ocsp') s.disable_ocsp_stapling = !v;
     else s[f] = v;
   } else {
     if (f === 'enabled') h.disabled = !v;
     else if (f === 'dirlist') h.disable_dir_listing = !v;
+    else if (f === 'circuit') h.disable_circuit_breaker = !v;
     else h[f] = v;
   }
 }
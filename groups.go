@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamGroups is a host's parsed upstream_groups, group_header and
+// group_cookie: one pool per group and the weights splitting requests
+// between them, which the admin API can change while the host runs.
+type upstreamGroups struct {
+	names   []string
+	pools   []*upstreamPool
+	weights atomic.Pointer[[]int] // by group, replaced as a whole
+	header  string
+	cookie  string
+	sticky  *stickyCookie // nil without sticky sessions
+}
+
+// groupWeights is the body of a PATCH of /api/groups/.
+type groupWeights struct {
+	Server  string         `json:"server"`
+	Host    string         `json:"host"`
+	Weights map[string]int `json:"weights"` // by group name, leaving out the groups that keep theirs
+}
+
+// groupState is one upstream group as reported by the admin API.
+type groupState struct {
+	Server    string   `json:"server"`
+	Host      string   `json:"host"`
+	Name      string   `json:"name"`
+	Weight    int      `json:"weight"`
+	Upstreams []string `json:"upstreams"`
+}
+
+// buildUpstreamGroups validates the host's upstream groups and builds a pool
+// for each, in place of the pool of forward_urls. Groups are off unless
+// upstream_groups is set.
+func (host *Host) buildUpstreamGroups() error {
+	host.upstreamGroups = nil
+	if len(host.UpstreamGroups) == 0 {
+		if host.GroupHeader != "" || host.GroupCookie != "" {
+			return fmt.Errorf("group_header and group_cookie need upstream_groups for host: %v", host.Name)
+		}
+		return nil
+	}
+	if host.Type != "reverse_proxy" {
+		return fmt.Errorf("upstream_groups need type reverse_proxy for host: %v", host.Name)
+	}
+	if host.ForwardURLs != "" {
+		return fmt.Errorf("forward_urls and upstream_groups can't both be set for host: %v", host.Name)
+	}
+	groups := &upstreamGroups{header: host.GroupHeader, cookie: host.GroupCookie, sticky: host.stickyCookie}
+	weights := make([]int, 0, len(host.UpstreamGroups))
+	total := 0
+	for i, group := range host.UpstreamGroups {
+		if group.Name == "" {
+			return fmt.Errorf("name is required in upstream group %v for host: %v", i+1, host.Name)
+		}
+		if groups.index(group.Name) >= 0 {
+			return fmt.Errorf("duplicate upstream group '%v' for host: %v", group.Name, host.Name)
+		}
+		if group.Weight < 0 {
+			return fmt.Errorf("weight of upstream group '%v' must not be negative for host: %v", group.Name, host.Name)
+		}
+		pool, err := host.newProxies(group.ForwardURLs)
+		if err != nil {
+			return fmt.Errorf("%v, in upstream group '%v'", err, group.Name)
+		}
+		groups.names = append(groups.names, group.Name)
+		groups.pools = append(groups.pools, pool)
+		weights = append(weights, group.Weight)
+		total += group.Weight
+	}
+	if total == 0 {
+		return fmt.Errorf("upstream_groups need a weight above 0 for host: %v", host.Name)
+	}
+	groups.weights.Store(&weights)
+	host.upstreamGroups = groups
+	return nil
+}
+
+// index returns the position of the group named name, or -1.
+func (groups *upstreamGroups) index(name string) int {
+	for i, n := range groups.names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// choose picks the group for r: the one its group_header or group_cookie
+// names, else the one its sticky cookie pins it to, else a random one by
+// weight. It adds the group to r's access record.
+func (groups *upstreamGroups) choose(w http.ResponseWriter, r *http.Request) *upstreamPool {
+	i := -1
+	if groups.header != "" {
+		i = groups.index(r.Header.Get(groups.header))
+	}
+	if i < 0 && groups.cookie != "" {
+		if cookie, err := r.Cookie(groups.cookie); err == nil {
+			i = groups.index(cookie.Value)
+		}
+	}
+	weights := *groups.weights.Load()
+	if i < 0 {
+		i = groups.pinned(r, weights)
+	}
+	if i < 0 {
+		i = pickWeight(weights)
+	}
+	addAccessAttrs(w, "group", groups.names[i])
+	return groups.pools[i]
+}
+
+// pinned returns the group of the available upstream r's sticky cookie
+// most recently pinned it to, or -1. Groups with a weight of 0 are left
+// out, so a rolled back canary loses its pinned clients too.
+func (groups *upstreamGroups) pinned(r *http.Request, weights []int) int {
+	if groups.sticky == nil {
+		return -1
+	}
+	now := time.Now()
+	for _, pin := range groups.sticky.pins(r) {
+		key, _, _ := strings.Cut(pin, ":")
+		for i, pool := range groups.pools {
+			if pool.stickyID != key || weights[i] == 0 {
+				continue
+			}
+			if u := groups.sticky.pinnedIn(r, pool); u != nil && u.available(now) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// pickWeight returns a random index of weights, each as likely as its share
+// of their total, which must be above 0.
+func pickWeight(weights []int) int {
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+	n := rand.IntN(total)
+	for i, weight := range weights {
+		if n < weight {
+			return i
+		}
+		n -= weight
+	}
+	// unreachable
+	return len(weights) - 1
+}
+
+// setGroupWeights changes the weights of the host's running upstream
+// groups, and of its config so the change is saved with it. Either every
+// weight given is applied or none is.
+func (host *Host) setGroupWeights(weights map[string]int) error {
+	groups := host.upstreamGroups
+	if groups == nil {
+		return fmt.Errorf("no upstream groups running for host: %v", host.Name)
+	}
+	updated := append([]int(nil), *groups.weights.Load()...)
+	for name, weight := range weights {
+		i := groups.index(name)
+		if i < 0 {
+			return fmt.Errorf("unknown upstream group '%v' for host: %v", name, host.Name)
+		}
+		if weight < 0 {
+			return fmt.Errorf("weight of upstream group '%v' must not be negative for host: %v", name, host.Name)
+		}
+		updated[i] = weight
+	}
+	total := 0
+	for _, weight := range updated {
+		total += weight
+	}
+	if total == 0 {
+		return fmt.Errorf("upstream_groups need a weight above 0 for host: %v", host.Name)
+	}
+	groups.weights.Store(&updated)
+	for i, group := range host.UpstreamGroups {
+		group.Weight = updated[i]
+	}
+	return nil
+}
+
+// groupStates reports the upstream groups of the server's running hosts.
+func (this *Server) groupStates() []groupState {
+	states := []groupState{}
+	if this.done == nil {
+		// not running
+		return states
+	}
+	for _, host := range this.Hosts {
+		if host.Disabled || host.upstreamGroups == nil {
+			continue
+		}
+		weights := *host.upstreamGroups.weights.Load()
+		for i, name := range host.upstreamGroups.names {
+			state := groupState{Server: this.Name, Host: host.Name, Name: name, Weight: weights[i], Upstreams: []string{}}
+			for _, u := range host.upstreamGroups.pools[i].upstreams {
+				state.Upstreams = append(state.Upstreams, u.target.String())
+			}
+			states = append(states, state)
+		}
+	}
+	return states
+}
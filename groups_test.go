@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// groupedServer is a server whose host splits requests between a stable
+// and a canary group, with the given weights.
+func groupedServer(t *testing.T, stable, canary int) *Server {
+	t.Helper()
+	return &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy",
+		UpstreamGroups: []*UpstreamGroup{
+			{Name: "stable", ForwardURLs: echoServer(t, "stable").URL, Weight: stable},
+			{Name: "canary", ForwardURLs: echoServer(t, "canary").URL, Weight: canary},
+		},
+		GroupHeader: "X-Upstream-Group", GroupCookie: "upstream_group",
+	}}}
+}
+
+func TestPickWeight(t *testing.T) {
+	const picks = 10000
+	counts := make([]int, 3)
+	for range picks {
+		counts[pickWeight([]int{95, 0, 5})]++
+	}
+	if counts[1] != 0 {
+		t.Errorf("a weight of 0 was picked %v times", counts[1])
+	}
+	if counts[2] < picks*3/100 || counts[2] > picks*7/100 {
+		t.Errorf("a weight of 5 in 100 was picked %v of %v times, want about %v", counts[2], picks, picks*5/100)
+	}
+}
+
+func TestUpstreamGroupsSplitAndOverride(t *testing.T) {
+	logs := captureAccessLog(t)
+	server := groupedServer(t, 100, 0)
+	server.AccessLog = true
+	client := startTestServer(t, server)
+
+	for range 10 {
+		if got := upstreamOf(t, client, "http://proxy.example.com/"); got != "stable" {
+			t.Fatalf("reached %q, want every request in the only weighted group", got)
+		}
+	}
+	record := parseRecord(t, logs.records()[len(logs.records())-1])
+	if record["group"] != "stable" || record["upstream"] == nil {
+		t.Errorf("access record = %v, want the group and upstream", record)
+	}
+
+	cases := []struct {
+		name    string
+		prepare func(*http.Request)
+		want    string
+	}{
+		{"header", func(r *http.Request) { r.Header.Set("X-Upstream-Group", "canary") }, "canary"},
+		{"cookie", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "upstream_group", Value: "canary"}) }, "canary"},
+		{"header over cookie", func(r *http.Request) {
+			r.Header.Set("X-Upstream-Group", "stable")
+			r.AddCookie(&http.Cookie{Name: "upstream_group", Value: "canary"})
+		}, "stable"},
+		{"unknown group", func(r *http.Request) { r.Header.Set("X-Upstream-Group", "beta") }, "stable"},
+	}
+	for _, c := range cases {
+		if got := upstreamOf(t, client, "http://proxy.example.com/", c.prepare); got != c.want {
+			t.Errorf("%v: reached %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestUpstreamGroupsFollowStickyPins(t *testing.T) {
+	server := groupedServer(t, 1, 1)
+	server.Hosts[0].StickyCookie = "sticky"
+	client := startTestServer(t, server)
+
+	first, cookie := stickyGet(t, client, "")
+	if cookie == nil {
+		t.Fatal("no sticky cookie set on the first response")
+	}
+	for i := range 10 {
+		if got, _ := stickyGet(t, client, cookie.Value); got != first {
+			t.Fatalf("request %v reached %v, want %v the client is pinned to", i+1, got, first)
+		}
+	}
+
+	// the group header moves the client, and its pin with it
+	other := map[string]string{"stable": "canary", "canary": "stable"}[first]
+	req, _ := http.NewRequest(http.MethodGet, "http://proxy.example.com/", nil)
+	req.Header.Set("X-Upstream-Group", other)
+	req.AddCookie(cookie)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodyString(t, resp)
+	moved := resp.Cookies()
+	if len(moved) != 1 || len(strings.Split(moved[0].Value, ".")) != 2 {
+		t.Fatalf("cookies = %v, want a pin for each group", moved)
+	}
+	for i := range 10 {
+		if got, _ := stickyGet(t, client, moved[0].Value); got != other {
+			t.Fatalf("request %v reached %v, want %v the client was last pinned to", i+1, got, other)
+		}
+	}
+
+	// a group rolled back to 0 loses its pinned clients
+	if err := server.Hosts[0].setGroupWeights(map[string]int{other: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := stickyGet(t, client, moved[0].Value); got != first {
+		t.Errorf("reached %v, want %v once %v has no weight", got, first, other)
+	}
+}
+
+func TestAdminChangesGroupWeights(t *testing.T) {
+	admin := newAdminServer(t)
+	server := groupedServer(t, 100, 0)
+	client := startTestServer(t, server)
+	servers = []*Server{server}
+
+	resp := adminDo(t, admin, http.MethodPatch, "/api/groups/", adminToken,
+		`{"server": "edge", "host": "proxy.example.com", "weights": {"stable": 0, "canary": 1}}`)
+	if body := bodyString(t, resp); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PATCH = %v %v, want 200", resp.StatusCode, body)
+	}
+	for range 10 {
+		if got := upstreamOf(t, client, "http://proxy.example.com/"); got != "canary" {
+			t.Fatalf("reached %q after the change, want canary", got)
+		}
+	}
+	if got := server.Hosts[0].UpstreamGroups[1].Weight; got != 1 {
+		t.Errorf("config weight = %v, want the change kept for saving", got)
+	}
+
+	var states []groupState
+	json.Unmarshal([]byte(bodyString(t, adminDo(t, admin, http.MethodGet, "/api/groups/", adminToken, ""))), &states)
+	if len(states) != 2 || states[0].Name != "stable" || states[0].Weight != 0 ||
+		states[1].Name != "canary" || states[1].Weight != 1 || len(states[1].Upstreams) != 1 {
+		t.Errorf("groups = %+v, want the new weights", states)
+	}
+	var upstreams []upstreamState
+	json.Unmarshal([]byte(bodyString(t, adminDo(t, admin, http.MethodGet, "/api/upstreams/", adminToken, ""))), &upstreams)
+	if len(upstreams) != 2 || upstreams[0].Group != "stable" || upstreams[1].Group != "canary" {
+		t.Errorf("upstreams = %+v, want them labelled with their group", upstreams)
+	}
+
+	for _, c := range []struct {
+		body   string
+		status int
+		want   string
+	}{
+		{`{"server": "edge", "host": "other.example.com", "weights": {"stable": 1}}`, http.StatusNotFound, "is not running"},
+		{`{"server": "edge", "host": "proxy.example.com", "weights": {"beta": 1}}`, http.StatusBadRequest, "unknown upstream group 'beta'"},
+		{`{"server": "edge", "host": "proxy.example.com", "weights": {"stable": 5, "canary": -1}}`, http.StatusBadRequest, "must not be negative"},
+		{`{"server": "edge", "host": "proxy.example.com", "weights": {"canary": 0}}`, http.StatusBadRequest, "need a weight above 0"},
+	} {
+		resp := adminDo(t, admin, http.MethodPatch, "/api/groups/", adminToken, c.body)
+		if body := bodyString(t, resp); resp.StatusCode != c.status || !strings.Contains(body, c.want) {
+			t.Errorf("PATCH %v = %v %v, want %v mentioning %q", c.body, resp.StatusCode, body, c.status, c.want)
+		}
+	}
+	// a rejected change leaves every weight as it was
+	if got := upstreamOf(t, client, "http://proxy.example.com/"); got != "canary" {
+		t.Errorf("reached %q after rejected changes, want canary still", got)
+	}
+}
+
+func TestStartRejectsInvalidUpstreamGroups(t *testing.T) {
+	group := func(name string, weight int) *UpstreamGroup {
+		return &UpstreamGroup{Name: name, ForwardURLs: "http://127.0.0.1:1", Weight: weight}
+	}
+	cases := []struct {
+		name string
+		host *Host
+		want string
+	}{
+		{"with forward_urls", &Host{ForwardURLs: "http://127.0.0.1:1", UpstreamGroups: []*UpstreamGroup{group("a", 1)}}, "can't both be set"},
+		{"not proxied", &Host{Type: "serve_static", Path: ".", UpstreamGroups: []*UpstreamGroup{group("a", 1)}}, "need type reverse_proxy"},
+		{"no name", &Host{UpstreamGroups: []*UpstreamGroup{group("", 1)}}, "name is required in upstream group 1"},
+		{"duplicate", &Host{UpstreamGroups: []*UpstreamGroup{group("a", 1), group("a", 1)}}, "duplicate upstream group 'a'"},
+		{"negative weight", &Host{UpstreamGroups: []*UpstreamGroup{group("a", -1), group("b", 1)}}, "must not be negative"},
+		{"all weights 0", &Host{UpstreamGroups: []*UpstreamGroup{group("a", 0), group("b", 0)}}, "need a weight above 0"},
+		{"bad url", &Host{UpstreamGroups: []*UpstreamGroup{{Name: "a", ForwardURLs: "ftp://x", Weight: 1}}}, "in upstream group 'a'"},
+		{"header without groups", &Host{ForwardURLs: "http://127.0.0.1:1", GroupHeader: "X-Group"}, "need upstream_groups"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host := c.host
+			host.Name = "proxy.example.com"
+			if host.Type == "" {
+				host.Type = "reverse_proxy"
+			}
+			server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %q, want it to mention %q", err, c.want)
+			}
+		})
+	}
+}
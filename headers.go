@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// headerVariables are the {variables} header rule values can use.
+var headerVariables = map[string]func(r *http.Request) string{
+	"client_ip": func(r *http.Request) string { return clientIP(r.RemoteAddr) },
+	"host":      func(r *http.Request) string { return r.Host },
+	"method":    func(r *http.Request) string { return r.Method },
+	"uri":       func(r *http.Request) string { return r.RequestURI },
+	"path":      func(r *http.Request) string { return r.URL.Path },
+	"scheme": func(r *http.Request) string {
+		if r.TLS != nil {
+			return "https"
+		}
+		return "http"
+	},
+	"request_id": requestID,
+	"tls_version": func(r *http.Request) string {
+		if r.TLS == nil {
+			return ""
+		}
+		return tls.VersionName(r.TLS.Version)
+	},
+	"tls_cipher": func(r *http.Request) string {
+		if r.TLS == nil {
+			return ""
+		}
+		return tls.CipherSuiteName(r.TLS.CipherSuite)
+	},
+	"tls_server_name": func(r *http.Request) string {
+		if r.TLS == nil {
+			return ""
+		}
+		return r.TLS.ServerName
+	},
+	"tls_client_subject": func(r *http.Request) string {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return ""
+		}
+		return r.TLS.VerifiedChains[0][0].Subject.String()
+	},
+}
+
+// headerRule is a parsed HeaderRule.
+type headerRule struct {
+	op    string
+	name  string // canonical
+	value []templatePart
+}
+
+// templatePart is a literal piece of a header value, or a variable when
+// variable is set.
+type templatePart struct {
+	literal  string
+	variable func(r *http.Request) string
+}
+
+// headerWriterKey is the request context key of the host's *headerWriter,
+// set when it has response header rules.
+type headerWriterKey struct{}
+
+// requestIDKey is the request context key of the *string holding the
+// request's ID, generated the first time a rule asks for it.
+type requestIDKey struct{}
+
+// buildHeaderRules validates the host's request and response header rules.
+func (host *Host) buildHeaderRules() error {
+	var err error
+	if host.requestRules, err = parseHeaderRules(host.RequestHeaders); err != nil {
+		return fmt.Errorf("%v in request_headers for host: %v", err, host.Name)
+	}
+	if host.responseRules, err = parseHeaderRules(host.ResponseHeaders); err != nil {
+		return fmt.Errorf("%v in response_headers for host: %v", err, host.Name)
+	}
+	return nil
+}
+
+func parseHeaderRules(rules []*HeaderRule) ([]headerRule, error) {
+	parsed := make([]headerRule, 0, len(rules))
+	for _, rule := range rules {
+		switch rule.Op {
+		case "add", "set", "remove":
+		default:
+			return nil, fmt.Errorf("invalid op '%v' for header '%v'", rule.Op, rule.Name)
+		}
+		if rule.Name == "" || strings.ContainsAny(rule.Name, " \t\r\n:") {
+			return nil, fmt.Errorf("invalid header name '%v'", rule.Name)
+		}
+		if strings.ContainsAny(rule.Value, "\r\n") {
+			return nil, fmt.Errorf("line break in the value of header '%v'", rule.Name)
+		}
+		value, err := parseTemplate(rule.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%v in the value of header '%v'", err, rule.Name)
+		}
+		parsed = append(parsed, headerRule{op: rule.Op, name: textproto.CanonicalMIMEHeaderKey(rule.Name), value: value})
+	}
+	return parsed, nil
+}
+
+// parseTemplate splits a header value into literals and {variables}.
+func parseTemplate(value string) ([]templatePart, error) {
+	var parts []templatePart
+	for value != "" {
+		before, rest, found := strings.Cut(value, "{")
+		if before != "" {
+			parts = append(parts, templatePart{literal: before})
+		}
+		if !found {
+			break
+		}
+		name, after, closed := strings.Cut(rest, "}")
+		if !closed {
+			return nil, fmt.Errorf("unclosed '{%v'", rest)
+		}
+		variable, ok := headerVariables[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable '{%v}'", name)
+		}
+		parts = append(parts, templatePart{variable: variable})
+		value = after
+	}
+	return parts, nil
+}
+
+// expand is the header value for r.
+func (rule *headerRule) expand(r *http.Request) string {
+	var b strings.Builder
+	for _, part := range rule.value {
+		if part.variable != nil {
+			b.WriteString(part.variable(r))
+		} else {
+			b.WriteString(part.literal)
+		}
+	}
+	return b.String()
+}
+
+// applyHeaderRules changes header by rules, in order, for the request r.
+func applyHeaderRules(header http.Header, rules []headerRule, r *http.Request) {
+	for i := range rules {
+		rule := &rules[i]
+		switch rule.op {
+		case "add":
+			header[rule.name] = append(header[rule.name], rule.expand(r))
+		case "set":
+			header[rule.name] = []string{rule.expand(r)}
+		case "remove":
+			delete(header, rule.name)
+		}
+	}
+}
+
+// withRequestID prepares r for {request_id}, the same value however many
+// rules use it.
+func withRequestID(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, new(string)))
+}
+
+// requestID returns the random ID of r, generating it on first use.
+func requestID(r *http.Request) string {
+	id, ok := r.Context().Value(requestIDKey{}).(*string)
+	if !ok {
+		id = new(string)
+	}
+	if *id == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		*id = hex.EncodeToString(b)
+	}
+	return *id
+}
+
+// headerWriter applies a host's response header rules to whatever the
+// handler answers with, right before the headers are sent.
+type headerWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	rules   []headerRule
+	applied bool
+}
+
+// apply runs the rules once. It is also called once the handler returns,
+// for responses sent without an explicit WriteHeader or Write.
+func (this *headerWriter) apply() {
+	if !this.applied {
+		this.applied = true
+		applyHeaderRules(this.ResponseWriter.Header(), this.rules, this.r)
+	}
+}
+
+func (this *headerWriter) WriteHeader(status int) {
+	// informational responses go out before the final headers are known,
+	// but for 101, the last the connection answers before it switches
+	if status >= 200 || status == http.StatusSwitchingProtocols {
+		this.apply()
+	}
+	this.ResponseWriter.WriteHeader(status)
+}
+
+// upgrade applies the rules to the headers of a proxied 101, which the
+// proxy writes itself on the hijacked connection rather than through
+// WriteHeader. They join the writer's own, as those of any response would,
+// but for Connection and Upgrade, which the proxy checks and adds itself.
+func (this *headerWriter) upgrade(header http.Header) {
+	for name, values := range header {
+		if name != "Connection" && name != "Upgrade" {
+			this.Header()[name] = append(this.Header()[name], values...)
+			delete(header, name)
+		}
+	}
+	this.apply()
+}
+
+func (this *headerWriter) Write(b []byte) (int, error) {
+	this.apply()
+	return this.ResponseWriter.Write(b)
+}
+
+func (this *headerWriter) Flush() {
+	this.apply()
+	http.NewResponseController(this.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the connection underneath, for
+// hijacking websocket upgrades.
+func (this *headerWriter) Unwrap() http.ResponseWriter {
+	return this.ResponseWriter
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// headerEcho is an upstream answering with the host and headers it got,
+// and with the response headers in respond.
+func headerEcho(t *testing.T, respond http.Header) *httptest.Server {
+	t.Helper()
+	return echoServer(t, "", func(w http.ResponseWriter, r *http.Request) bool {
+		for name, values := range respond {
+			w.Header()[name] = values
+		}
+		json.NewEncoder(w).Encode(map[string]any{"host": r.Host, "header": r.Header})
+		return true
+	})
+}
+
+func TestHeaderRulesOnProxiedRequests(t *testing.T) {
+	upstream := headerEcho(t, http.Header{"X-Powered-By": {"php"}, "X-Cache": {"miss"}})
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: upstream.URL,
+		RequestHeaders: []*HeaderRule{
+			{Op: "set", Name: "x-real-ip", Value: "{client_ip}"},
+			{Op: "add", Name: "X-Tag", Value: "edge {scheme} {method} {path}"},
+			{Op: "remove", Name: "Cookie"},
+			{Op: "set", Name: "X-Request-ID", Value: "{request_id}"},
+			{Op: "set", Name: "Host", Value: "backend.internal"},
+		},
+		ResponseHeaders: []*HeaderRule{
+			{Op: "remove", Name: "X-Powered-By"},
+			{Op: "set", Name: "X-Cache", Value: "{host}"},
+			{Op: "add", Name: "X-Cache", Value: "edge"},
+			{Op: "set", Name: "Server", Value: "edge"},
+			{Op: "set", Name: "X-Request-ID", Value: "{request_id}"},
+		},
+	}}}
+	client := startTestServer(t, server)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://proxy.example.com/a?b=c", nil)
+	req.Header.Set("X-Tag", "client")
+	req.Header.Set("Cookie", "session=secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Host   string
+		Header http.Header
+	}
+	json.Unmarshal([]byte(bodyString(t, resp)), &got)
+
+	if got.Host != "backend.internal" {
+		t.Errorf("upstream host = %q, want the rule's backend.internal", got.Host)
+	}
+	if v := got.Header.Get("X-Real-Ip"); v != "127.0.0.1" {
+		t.Errorf("X-Real-IP = %q, want the client IP", v)
+	}
+	if v := strings.Join(got.Header["X-Tag"], ", "); v != "client, edge http GET /a" {
+		t.Errorf("X-Tag = %q, want the client's value and the added one", v)
+	}
+	if v := got.Header.Get("Cookie"); v != "" {
+		t.Errorf("Cookie = %q, want it removed", v)
+	}
+	if v := resp.Header.Get("X-Powered-By"); v != "" {
+		t.Errorf("X-Powered-By = %q, want it removed", v)
+	}
+	if v := strings.Join(resp.Header["X-Cache"], ", "); v != "proxy.example.com, edge" {
+		t.Errorf("X-Cache = %q, want the upstream's replaced, then one added", v)
+	}
+	if v := resp.Header.Get("Server"); v != "edge" {
+		t.Errorf("Server = %q, want goweb's replaced", v)
+	}
+	id := resp.Header.Get("X-Request-Id")
+	if len(id) != 32 || got.Header.Get("X-Request-Id") != id {
+		t.Errorf("request ID = %q upstream and %q in the response, want the same random ID", got.Header.Get("X-Request-Id"), id)
+	}
+}
+
+func TestHeaderRulesOnOwnResponses(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeSelfSignedCert(t, dir, "example.com")
+	host := redirectHost("example.com")
+	host.CertPath, host.KeyPath = certPath, keyPath
+	host.ResponseHeaders = []*HeaderRule{
+		{Op: "set", Name: "Strict-Transport-Security", Value: "max-age=63072000"},
+		{Op: "set", Name: "X-TLS", Value: "{tls_version} {tls_server_name}"},
+		{Op: "remove", Name: "Server"},
+	}
+	client := startTestServer(t, &Server{Name: "edge", Type: "https", Listen: "127.0.0.1:0", Hosts: []*Host{host}})
+
+	resp := get(t, client, "https://example.com/")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("status = %v, want the redirect", resp.StatusCode)
+	}
+	if v := resp.Header.Get("Strict-Transport-Security"); v != "max-age=63072000" {
+		t.Errorf("Strict-Transport-Security = %q", v)
+	}
+	if v := resp.Header.Get("X-Tls"); v != "TLS 1.3 example.com" {
+		t.Errorf("X-TLS = %q, want the TLS version and server name", v)
+	}
+	if _, ok := resp.Header["Server"]; ok {
+		t.Errorf("Server = %q, want it removed", resp.Header.Get("Server"))
+	}
+}
+
+func TestHeaderRulesOnProxiedUpgrades(t *testing.T) {
+	upstream := echoServer(t, "", func(w http.ResponseWriter, r *http.Request) bool {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return true
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\nX-Powered-By: php\r\n\r\n")
+		rw.Flush()
+		io.Copy(io.Discard, rw)
+		return true
+	})
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: upstream.URL,
+		ResponseHeaders: []*HeaderRule{
+			{Op: "remove", Name: "X-Powered-By"},
+			{Op: "set", Name: "X-Frame-Options", Value: "DENY"},
+		},
+	}}}
+	startTestServer(t, server)
+
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: proxy.example.com\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "test" {
+		t.Fatalf("got %v upgrading to %q, want 101 to test", resp.StatusCode, resp.Header.Get("Upgrade"))
+	}
+	if _, ok := resp.Header["X-Powered-By"]; ok {
+		t.Errorf("X-Powered-By = %q, want it removed", resp.Header.Get("X-Powered-By"))
+	}
+	if v := resp.Header.Get("X-Frame-Options"); v != "DENY" {
+		t.Errorf("X-Frame-Options = %q, want DENY", v)
+	}
+}
+
+func TestHeaderWriterAppliesWithoutWrite(t *testing.T) {
+	rules, err := parseHeaderRules([]*HeaderRule{{Op: "set", Name: "X-Empty", Value: "yes"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	hw := &headerWriter{ResponseWriter: rec, r: httptest.NewRequest(http.MethodGet, "/", nil), rules: rules}
+	// a handler returning without writing, as handle then applies the rules
+	hw.apply()
+	hw.WriteHeader(http.StatusNoContent)
+	if rec.Header().Get("X-Empty") != "yes" {
+		t.Errorf("X-Empty = %q, want the rule applied to an empty response", rec.Header().Get("X-Empty"))
+	}
+}
+
+func TestHeaderWriterAppliesOnSwitchingProtocols(t *testing.T) {
+	rules, err := parseHeaderRules([]*HeaderRule{{Op: "set", Name: "X-Upgraded", Value: "yes"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for status, want := range map[int]string{http.StatusContinue: "", http.StatusSwitchingProtocols: "yes"} {
+		rec := httptest.NewRecorder()
+		hw := &headerWriter{ResponseWriter: rec, r: httptest.NewRequest(http.MethodGet, "/", nil), rules: rules}
+		hw.WriteHeader(status)
+		if got := rec.Header().Get("X-Upgraded"); got != want {
+			t.Errorf("X-Upgraded = %q after %v, want %q", got, status, want)
+		}
+	}
+}
+
+func TestStartRejectsInvalidHeaderRules(t *testing.T) {
+	cases := []struct {
+		name string
+		host *Host
+		want string
+	}{
+		{"bad op", &Host{RequestHeaders: []*HeaderRule{{Op: "append", Name: "X-A"}}}, "invalid op 'append' for header 'X-A' in request_headers"},
+		{"bad name", &Host{ResponseHeaders: []*HeaderRule{{Op: "set", Name: "X A"}}}, "invalid header name 'X A' in response_headers"},
+		{"line break", &Host{ResponseHeaders: []*HeaderRule{{Op: "set", Name: "X-A", Value: "a\r\nX-B: b"}}}, "line break in the value of header 'X-A'"},
+		{"unknown variable", &Host{RequestHeaders: []*HeaderRule{{Op: "set", Name: "X-A", Value: "{client}"}}}, "unknown variable '{client}'"},
+		{"unclosed variable", &Host{RequestHeaders: []*HeaderRule{{Op: "set", Name: "X-A", Value: "{host"}}}, "unclosed '{host'"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host := c.host
+			host.Name, host.Type, host.ForwardURLs = "proxy.example.com", "reverse_proxy", "http://127.0.0.1:1"
+			server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %q, want it to mention %q", err, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ringReplicas is how many points each unit of weight puts on the
+// consistent hash ring, enough to spread clients evenly.
+const ringReplicas = 160
+
+// lbPolicies are the values of lb_policy, "" being ip_hash.
+var lbPolicies = map[string]bool{
+	"":                true,
+	"ip_hash":         true,
+	"round_robin":     true,
+	"least_conn":      true,
+	"random_two":      true,
+	"weighted":        true,
+	"header_hash":     true,
+	"cookie_hash":     true,
+	"consistent_hash": true,
+}
+
+// ringNode is a point of the consistent hash ring.
+type ringNode struct {
+	hash     uint32
+	upstream *upstream
+}
+
+// parseForwardURL splits a forward_urls entry into its URL and the weight
+// given by an optional ;weight=N suffix, 1 by default.
+func parseForwardURL(entry string) (string, int, error) {
+	forwardURL, weight, found := strings.Cut(entry, ";weight=")
+	if !found {
+		return entry, 1, nil
+	}
+	n, err := strconv.Atoi(weight)
+	if err != nil || n < 1 {
+		return "", 0, fmt.Errorf("invalid weight '%v'", weight)
+	}
+	return forwardURL, n, nil
+}
+
+// checkLBPolicy validates the host's lb_policy and lb_key, and whether the
+// policy uses upstream weights.
+func (host *Host) checkLBPolicy(weighted bool) error {
+	if !lbPolicies[host.LBPolicy] {
+		return fmt.Errorf("unknown lb_policy '%v' for host: %v", host.LBPolicy, host.Name)
+	}
+	if (host.LBPolicy == "header_hash" || host.LBPolicy == "cookie_hash") && host.LBKey == "" {
+		return fmt.Errorf("lb_key is required for lb_policy %v for host: %v", host.LBPolicy, host.Name)
+	}
+	if weighted && host.LBPolicy != "weighted" && host.LBPolicy != "consistent_hash" {
+		return fmt.Errorf("weights in forward_urls need lb_policy weighted or consistent_hash for host: %v", host.Name)
+	}
+	return nil
+}
+
+// buildRing places every upstream on the consistent hash ring, with as many
+// points as its weight asks for.
+func (pool *upstreamPool) buildRing() {
+	pool.ring = nil
+	for _, u := range pool.upstreams {
+		for i := range ringReplicas * u.weight {
+			pool.ring = append(pool.ring, ringNode{hash: hash32(u.target.String() + "#" + strconv.Itoa(i)), upstream: u})
+		}
+	}
+	slices.SortFunc(pool.ring, func(a, b ringNode) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+}
+
+// choose picks one of candidates for r by the pool's policy.
+func (pool *upstreamPool) choose(r *http.Request, candidates []*upstream) *upstream {
+	switch pool.policy {
+	case "round_robin":
+		return candidates[(pool.next.Add(1)-1)%uint64(len(candidates))]
+	case "least_conn":
+		// ties go to a random one, so idle upstreams share the load
+		var best *upstream
+		var bestActive int64
+		ties := 0
+		for _, u := range candidates {
+			active := u.active.Load()
+			switch {
+			case best == nil || active < bestActive:
+				best, bestActive, ties = u, active, 1
+			case active == bestActive:
+				ties++
+				if rand.IntN(ties) == 0 {
+					best = u
+				}
+			}
+		}
+		return best
+	case "random_two":
+		if len(candidates) == 1 {
+			return candidates[0]
+		}
+		i := rand.IntN(len(candidates))
+		j := rand.IntN(len(candidates) - 1)
+		if j >= i {
+			j++
+		}
+		if candidates[j].active.Load() < candidates[i].active.Load() {
+			return candidates[j]
+		}
+		return candidates[i]
+	case "weighted":
+		return pool.chooseWeighted(candidates)
+	case "consistent_hash":
+		return pool.chooseOnRing(pool.hashKey(r), candidates)
+	default:
+		return candidates[hashIndex(pool.hashKey(r), len(candidates))]
+	}
+}
+
+// hashKey is what the hash policies map clients by: the lb_key header or
+// cookie when set and present, the client IP otherwise.
+func (pool *upstreamPool) hashKey(r *http.Request) string {
+	switch pool.policy {
+	case "header_hash", "consistent_hash":
+		if pool.key != "" {
+			if value := r.Header.Get(pool.key); value != "" {
+				return value
+			}
+		}
+	case "cookie_hash":
+		if cookie, err := r.Cookie(pool.key); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	return clientIP(r.RemoteAddr)
+}
+
+// chooseWeighted is nginx's smooth weighted round robin: every pick adds
+// each candidate's weight to its running score, takes the highest score and
+// lowers it by the total, which spreads the picks of a heavy upstream evenly
+// instead of in bursts.
+func (pool *upstreamPool) chooseWeighted(candidates []*upstream) *upstream {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	var best *upstream
+	total := 0
+	for _, u := range candidates {
+		u.score += u.weight
+		total += u.weight
+		if best == nil || u.score > best.score {
+			best = u
+		}
+	}
+	best.score -= total
+	return best
+}
+
+// chooseOnRing walks the consistent hash ring clockwise from key to the
+// first point of a candidate. Removing an upstream only moves the clients
+// that mapped to it.
+func (pool *upstreamPool) chooseOnRing(key string, candidates []*upstream) *upstream {
+	h := hash32(key)
+	start, _ := slices.BinarySearchFunc(pool.ring, h, func(node ringNode, h uint32) int {
+		return cmp.Compare(node.hash, h)
+	})
+	for i := range pool.ring {
+		node := pool.ring[(start+i)%len(pool.ring)]
+		if len(candidates) == len(pool.upstreams) || slices.Contains(candidates, node.upstream) {
+			return node.upstream
+		}
+	}
+	return candidates[0]
+}
+
+// hash32 is the fnv-1a hash of s.
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testPool builds a pool of upstreams named u0, u1... with the given weights.
+func testPool(policy, key string, weights ...int) *upstreamPool {
+	pool := &upstreamPool{policy: policy, key: key}
+	for i, weight := range weights {
+		pool.upstreams = append(pool.upstreams, &upstream{
+			target: &url.URL{Scheme: "http", Host: fmt.Sprintf("u%v:80", i)},
+			weight: weight,
+		})
+	}
+	if policy == "consistent_hash" {
+		pool.buildRing()
+	}
+	return pool
+}
+
+// requestFrom is a request from the client IP ip.
+func requestFrom(ip string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = ip + ":50000"
+	return r
+}
+
+func TestParseForwardURL(t *testing.T) {
+	cases := []struct {
+		entry      string
+		wantURL    string
+		wantWeight int
+		wantErr    bool
+	}{
+		{"http://a:8080", "http://a:8080", 1, false},
+		{"http://a:8080;weight=5", "http://a:8080", 5, false},
+		{"http://a:8080;weight=0", "", 0, true},
+		{"http://a:8080;weight=x", "", 0, true},
+	}
+	for _, c := range cases {
+		forwardURL, weight, err := parseForwardURL(c.entry)
+		if (err != nil) != c.wantErr || forwardURL != c.wantURL || weight != c.wantWeight {
+			t.Errorf("parseForwardURL(%q) = %q, %v, %v, want %q, %v, error %v",
+				c.entry, forwardURL, weight, err, c.wantURL, c.wantWeight, c.wantErr)
+		}
+	}
+}
+
+func TestLBRoundRobin(t *testing.T) {
+	pool := testPool("round_robin", "", 1, 1, 1)
+	r := requestFrom("10.0.0.1")
+	for i := range 6 {
+		if got, want := pool.pick(r), pool.upstreams[i%3]; got != want {
+			t.Fatalf("pick %v = %v, want %v", i, got.target.Host, want.target.Host)
+		}
+	}
+}
+
+func TestLBLeastConn(t *testing.T) {
+	pool := testPool("least_conn", "", 1, 1, 1)
+	pool.upstreams[0].active.Store(3)
+	pool.upstreams[1].active.Store(1)
+	pool.upstreams[2].active.Store(2)
+	for range 10 {
+		if got := pool.pick(requestFrom("10.0.0.1")); got != pool.upstreams[1] {
+			t.Fatalf("pick = %v, want the upstream with the fewest requests in flight", got.target.Host)
+		}
+	}
+}
+
+// a response cut short makes ReverseProxy panic, which must not leave the
+// upstream counted as busy for good
+func TestActiveCountSurvivesBrokenResponses(t *testing.T) {
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: cutShortServer(t).URL, LBPolicy: "least_conn",
+	}}}
+	client := startTestServer(t, server)
+	for range 3 {
+		if resp, err := client.Get("http://proxy.example.com/"); err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+	waitFor(t, "no requests in flight", func() bool { return server.upstreamStates()[0].Active == 0 })
+}
+
+func TestLBRandomTwo(t *testing.T) {
+	pool := testPool("random_two", "", 1, 1)
+	pool.upstreams[0].active.Store(5)
+	// with two upstreams both are always drawn, so the idle one wins
+	for range 20 {
+		if got := pool.pick(requestFrom("10.0.0.1")); got != pool.upstreams[1] {
+			t.Fatalf("pick = %v, want the less loaded of the two", got.target.Host)
+		}
+	}
+}
+
+func TestLBWeighted(t *testing.T) {
+	pool := testPool("weighted", "", 5, 1, 1)
+	var picks []string
+	for range 7 {
+		picks = append(picks, pool.pick(requestFrom("10.0.0.1")).target.Host)
+	}
+	// smooth: the heavy upstream's picks are spread, not in a burst of five
+	if got, want := strings.Join(picks, " "), "u0:80 u0:80 u1:80 u0:80 u2:80 u0:80 u0:80"; got != want {
+		t.Errorf("picks = %v, want %v", got, want)
+	}
+}
+
+func TestLBHeaderAndCookieHash(t *testing.T) {
+	headerPool := testPool("header_hash", "X-User", 1, 1, 1, 1)
+	cookiePool := testPool("cookie_hash", "session", 1, 1, 1, 1)
+	seen := map[*upstream]bool{}
+	for i := range 50 {
+		user := fmt.Sprintf("user-%v", i)
+		// the same user from different IPs, as behind a NAT pool
+		a, b := requestFrom("10.0.0.1"), requestFrom("10.0.0.2")
+		a.Header.Set("X-User", user)
+		b.Header.Set("X-User", user)
+		if headerPool.pick(a) != headerPool.pick(b) {
+			t.Fatalf("%v moved upstream with the client IP, want the header to decide", user)
+		}
+		seen[headerPool.pick(a)] = true
+
+		a.AddCookie(&http.Cookie{Name: "session", Value: user})
+		b.AddCookie(&http.Cookie{Name: "session", Value: user})
+		if cookiePool.pick(a) != cookiePool.pick(b) {
+			t.Fatalf("%v moved upstream with the client IP, want the cookie to decide", user)
+		}
+	}
+	if len(seen) != 4 {
+		t.Errorf("50 users reached %v of 4 upstreams, want them spread", len(seen))
+	}
+	// without the header the client IP decides
+	if got, want := headerPool.pick(requestFrom("10.0.0.1")), headerPool.upstreams[hashIndex("10.0.0.1", 4)]; got != want {
+		t.Errorf("pick without the header = %v, want %v by client IP", got.target.Host, want.target.Host)
+	}
+}
+
+func TestLBConsistentHash(t *testing.T) {
+	const clients = 2000
+	before := testPool("consistent_hash", "", 1, 1, 1, 1)
+	after := testPool("consistent_hash", "", 1, 1, 1, 1, 1)
+	moved := 0
+	for i := range clients {
+		r := requestFrom(fmt.Sprintf("10.0.%v.%v", i/256, i%256))
+		if before.pick(r).target.Host != after.pick(r).target.Host {
+			moved++
+		}
+	}
+	// adding a fifth upstream should move about a fifth of the clients,
+	// where hashIndex % n would move about four fifths
+	if moved > clients*3/10 {
+		t.Errorf("adding an upstream moved %v of %v clients, want about %v", moved, clients, clients/5)
+	}
+
+	// an ejected upstream only moves its own clients
+	pool := testPool("consistent_hash", "", 1, 1, 1)
+	gone := pool.upstreams[1]
+	for i := range 200 {
+		r := requestFrom(fmt.Sprintf("10.1.0.%v", i))
+		first := pool.choose(r, pool.upstreams)
+		rest := pool.choose(r, []*upstream{pool.upstreams[0], pool.upstreams[2]})
+		if first != gone && rest != first {
+			t.Fatalf("client %v moved from a remaining upstream", i)
+		}
+	}
+}
+
+func TestReverseProxyRoundRobin(t *testing.T) {
+	one, two := echoServer(t, "one"), echoServer(t, "two")
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: one.URL + " " + two.URL, LBPolicy: "round_robin",
+	}}}
+	client := startTestServer(t, server)
+	var got []string
+	for range 4 {
+		got = append(got, upstreamOf(t, client, "http://proxy.example.com/"))
+	}
+	if strings.Join(got, " ") != "one two one two" {
+		t.Errorf("upstreams = %v, want the same client sent to each in turn", got)
+	}
+}
+
+func TestStartRejectsInvalidLBPolicy(t *testing.T) {
+	cases := []struct {
+		name string
+		host *Host
+		want string
+	}{
+		{"unknown policy", &Host{LBPolicy: "fastest"}, "unknown lb_policy 'fastest'"},
+		{"missing lb_key", &Host{LBPolicy: "cookie_hash"}, "lb_key is required for lb_policy cookie_hash"},
+		{"weights without weighted", &Host{ForwardURLs: "http://127.0.0.1:1;weight=2"}, "need lb_policy weighted"},
+		{"bad weight", &Host{LBPolicy: "weighted", ForwardURLs: "http://127.0.0.1:1;weight=-2"}, "invalid weight '-2'"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host := c.host
+			host.Name, host.Type = "proxy.example.com", "reverse_proxy"
+			if host.ForwardURLs == "" {
+				host.ForwardURLs = "http://127.0.0.1:1"
+			}
+			server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %q, want it to mention %q", err, c.want)
+			}
+		})
+	}
+}
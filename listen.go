@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// socketOptions are a server's parsed unix_socket_mode and
+// unix_socket_owner, applied to the unix sockets it listens on.
+type socketOptions struct {
+	mode     os.FileMode
+	hasMode  bool
+	uid, gid int // -1 to leave unchanged
+}
+
+// listen opens every address of the space separated listen setting: a
+// host:port over tcp, or unix:/path/to.sock. Several addresses are joined
+// into one listener, closed together. With proxy_protocol, connections are
+// read past their PROXY header.
+func (this *Server) listen() (net.Listener, error) {
+	addrs := strings.Fields(this.Listen)
+	if len(addrs) == 0 {
+		return nil, errors.New("listen is required")
+	}
+	options, err := this.socketOptions()
+	if err != nil {
+		return nil, err
+	}
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		var listener net.Listener
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			listener, err = listenUnix(strings.TrimPrefix(path, "//"), options)
+		} else {
+			listener, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	listener := listeners[0]
+	if len(listeners) > 1 {
+		listener = newMultiListener(listeners)
+	}
+	if this.ProxyProtocol != "" {
+		listener = &proxyListener{Listener: listener, trusted: this.trustedProxies, required: this.ProxyProtocol == "required"}
+	}
+	return listener, nil
+}
+
+// socketOptions parses the server's unix socket mode and owner.
+func (this *Server) socketOptions() (*socketOptions, error) {
+	options := &socketOptions{uid: -1, gid: -1}
+	if this.UnixSocketMode != "" {
+		mode, err := strconv.ParseUint(this.UnixSocketMode, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, fmt.Errorf("invalid unix_socket_mode '%v', want octal permissions such as 0660", this.UnixSocketMode)
+		}
+		options.mode, options.hasMode = os.FileMode(mode), true
+	}
+	if this.UnixSocketOwner != "" {
+		owner, group, _ := strings.Cut(this.UnixSocketOwner, ":")
+		if owner != "" {
+			uid, err := lookupID(owner, func(name string) (string, error) {
+				u, err := user.Lookup(name)
+				if err != nil {
+					return "", err
+				}
+				return u.Uid, nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("invalid unix_socket_owner '%v': %v", this.UnixSocketOwner, err)
+			}
+			options.uid = uid
+		}
+		if group != "" {
+			gid, err := lookupID(group, func(name string) (string, error) {
+				g, err := user.LookupGroup(name)
+				if err != nil {
+					return "", err
+				}
+				return g.Gid, nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("invalid unix_socket_owner '%v': %v", this.UnixSocketOwner, err)
+			}
+			options.gid = gid
+		}
+	}
+	return options, nil
+}
+
+// lookupID resolves a user or group given by name or numeric ID.
+func lookupID(nameOrID string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return id, nil
+	}
+	id, err := lookup(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// listenUnix listens on the unix socket at path, replacing the socket file
+// a previous run left behind unless something still accepts connections on
+// it, and applies the socket options.
+func listenUnix(path string, options *socketOptions) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix socket '%v' is in use", path)
+		}
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if options.hasMode {
+		if err := os.Chmod(path, options.mode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	if options.uid != -1 || options.gid != -1 {
+		if err := os.Chown(path, options.uid, options.gid); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// multiListener accepts the connections of several listeners as one.
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptedConn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// acceptedConn is the result of an Accept on one of a multiListener's
+// listeners.
+type acceptedConn struct {
+	conn net.Conn
+	err  error
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	this := &multiListener{listeners: listeners, accepted: make(chan acceptedConn), closed: make(chan struct{})}
+	for _, listener := range listeners {
+		go this.accept(listener)
+	}
+	return this
+}
+
+// accept passes on what listener accepts until it is closed.
+func (this *multiListener) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		select {
+		case this.accepted <- acceptedConn{conn, err}:
+		case <-this.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+func (this *multiListener) Accept() (net.Conn, error) {
+	select {
+	case accepted := <-this.accepted:
+		return accepted.conn, accepted.err
+	case <-this.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes every listener.
+func (this *multiListener) Close() error {
+	var err error
+	this.closeOnce.Do(func() {
+		close(this.closed)
+		for _, listener := range this.listeners {
+			if closeErr := listener.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+// Addr is the address of the first listener.
+func (this *multiListener) Addr() net.Addr {
+	return this.listeners[0].Addr()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unixClient is a client reaching the http server on the unix socket at path.
+func unixClient(path string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		Timeout:       10 * time.Second,
+	}
+}
+
+func TestServerListensOnSeveralAddresses(t *testing.T) {
+	path := socketPath(t, "goweb.sock")
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0 unix:" + path, UnixSocketMode: "0600",
+		Hosts: []*Host{redirectHost("example.com")}}
+	client := startTestServer(t, server)
+
+	for name, client := range map[string]*http.Client{"tcp": client, "unix": unixClient(path)} {
+		resp := get(t, client, "http://example.com/")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMovedPermanently {
+			t.Errorf("%v: status = %v, want %v", name, resp.StatusCode, http.StatusMovedPermanently)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	addr := server.listener.Addr().String()
+	server.Shutdown()
+	if accepting(addr) {
+		t.Error("the tcp address still accepts connections after Shutdown")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left behind after Shutdown: %v", err)
+	}
+}
+
+func TestTCPServerListensOnUnixSocket(t *testing.T) {
+	path := socketPath(t, "tcp.sock")
+	server := &Server{Name: "tcp-edge", Type: "tcp", Listen: "127.0.0.1:0 unix://" + path,
+		Hosts: []*Host{{Name: "db", Upstream: startEchoServer(t)}}}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() = %v, want nil", err)
+	}
+	t.Cleanup(func() { server.Shutdown() })
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte("ping"))
+	conn.(*net.UnixConn).CloseWrite()
+	if got, _ := io.ReadAll(conn); string(got) != "ping" {
+		t.Errorf("read %q, want %q", got, "ping")
+	}
+}
+
+func TestListenUnixSocketFiles(t *testing.T) {
+	path := socketPath(t, "goweb.sock")
+
+	// a socket file left behind by a previous run is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err := listenUnix(path, &socketOptions{uid: os.Getuid(), gid: -1})
+	if err != nil {
+		t.Fatalf("listenUnix() over a stale socket = %v, want nil", err)
+	}
+	defer listener.Close()
+
+	// one still accepting connections is not
+	if _, err := listenUnix(path, &socketOptions{uid: -1, gid: -1}); err == nil || !strings.Contains(err.Error(), "is in use") {
+		t.Errorf("listenUnix() over a live socket = %v, want it refused", err)
+	}
+}
+
+func TestStartRejectsInvalidListen(t *testing.T) {
+	cases := []struct {
+		name   string
+		server *Server
+		want   string
+	}{
+		{"no address", &Server{Listen: " "}, "listen is required"},
+		{"bad mode", &Server{Listen: "unix:/tmp/x.sock", UnixSocketMode: "rw"}, "invalid unix_socket_mode 'rw'"},
+		{"mode out of range", &Server{Listen: "unix:/tmp/x.sock", UnixSocketMode: "7777"}, "invalid unix_socket_mode '7777'"},
+		{"unknown owner", &Server{Listen: "unix:/tmp/x.sock", UnixSocketOwner: "no-such-user-goweb"}, "invalid unix_socket_owner"},
+		{"one bad address", &Server{Listen: "127.0.0.1:0 127.0.0.1"}, "missing port"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := c.server
+			server.Name, server.Type, server.Hosts = "edge", "http", []*Host{redirectHost("example.com")}
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %q, want it to mention %q", err, c.want)
+			}
+			if server.listener != nil {
+				t.Error("listener is non-nil, want the addresses opened so far closed")
+			}
+		})
+	}
+}
+
+func TestSocketOptionsNumericOwner(t *testing.T) {
+	uid, gid := strconv.Itoa(os.Getuid()), strconv.Itoa(os.Getgid())
+	server := &Server{UnixSocketOwner: uid + ":" + gid}
+	options, err := server.socketOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.uid != os.Getuid() || options.gid != os.Getgid() || options.hasMode {
+		t.Errorf("options = %+v, want uid %v, gid %v and no mode", options, uid, gid)
+	}
+}
@@ -65,6 +65,7 @@ type responseRecorder struct {
 	bytes       int64
 	wroteHeader bool
 	hijacked    bool
+	attrs       []any // added by handlers, see addAccessAttrs
 }
 
 func (this *responseRecorder) WriteHeader(status int) {
@@ -97,6 +98,22 @@ func (this *responseRecorder) Unwrap() http.ResponseWriter {
 	return this.ResponseWriter
 }
 
+// addAccessAttrs adds attributes to the access record of the request w
+// answers, if it is logged.
+func addAccessAttrs(w http.ResponseWriter, attrs ...any) {
+	for {
+		switch this := w.(type) {
+		case *responseRecorder:
+			this.attrs = append(this.attrs, attrs...)
+			return
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = this.Unwrap()
+		default:
+			return
+		}
+	}
+}
+
 // logAccess wraps next and writes one access record per request.
 func (this *Server) logAccess(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -109,7 +126,7 @@ func (this *Server) logAccess(next http.Handler) http.Handler {
 			// returns when the tunneled session ends
 			status = http.StatusSwitchingProtocols
 		}
-		accessLog.Info("access",
+		accessLog.Info("access", append([]any{
 			"server", this.Name,
 			"host", normalizeHost(r.Host),
 			"client", clientIP(r.RemoteAddr),
@@ -121,7 +138,7 @@ func (this *Server) logAccess(next http.Handler) http.Handler {
 			"duration_ms", durationMs(start),
 			"referer", r.Referer(),
 			"user_agent", r.UserAgent(),
-		)
+		}, rec.attrs...)...)
 	})
 }
 
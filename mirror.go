@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Mirroring limits. Requests arriving while a host has mirrorMaxInFlight
+// copies in flight are not mirrored, so a slow mirror can't pile up
+// goroutines and buffered bodies.
+const (
+	mirrorMaxInFlight = 64
+	mirrorTimeout     = 30 * time.Second
+)
+
+// mirror is a host's parsed mirror_urls, mirror_percent and
+// mirror_body_limit.
+type mirror struct {
+	host      string
+	targets   []*mirrorTarget
+	percent   int
+	bodyLimit int64
+	slots     chan struct{} // holds one value per copy in flight
+}
+
+// mirrorTarget is one of the mirror URLs and the proxy sending it copies.
+type mirrorTarget struct {
+	target *url.URL
+	proxy  *httputil.ReverseProxy
+}
+
+// mirrorRecorder is the response writer of a copy, keeping what the access
+// record needs and discarding the body.
+type mirrorRecorder struct {
+	header http.Header
+	status int
+	bytes  int64
+	err    error
+}
+
+func (rec *mirrorRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *mirrorRecorder) WriteHeader(status int) {
+	if rec.status == 0 && status >= 200 {
+		rec.status = status
+	}
+}
+
+func (rec *mirrorRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.bytes += int64(len(b))
+	return len(b), nil
+}
+
+// buildMirror validates the host's mirror settings, which its
+// reverse_proxy upstreams are built with. Mirroring is off unless
+// mirror_urls is set.
+func (host *Host) buildMirror() error {
+	host.mirror = nil
+	if host.MirrorPercent < 0 || host.MirrorPercent > 100 {
+		return fmt.Errorf("mirror_percent must be between 0 and 100 for host: %v", host.Name)
+	}
+	if host.MirrorBodyLimit < 0 {
+		return fmt.Errorf("mirror_body_limit must not be negative for host: %v", host.Name)
+	}
+	urls := strings.Fields(host.MirrorURLs)
+	if len(urls) == 0 {
+		if host.MirrorPercent != 0 || host.MirrorBodyLimit != 0 {
+			return fmt.Errorf("mirror_percent and mirror_body_limit need mirror_urls for host: %v", host.Name)
+		}
+		return nil
+	}
+	m := &mirror{host: host.Name, percent: 100, bodyLimit: host.MirrorBodyLimit, slots: make(chan struct{}, mirrorMaxInFlight)}
+	if host.MirrorPercent > 0 {
+		m.percent = host.MirrorPercent
+	}
+	for _, mirrorURL := range urls {
+		target, address, transport, err := host.upstreamURL(mirrorURL)
+		if err != nil {
+			return fmt.Errorf("invalid mirror URL '%v' for host: %v: %v", mirrorURL, host.Name, err)
+		}
+		m.targets = append(m.targets, &mirrorTarget{target: target, proxy: &httputil.ReverseProxy{
+			Transport: transport,
+			Rewrite: func(r *httputil.ProxyRequest) {
+				host.rewriteRequest(r, address)
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				w.(*mirrorRecorder).err = err
+			},
+		}})
+	}
+	host.mirror = m
+	return nil
+}
+
+// send copies r to every mirror URL in the background when r is among the
+// sampled percent of requests. It returns the request to proxy, whose body
+// is read from memory once it has been copied. Upgrades are never mirrored,
+// and neither are requests with a body larger than mirror_body_limit.
+func (m *mirror) send(r *http.Request) *http.Request {
+	if m == nil || r.Header.Get("Upgrade") != "" || rand.IntN(100) >= m.percent {
+		return r
+	}
+	body, ok := replayableBody(r, m.bodyLimit)
+	if !ok {
+		slog.Debug("Mirror skipped, request body over mirror_body_limit", "host", m.host, "uri", r.RequestURI)
+		return r
+	}
+	if body != nil {
+		r = r.WithContext(r.Context())
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	// the copies outlive the request, so they get a context of their own
+	// with only the values the upstream request is built from. Keeping the
+	// server's values would make ReverseProxy panic when copying a
+	// mirror's body fails, in a goroutine nothing recovers.
+	ctx := context.Background()
+	for _, key := range []any{requestIDKey{}, peerKey{}} {
+		if value := r.Context().Value(key); value != nil {
+			ctx = context.WithValue(ctx, key, value)
+		}
+	}
+	for _, t := range m.targets {
+		select {
+		case m.slots <- struct{}{}:
+		default:
+			slog.Debug("Mirror skipped, too many in flight", "host", m.host, "mirror", t.target.String(), "uri", r.RequestURI)
+			continue
+		}
+		req := r.Clone(ctx)
+		req.Body = http.NoBody
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		go m.do(t, req)
+	}
+	return r
+}
+
+// do sends the copy r to t, discarding the response, and writes its own
+// access record, apart from the client's.
+func (m *mirror) do(t *mirrorTarget, r *http.Request) {
+	defer func() { <-m.slots }()
+	ctx, cancel := context.WithTimeout(r.Context(), mirrorTimeout)
+	defer cancel()
+	start := time.Now()
+	rec := &mirrorRecorder{header: http.Header{}}
+	t.proxy.ServeHTTP(rec, r.WithContext(ctx))
+	attrs := []any{
+		"host", m.host,
+		"mirror", t.target.String(),
+		"client", clientIP(r.RemoteAddr),
+		"method", r.Method,
+		"uri", r.RequestURI,
+		"status", rec.status,
+		"bytes", rec.bytes,
+		"duration_ms", durationMs(start),
+	}
+	if rec.err != nil {
+		attrs = append(attrs, "err", rec.err.Error())
+	}
+	accessLog.Info("mirror", attrs...)
+}
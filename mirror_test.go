@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mirroredRequest is what a mirror received.
+type mirroredRequest struct {
+	method, uri, host, forwardedFor, body string
+}
+
+// mirrorServer is a mirror answering 201, passing on what it receives.
+func mirrorServer(t *testing.T) (*httptest.Server, <-chan mirroredRequest) {
+	t.Helper()
+	received := make(chan mirroredRequest, 100)
+	srv := echoServer(t, "mirror", func(w http.ResponseWriter, r *http.Request) bool {
+		body, _ := io.ReadAll(r.Body)
+		received <- mirroredRequest{r.Method, r.RequestURI, r.Host, r.Header.Get("X-Forwarded-For"), string(body)}
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "ignored")
+		return true
+	})
+	return srv, received
+}
+
+// mirrorRecords returns the mirror records in buf.
+func mirrorRecords(t *testing.T, buf *syncBuffer) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	for _, line := range buf.records() {
+		if record := parseRecord(t, line); record["msg"] == "mirror" {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestMirrorCopiesRequests(t *testing.T) {
+	logs := captureAccessLog(t)
+	shadow, received := mirrorServer(t)
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: echoServer(t, "primary").URL,
+		MirrorURLs: shadow.URL, MirrorBodyLimit: 1024,
+	}}}
+	client := startTestServer(t, server)
+
+	resp, err := client.Post("http://proxy.example.com/orders?draft=1", "text/plain", strings.NewReader("one order"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := bodyString(t, resp); resp.StatusCode != http.StatusOK || !strings.Contains(body, "primary") {
+		t.Fatalf("client got %v %q, want the primary's answer", resp.StatusCode, body)
+	}
+
+	select {
+	case got := <-received:
+		want := mirroredRequest{"POST", "/orders?draft=1", "proxy.example.com", "127.0.0.1", "one order"}
+		if got != want {
+			t.Errorf("mirror received %+v, want %+v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the mirror received nothing")
+	}
+	waitFor(t, "the mirror record", func() bool { return len(mirrorRecords(t, logs)) == 1 })
+	record := mirrorRecords(t, logs)[0]
+	if record["mirror"] != shadow.URL || record["status"] != float64(http.StatusCreated) ||
+		record["bytes"] != float64(len("ignored")) || record["uri"] != "/orders?draft=1" {
+		t.Errorf("mirror record = %v", record)
+	}
+}
+
+func TestMirrorDoesNotDelayClients(t *testing.T) {
+	logs := captureAccessLog(t)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(slow.Close)
+	dead := deadURL(t)
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: echoServer(t, "primary").URL,
+		MirrorURLs: slow.URL + " " + dead,
+	}}}
+	client := startTestServer(t, server)
+
+	start := time.Now()
+	if got := upstreamOf(t, client, "http://proxy.example.com/"); got != "primary" {
+		t.Fatalf("reached %q, want primary", got)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the request took %v, want it not to wait for the slow mirror", elapsed)
+	}
+
+	waitFor(t, "both mirror records", func() bool { return len(mirrorRecords(t, logs)) == 2 })
+	for _, record := range mirrorRecords(t, logs) {
+		switch record["mirror"] {
+		case slow.URL:
+			if record["status"] != float64(http.StatusInternalServerError) || record["err"] != nil {
+				t.Errorf("slow mirror record = %v, want its 500", record)
+			}
+		case dead:
+			if record["status"] != float64(0) || record["err"] == nil {
+				t.Errorf("dead mirror record = %v, want the connection error", record)
+			}
+		}
+	}
+	// a failing mirror is not an upstream failure
+	for _, state := range server.upstreamStates() {
+		if state.Fails != 0 {
+			t.Errorf("upstream %v has %v fails, want mirrors not to count", state.URL, state.Fails)
+		}
+	}
+}
+
+// a mirror cutting its response short must not take the process down with
+// it, as a panic in the background copy would
+func TestMirrorSurvivesBrokenResponses(t *testing.T) {
+	logs := captureAccessLog(t)
+	broken := cutShortServer(t)
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: echoServer(t, "primary").URL,
+		MirrorURLs: broken.URL,
+	}}}
+	client := startTestServer(t, server)
+
+	for range 3 {
+		if got := upstreamOf(t, client, "http://proxy.example.com/"); got != "primary" {
+			t.Fatalf("reached %q, want primary", got)
+		}
+	}
+	waitFor(t, "the mirror records", func() bool { return len(mirrorRecords(t, logs)) == 3 })
+	for _, record := range mirrorRecords(t, logs) {
+		if record["status"] != float64(http.StatusOK) || record["bytes"] != float64(len("partial")) {
+			t.Errorf("mirror record = %v, want the part that came", record)
+		}
+	}
+}
+
+func TestMirrorSkipsLargeBodiesAndSamples(t *testing.T) {
+	var mirrored atomic.Int64
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored.Add(1)
+	}))
+	t.Cleanup(shadow.Close)
+	host := &Host{Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: echoServer(t, "primary").URL,
+		MirrorURLs: shadow.URL, MirrorBodyLimit: 4}
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+	client := startTestServer(t, server)
+
+	// too large to copy, yet the primary gets it in full
+	resp, err := client.Post("http://proxy.example.com/", "text/plain", strings.NewReader("more than four"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	time.Sleep(100 * time.Millisecond)
+	if got := mirrored.Load(); got != 0 {
+		t.Errorf("mirror received %v requests, want a body over mirror_body_limit skipped", got)
+	}
+
+	host.mirror.percent = 25
+	const requests = 200
+	for range requests {
+		get(t, client, "http://proxy.example.com/").Body.Close()
+	}
+	waitFor(t, "the sampled copies", func() bool { return len(host.mirror.slots) == 0 })
+	if got := mirrored.Load(); got < requests/8 || got > requests*3/8 {
+		t.Errorf("mirror received %v of %v requests, want about a quarter", got, requests)
+	}
+}
+
+func TestStartRejectsInvalidMirror(t *testing.T) {
+	cases := []struct {
+		name string
+		host *Host
+		want string
+	}{
+		{"bad url", &Host{MirrorURLs: "ftp://shadow.example.com"}, "invalid mirror URL 'ftp://shadow.example.com'"},
+		{"percent over 100", &Host{MirrorURLs: "http://127.0.0.1:1", MirrorPercent: 101}, "mirror_percent must be between 0 and 100"},
+		{"negative body limit", &Host{MirrorURLs: "http://127.0.0.1:1", MirrorBodyLimit: -1}, "mirror_body_limit must not be negative"},
+		{"percent without urls", &Host{MirrorPercent: 10}, "need mirror_urls"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host := c.host
+			host.Name, host.Type, host.ForwardURLs = "proxy.example.com", "reverse_proxy", "http://127.0.0.1:1"
+			server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %q, want it to mention %q", err, c.want)
+			}
+		})
+	}
+}
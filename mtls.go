@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Headers carrying a verified client certificate to upstreams. Incoming
+// copies are always removed so clients cannot forge them.
+const (
+	clientCertSubjectHeader     = "X-Client-Cert-Subject"
+	clientCertFingerprintHeader = "X-Client-Cert-Fingerprint"
+)
+
+// clientAuthTypes maps the client_auth values onto crypto/tls policies.
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                tls.NoClientCert,
+	"none":            tls.NoClientCert,
+	"request":         tls.RequestClientCert,
+	"require":         tls.RequireAndVerifyClientCert,
+	"verify-if-given": tls.VerifyClientCertIfGiven,
+}
+
+// buildClientAuth validates the host's client_auth and client_ca_path and
+// builds the TLS config used for handshakes with its names: base with the
+// host's client certificate policy on top. Hosts without client_auth use
+// base itself.
+func (host *Host) buildClientAuth(base *tls.Config) error {
+	host.tlsConfig = nil
+	authType, ok := clientAuthTypes[host.ClientAuth]
+	if !ok {
+		return fmt.Errorf("invalid client_auth '%v'", host.ClientAuth)
+	}
+	if authType == tls.NoClientCert {
+		return nil
+	}
+	var pool *x509.CertPool
+	if host.ClientCAPath != "" {
+		pem, err := os.ReadFile(host.ClientCAPath)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client_ca_path '%v'", host.ClientCAPath)
+		}
+	} else if authType != tls.RequestClientCert {
+		return fmt.Errorf("client_ca_path is required for client_auth '%v'", host.ClientAuth)
+	}
+	config := base.Clone()
+	config.GetConfigForClient = nil
+	config.ClientAuth = authType
+	config.ClientCAs = pool
+	host.tlsConfig = config
+	return nil
+}
+
+// getConfigForClient picks the TLS config for a handshake: the ACME
+// challenge config for TLS-ALPN-01 validation, otherwise the client
+// certificate policy of the host the SNI name routes to. Returning nil
+// continues with the server's own config.
+func (this *Server) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if config, err := acmeALPNConfig(hello); config != nil || err != nil {
+		return config, err
+	}
+	host := this.routeHost(normalizeHost(hello.ServerName))
+	if host == nil || host.Disabled {
+		return nil, nil
+	}
+	return host.tlsConfig, nil
+}
+
+// misdirected reports whether r reached host over a connection whose
+// handshake was made for another name. The client certificate policy is
+// applied per SNI name, so a host with client_auth must not be served on a
+// connection negotiated without it — whether by a forged Host header or by
+// HTTP/2 connection reuse. 421 makes clients retry on a fresh connection.
+func (this *Server) misdirected(host *Host, r *http.Request) bool {
+	if host.tlsConfig == nil || r.TLS == nil {
+		return false
+	}
+	return this.routeHost(normalizeHost(r.TLS.ServerName)) != host
+}
+
+// setClientCertHeaders replaces any client certificate headers on out with
+// the verified certificate of in, if it has one.
+func setClientCertHeaders(out http.Header, in *http.Request) {
+	out.Del(clientCertSubjectHeader)
+	out.Del(clientCertFingerprintHeader)
+	if in.TLS == nil || len(in.TLS.VerifiedChains) == 0 {
+		return
+	}
+	leaf := in.TLS.VerifiedChains[0][0]
+	fingerprint := sha256.Sum256(leaf.Raw)
+	out.Set(clientCertSubjectHeader, leaf.Subject.String())
+	out.Set(clientCertFingerprintHeader, hex.EncodeToString(fingerprint[:]))
+}
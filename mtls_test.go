@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeClientCA writes a CA certificate to dir and returns its path together
+// with a client certificate it issued for commonName.
+func writeClientCA(t *testing.T, dir, commonName string) (caPath string, client tls.Certificate) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPath = filepath.Join(dir, "client-ca.pem")
+	if err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return caPath, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// sniClient is a client that always handshakes for serverName, whatever the
+// request URL's host, presenting certs if any.
+func sniClient(addr, serverName string, certs ...tls.Certificate) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+			TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true, Certificates: certs},
+		},
+		Timeout: 10 * time.Second,
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	caPath, clientCert := writeClientCA(t, dir, "alice")
+	upstream := echoServer(t, "api")
+	secureCert, secureKey := writeSelfSignedCert(t, dir, "secure.example.com")
+	openCert, openKey := writeSelfSignedCert(t, dir, "open.example.com")
+	server := &Server{Name: "edge", Type: "https", Listen: "127.0.0.1:0", Hosts: []*Host{
+		{
+			Name: "secure.example.com", Type: "reverse_proxy", ForwardURLs: upstream.URL,
+			CertPath: secureCert, KeyPath: secureKey,
+			ClientAuth: "require", ClientCAPath: caPath,
+		},
+		{
+			Name: "open.example.com", Type: "reverse_proxy", ForwardURLs: upstream.URL,
+			CertPath: openCert, KeyPath: openKey,
+		},
+	}}
+	startTestServer(t, server)
+	addr := server.listener.Addr().String()
+
+	upstreamSaw := func(t *testing.T, resp *http.Response) map[string]string {
+		t.Helper()
+		var body map[string]string
+		if err := json.Unmarshal([]byte(bodyString(t, resp)), &body); err != nil {
+			t.Fatalf("decoding upstream response: %v", err)
+		}
+		return body
+	}
+
+	t.Run("verified certificate is forwarded", func(t *testing.T) {
+		resp, err := sniClient(addr, "secure.example.com", clientCert).Get("https://secure.example.com/")
+		if err != nil {
+			t.Fatalf("GET with a client certificate: %v", err)
+		}
+		body := upstreamSaw(t, resp)
+		fingerprint := sha256.Sum256(clientCert.Certificate[0])
+		if body["subject"] != "CN=alice" || body["sha256"] != hex.EncodeToString(fingerprint[:]) {
+			t.Errorf("upstream saw subject %q and fingerprint %q, want alice's", body["subject"], body["sha256"])
+		}
+	})
+
+	t.Run("missing certificate is refused", func(t *testing.T) {
+		resp, err := sniClient(addr, "secure.example.com").Get("https://secure.example.com/")
+		if err == nil {
+			resp.Body.Close()
+			t.Fatalf("GET without a client certificate: status %v, want the handshake refused", resp.StatusCode)
+		}
+	})
+
+	t.Run("forged headers are stripped", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "https://open.example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(clientCertSubjectHeader, "CN=admin")
+		req.Header.Set(clientCertFingerprintHeader, "00")
+		resp, err := sniClient(addr, "open.example.com").Do(req)
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		if body := upstreamSaw(t, resp); body["subject"] != "" || body["sha256"] != "" {
+			t.Errorf("upstream saw subject %q and fingerprint %q, want both stripped", body["subject"], body["sha256"])
+		}
+	})
+
+	t.Run("other name's connection is misdirected", func(t *testing.T) {
+		resp, err := sniClient(addr, "open.example.com").Get("https://secure.example.com/")
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMisdirectedRequest {
+			t.Errorf("status = %v, want %v", resp.StatusCode, http.StatusMisdirectedRequest)
+		}
+	})
+}
+
+func TestClientAuthVerifyIfGiven(t *testing.T) {
+	caPath, _ := writeClientCA(t, t.TempDir(), "alice")
+	host := &Host{Name: "a.example.com", ClientAuth: "verify-if-given", ClientCAPath: caPath}
+	if err := host.buildClientAuth(&tls.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := host.tlsConfig.ClientAuth; got != tls.VerifyClientCertIfGiven {
+		t.Errorf("client_auth verify-if-given = %v, want %v", got, tls.VerifyClientCertIfGiven)
+	}
+}
+
+func TestStartRejectsInvalidClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeSelfSignedCert(t, dir, "a.example.com")
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name, clientAuth, caPath, want string
+	}{
+		{"unknown mode", "sometimes", "", "invalid client_auth"},
+		{"require without a CA", "require", "", "client_ca_path is required"},
+		{"missing CA file", "verify-if-given", filepath.Join(dir, "missing.pem"), "no such file"},
+		{"CA file without certificates", "require", garbage, "no certificates found"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host := redirectHost("a.example.com")
+			host.CertPath, host.KeyPath = certPath, keyPath
+			host.ClientAuth, host.ClientCAPath = c.clientAuth, c.caPath
+			server := &Server{Name: "edge", Type: "https", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) || host.Status == "" {
+				t.Errorf("error = %q, host Status = %q, want %q recorded on the host", err, host.Status, c.want)
+			}
+			if server.listener != nil {
+				t.Error("listener is non-nil, want no port bound")
+			}
+		})
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// OCSP stapling per RFC 6960: for every served certificate whose chain
+// includes its issuer, the responder named in the certificate — or the
+// server's ocsp_responder — is asked for the certificate's status, and the
+// signed answer is attached to the handshake so clients need not ask
+// themselves. Answers are cached on disk so a restart staples at once.
+
+const (
+	ocspDefaultStorage = "ocsp"
+	ocspRetryInterval  = 10 * time.Minute
+	ocspTimeout        = 30 * time.Second
+	// ocspDefaultValidity is how long an answer without a nextUpdate is
+	// relied on before asking again.
+	ocspDefaultValidity = time.Hour
+	ocspMaxResponseSize = 1 << 20
+)
+
+// ocspCheckInterval is how often the served certificates are checked for a
+// missing or ageing staple. A variable so tests can check faster.
+var ocspCheckInterval = time.Minute
+
+var (
+	oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidSHA1      = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+)
+
+// ocspSignatureAlgorithms maps the signature algorithms responders use onto
+// crypto/x509's.
+var ocspSignatureAlgorithms = map[string]x509.SignatureAlgorithm{
+	"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+	"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+	"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+	"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+	"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+	"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+	"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+	"1.3.101.112":           x509.PureEd25519,
+}
+
+type ocspCertID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest ocspTBSRequest
+}
+
+type ocspTBSRequest struct {
+	RequestList []ocspSingleRequest
+}
+
+type ocspSingleRequest struct {
+	CertID ocspCertID
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version     int `asn1:"optional,default:0,explicit,tag:0"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+	Extensions  []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked    ocspRevokedInfo  `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate time.Time        `asn1:"generalized"`
+	NextUpdate time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	Extensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+// ocspCertIDFor identifies leaf to its issuer's responder, hashing with
+// hash, which must be SHA-1 or SHA-256.
+func ocspCertIDFor(leaf, issuer *x509.Certificate, hash crypto.Hash) (ocspCertID, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return ocspCertID{}, err
+	}
+	id := ocspCertID{SerialNumber: leaf.SerialNumber}
+	switch hash {
+	case crypto.SHA1:
+		nameHash := sha1.Sum(issuer.RawSubject)
+		keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+		id.HashAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue}
+		id.IssuerNameHash, id.IssuerKeyHash = nameHash[:], keyHash[:]
+	case crypto.SHA256:
+		nameHash := sha256.Sum256(issuer.RawSubject)
+		keyHash := sha256.Sum256(spki.PublicKey.RightAlign())
+		id.HashAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+		id.IssuerNameHash, id.IssuerKeyHash = nameHash[:], keyHash[:]
+	default:
+		return ocspCertID{}, fmt.Errorf("unsupported OCSP hash %v", hash)
+	}
+	return id, nil
+}
+
+// matches reports whether id names the same certificate as the SHA-1 or
+// SHA-256 id computed for leaf.
+func (id ocspCertID) matches(leaf, issuer *x509.Certificate) bool {
+	hash := crypto.SHA1
+	if id.HashAlgorithm.Algorithm.Equal(oidSHA256) {
+		hash = crypto.SHA256
+	} else if !id.HashAlgorithm.Algorithm.Equal(oidSHA1) {
+		return false
+	}
+	want, err := ocspCertIDFor(leaf, issuer, hash)
+	if err != nil || id.SerialNumber == nil {
+		return false
+	}
+	return id.SerialNumber.Cmp(want.SerialNumber) == 0 &&
+		bytes.Equal(id.IssuerNameHash, want.IssuerNameHash) &&
+		bytes.Equal(id.IssuerKeyHash, want.IssuerKeyHash)
+}
+
+// newOCSPRequest builds the DER request for leaf's status.
+func newOCSPRequest(leaf, issuer *x509.Certificate) ([]byte, error) {
+	id, err := ocspCertIDFor(leaf, issuer, crypto.SHA1)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(ocspRequest{TBSRequest: ocspTBSRequest{RequestList: []ocspSingleRequest{{CertID: id}}}})
+}
+
+// parseOCSPResponse checks that der is a successful response signed by
+// issuer, or by a responder issuer delegated to, and returns its answer
+// about leaf.
+func parseOCSPResponse(der []byte, leaf, issuer *x509.Certificate) (*ocspSingleResponse, error) {
+	var resp ocspResponse
+	if rest, err := asn1.Unmarshal(der, &resp); err != nil {
+		return nil, fmt.Errorf("malformed OCSP response: %v", err)
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after OCSP response")
+	}
+	if resp.Status != 0 {
+		return nil, fmt.Errorf("OCSP responder returned status %v", resp.Status)
+	}
+	if !resp.Response.ResponseType.Equal(oidOCSPBasic) {
+		return nil, fmt.Errorf("unsupported OCSP response type %v", resp.Response.ResponseType)
+	}
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil {
+		return nil, fmt.Errorf("malformed OCSP response: %v", err)
+	}
+	var data ocspResponseData
+	if _, err := asn1.Unmarshal(basic.TBSResponseData.FullBytes, &data); err != nil {
+		return nil, fmt.Errorf("malformed OCSP response data: %v", err)
+	}
+
+	signer := issuer
+	if len(basic.Certificates) > 0 {
+		responder, err := x509.ParseCertificate(basic.Certificates[0].FullBytes)
+		if err != nil {
+			return nil, fmt.Errorf("malformed OCSP responder certificate: %v", err)
+		}
+		if !bytes.Equal(responder.Raw, issuer.Raw) {
+			if err := responder.CheckSignatureFrom(issuer); err != nil {
+				return nil, fmt.Errorf("OCSP responder certificate not issued by the certificate's issuer: %v", err)
+			}
+			delegated := false
+			for _, usage := range responder.ExtKeyUsage {
+				delegated = delegated || usage == x509.ExtKeyUsageOCSPSigning
+			}
+			if !delegated {
+				return nil, errors.New("OCSP responder certificate is not authorized for OCSP signing")
+			}
+			signer = responder
+		}
+	}
+	algorithm, ok := ocspSignatureAlgorithms[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported OCSP signature algorithm %v", basic.SignatureAlgorithm.Algorithm)
+	}
+	if err := signer.CheckSignature(algorithm, basic.TBSResponseData.FullBytes, basic.Signature.RightAlign()); err != nil {
+		return nil, fmt.Errorf("bad OCSP response signature: %v", err)
+	}
+
+	for i := range data.Responses {
+		if data.Responses[i].CertID.matches(leaf, issuer) {
+			return &data.Responses[i], nil
+		}
+	}
+	return nil, errors.New("OCSP response does not cover the certificate")
+}
+
+// ocspNeedsRefresh reports whether resp is past the middle of its validity
+// window, leaving the other half for retries before it expires.
+func ocspNeedsRefresh(resp *ocspSingleResponse, now time.Time) bool {
+	refreshAt := resp.ThisUpdate.Add(ocspDefaultValidity)
+	if !resp.NextUpdate.IsZero() {
+		refreshAt = resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+	}
+	return !now.Before(refreshAt)
+}
+
+// ocspExpired reports whether resp can no longer be stapled.
+func ocspExpired(resp *ocspSingleResponse, now time.Time) bool {
+	if resp.NextUpdate.IsZero() {
+		return !now.Before(resp.ThisUpdate.Add(ocspDefaultValidity))
+	}
+	return !now.Before(resp.NextUpdate)
+}
+
+func (this *Server) ocspDir() string {
+	if this.OCSPStorage != "" {
+		return this.OCSPStorage
+	}
+	return ocspDefaultStorage
+}
+
+// manageOCSP keeps the staples of the server's certificates fresh, checking
+// every interval until done is closed. A failed certificate is retried after
+// ocspRetryInterval; a new certificate, from a reload or renewal, is stapled
+// on the next check.
+func (this *Server) manageOCSP(interval time.Duration, done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+	retryAt := map[*tls.Certificate]time.Time{}
+	for {
+		now := time.Now()
+		current := map[*tls.Certificate]time.Time{}
+		for _, host := range this.Hosts {
+			cert := host.certificate.Load()
+			if host.Disabled || cert == nil {
+				continue
+			}
+			if now.Before(retryAt[cert]) {
+				current[cert] = retryAt[cert]
+				continue
+			}
+			if err := this.staple(ctx, host, cert); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				current[cert] = now.Add(ocspRetryInterval)
+				slog.Warn("Failed to staple OCSP response", "host", host.Name, "server", this.Name, "err", err)
+			}
+		}
+		retryAt = current
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// staple attaches a fresh OCSP response to cert, which the host serves,
+// from the disk cache or else the responder. A cached response that is
+// ageing but still valid is stapled when the responder cannot be reached.
+// Certificates without their issuer in the chain, or without a responder,
+// are left alone.
+func (this *Server) staple(ctx context.Context, host *Host, cert *tls.Certificate) error {
+	leaf := cert.Leaf
+	if leaf == nil || len(cert.Certificate) < 2 {
+		return nil
+	}
+	responder := this.OCSPResponder
+	if responder == "" {
+		if len(leaf.OCSPServer) == 0 {
+			return nil
+		}
+		responder = leaf.OCSPServer[0]
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if cert.OCSPStaple != nil {
+		if resp, err := parseOCSPResponse(cert.OCSPStaple, leaf, issuer); err == nil && !ocspNeedsRefresh(resp, now) {
+			return nil
+		}
+	}
+
+	fingerprint := sha256.Sum256(leaf.Raw)
+	cachePath := filepath.Join(this.ocspDir(), hex.EncodeToString(fingerprint[:])+".der")
+	var fallback []byte
+	if der, err := os.ReadFile(cachePath); err == nil {
+		if resp, err := parseOCSPResponse(der, leaf, issuer); err == nil && !ocspExpired(resp, now) {
+			if !ocspNeedsRefresh(resp, now) {
+				this.attachStaple(host, cert, der, resp)
+				return nil
+			}
+			fallback = der
+		}
+	}
+
+	der, resp, err := fetchOCSP(ctx, responder, leaf, issuer)
+	if err == nil && ocspExpired(resp, now) {
+		err = errors.New("OCSP responder returned an expired response")
+	}
+	if err != nil {
+		if fallback != nil {
+			resp, _ := parseOCSPResponse(fallback, leaf, issuer)
+			this.attachStaple(host, cert, fallback, resp)
+		}
+		return fmt.Errorf("%v from %v", err, responder)
+	}
+	if err := writeFileAtomic(cachePath, der, 0600); err != nil {
+		slog.Warn("Failed to cache OCSP response", "host", host.Name, "server", this.Name, "err", err)
+	}
+	this.attachStaple(host, cert, der, resp)
+	return nil
+}
+
+// attachStaple starts serving cert with der stapled, unless the host has
+// moved on to another certificate meanwhile.
+func (this *Server) attachStaple(host *Host, cert *tls.Certificate, der []byte, resp *ocspSingleResponse) {
+	stapled := *cert
+	stapled.OCSPStaple = der
+	if !host.certificate.CompareAndSwap(cert, &stapled) {
+		return
+	}
+	if resp.Revoked.RevocationTime.IsZero() {
+		slog.Debug("OCSP response stapled", "host", host.Name, "server", this.Name,
+			"next_update", resp.NextUpdate.Format(time.RFC3339))
+		return
+	}
+	slog.Error("Certificate is revoked", "host", host.Name, "server", this.Name,
+		"revoked_at", resp.Revoked.RevocationTime.Format(time.RFC3339))
+}
+
+// fetchOCSP asks responder for leaf's status. Unknown certificates are an
+// error, since there is nothing useful to staple for them.
+func fetchOCSP(ctx context.Context, responder string, leaf, issuer *x509.Certificate) ([]byte, *ocspSingleResponse, error) {
+	body, err := newOCSPRequest(leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, ocspTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, responder, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder returned HTTP %v", res.StatusCode)
+	}
+	der, err := io.ReadAll(io.LimitReader(res.Body, ocspMaxResponseSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := parseOCSPResponse(der, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Unknown {
+		return nil, nil, errors.New("OCSP responder does not know the certificate")
+	}
+	return der, resp, nil
+}
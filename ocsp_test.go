@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeOCSP is a CA with an OCSP responder answering "good" for everything
+// it issued, signing the responses with the CA key itself.
+type fakeOCSP struct {
+	*httptest.Server
+	caCert   *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+	requests atomic.Int32
+}
+
+func newFakeOCSP(t *testing.T) *fakeOCSP {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test OCSP CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeOCSP{caCert: caCert, caKey: caKey}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.requests.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		var req ocspRequest
+		if _, err := asn1.Unmarshal(body, &req); err != nil || len(req.TBSRequest.RequestList) != 1 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(f.respond(t, req.TBSRequest.RequestList[0].CertID, f.caKey))
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// respond builds a "good" response about id, valid for an hour and signed
+// with key.
+func (f *fakeOCSP) respond(t *testing.T, id ocspCertID, key *ecdsa.PrivateKey) []byte {
+	t.Helper()
+	caID, err := ocspCertIDFor(f.caCert, f.caCert, crypto.SHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responderID, err := asn1.Marshal(caID.IssuerKeyHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	tbs, err := asn1.Marshal(ocspResponseData{
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: responderID},
+		ProducedAt:  now,
+		Responses: []ocspSingleResponse{{
+			CertID:     id,
+			Good:       true,
+			ThisUpdate: now.Add(-time.Minute),
+			NextUpdate: now.Add(time.Hour),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(tbs)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	basic, err := asn1.Marshal(ocspBasicResponse{
+		TBSResponseData:    asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+		Signature:          asn1.BitString{Bytes: signature, BitLength: len(signature) * 8},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(ocspResponse{Response: ocspResponseBytes{ResponseType: oidOCSPBasic, Response: basic}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// issue writes a certificate for name, chained to the CA, into dir, naming
+// ocspURL as its responder when given.
+func (f *fakeOCSP) issue(t *testing.T, dir, name, ocspURL string) (certPath, keyPath string, leaf *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ocspURL != "" {
+		template.OCSPServer = []string{ocspURL}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, f.caCert, &key.PublicKey, f.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})...)
+	certPath = filepath.Join(dir, name+".crt")
+	keyPath = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, chain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath, leaf
+}
+
+func fastOCSPChecks(t *testing.T) {
+	old := ocspCheckInterval
+	ocspCheckInterval = 10 * time.Millisecond
+	t.Cleanup(func() { ocspCheckInterval = old })
+}
+
+// stapledResponse returns the OCSP response stapled to a handshake for
+// serverName, or nil.
+func stapledResponse(t *testing.T, addr, serverName string) []byte {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TLS handshake for %v: %v", serverName, err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().OCSPResponse
+}
+
+// The responder named in the certificate is asked once, its answer stapled
+// and cached, and a restart staples from the cache with the responder gone.
+func TestOCSPStapling(t *testing.T) {
+	fastOCSPChecks(t)
+	ca := newFakeOCSP(t)
+	dir := t.TempDir()
+	storage := filepath.Join(dir, "ocsp")
+	certPath, keyPath, leaf := ca.issue(t, dir, "a.example.com", ca.URL)
+	newServer := func() *Server {
+		host := redirectHost("a.example.com")
+		host.CertPath, host.KeyPath = certPath, keyPath
+		return &Server{Name: "edge", Type: "https", Listen: "127.0.0.1:0", OCSPStorage: storage, Hosts: []*Host{host}}
+	}
+
+	server := newServer()
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() = %v, want nil", err)
+	}
+	addr := server.listener.Addr().String()
+	var staple []byte
+	waitFor(t, "an OCSP staple", func() bool {
+		staple = stapledResponse(t, addr, "a.example.com")
+		return staple != nil
+	})
+	resp, err := parseOCSPResponse(staple, leaf, ca.caCert)
+	if err != nil {
+		t.Fatalf("parsing the staple: %v", err)
+	}
+	if !resp.Good {
+		t.Error("stapled status is not good")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := ca.requests.Load(); got != 1 {
+		t.Errorf("responder asked %v times, want once while the answer is fresh", got)
+	}
+	server.Shutdown()
+
+	ca.Close()
+	server = newServer()
+	if err := server.Start(); err != nil {
+		t.Fatalf("restart: Start() = %v, want nil", err)
+	}
+	defer server.Shutdown()
+	addr = server.listener.Addr().String()
+	waitFor(t, "the cached OCSP staple", func() bool {
+		return string(stapledResponse(t, addr, "a.example.com")) == string(staple)
+	})
+}
+
+// ocsp_responder replaces the responder of certificates, including ones
+// that name none.
+func TestOCSPResponderOverride(t *testing.T) {
+	fastOCSPChecks(t)
+	ca := newFakeOCSP(t)
+	dir := t.TempDir()
+	certPath, keyPath, _ := ca.issue(t, dir, "a.example.com", "")
+	host := redirectHost("a.example.com")
+	host.CertPath, host.KeyPath = certPath, keyPath
+	server := &Server{Name: "edge", Type: "https", Listen: "127.0.0.1:0", Hosts: []*Host{host},
+		OCSPResponder: ca.URL, OCSPStorage: filepath.Join(dir, "ocsp")}
+	startTestServer(t, server)
+	addr := server.listener.Addr().String()
+	waitFor(t, "an OCSP staple", func() bool { return stapledResponse(t, addr, "a.example.com") != nil })
+}
+
+func TestParseOCSPResponseRejects(t *testing.T) {
+	ca := newFakeOCSP(t)
+	dir := t.TempDir()
+	_, _, leaf := ca.issue(t, dir, "a.example.com", "")
+	_, _, other := ca.issue(t, dir, "b.example.com", "")
+	if _, err := ocspCertIDFor(leaf, ca.caCert, crypto.MD5); err == nil {
+		t.Fatal("ocspCertIDFor accepted an unsupported hash")
+	}
+	id, err := ocspCertIDFor(leaf, ca.caCert, crypto.SHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID, err := ocspCertIDFor(other, ca.caCert, crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseOCSPResponse(ca.respond(t, id, ca.caKey), leaf, ca.caCert); err != nil {
+		t.Fatalf("parseOCSPResponse() = %v for a valid response, want nil", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		der  []byte
+		want string
+	}{
+		{"garbage", []byte("not an OCSP response"), "malformed"},
+		{"signed by another key", ca.respond(t, id, otherKey), "bad OCSP response signature"},
+		{"about another certificate", ca.respond(t, otherID, ca.caKey), "does not cover"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := parseOCSPResponse(c.der, leaf, ca.caCert)
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("parseOCSPResponse() = %v, want an error mentioning %q", err, c.want)
+			}
+		})
+	}
+}
+
+func TestOCSPNeedsRefresh(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name                 string
+		thisUpdate           time.Time
+		nextUpdate           time.Time
+		wantRefresh, wantExp bool
+	}{
+		{"fresh", now.Add(-time.Hour), now.Add(7 * 24 * time.Hour), false, false},
+		{"past half its window", now.Add(-4 * 24 * time.Hour), now.Add(3 * 24 * time.Hour), true, false},
+		{"expired", now.Add(-8 * 24 * time.Hour), now.Add(-time.Hour), true, true},
+		{"no next update, recent", now.Add(-time.Minute), time.Time{}, false, false},
+		{"no next update, old", now.Add(-2 * time.Hour), time.Time{}, true, true},
+	}
+	for _, c := range cases {
+		resp := &ocspSingleResponse{ThisUpdate: c.thisUpdate, NextUpdate: c.nextUpdate}
+		if got := ocspNeedsRefresh(resp, now); got != c.wantRefresh {
+			t.Errorf("%v: ocspNeedsRefresh() = %v, want %v", c.name, got, c.wantRefresh)
+		}
+		if got := ocspExpired(resp, now); got != c.wantExp {
+			t.Errorf("%v: ocspExpired() = %v, want %v", c.name, got, c.wantExp)
+		}
+	}
+}
+
+func TestStartRejectsInvalidOCSPResponder(t *testing.T) {
+	certPath, keyPath := writeSelfSignedCert(t, t.TempDir(), "a.example.com")
+	host := redirectHost("a.example.com")
+	host.CertPath, host.KeyPath = certPath, keyPath
+	server := &Server{Name: "edge", Type: "https", Listen: "127.0.0.1:0", Hosts: []*Host{host}, OCSPResponder: "ocsp.example.com"}
+	err := server.Start()
+	if err == nil {
+		server.Shutdown()
+		t.Fatal("Start() = nil, want an error")
+	}
+	if !strings.Contains(err.Error(), "Invalid ocsp_responder") || server.listener != nil {
+		t.Errorf("error = %q, listener = %v, want the responder rejected before listening", err, server.listener)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The signatures opening a PROXY protocol header.
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyV1MaxLength is the longest a v1 header may be, CRLF included.
+const proxyV1MaxLength = 107
+
+// proxyPeekTimeout is how long an optional header is waited for. Balancers
+// send it right away, so a connection quiet for longer is taken to have
+// none, as with protocols where the server speaks first.
+var proxyPeekTimeout = time.Second
+
+// proxyListener reads the PROXY protocol header load balancers such as
+// HAProxy and AWS NLB put before a connection, so its RemoteAddr and
+// LocalAddr are those of the client's original connection.
+type proxyListener struct {
+	net.Listener
+	trusted  trustedProxies // the peers that may send a header
+	required bool           // connections without a header are closed
+}
+
+// proxyConn reads its PROXY header on first use, rather than in Accept, so
+// a slow client can't hold up the ones behind it.
+type proxyConn struct {
+	net.Conn
+	listener      *proxyListener
+	once          sync.Once
+	err           error
+	reader        io.Reader
+	remote, local net.Addr // from the header, nil to keep the connection's own
+}
+
+// checkProxyProtocol validates the server's proxy_protocol. A header is
+// only believed from trusted_proxies, so it needs them: from anyone, a
+// client could claim any address.
+func (this *Server) checkProxyProtocol() error {
+	switch this.ProxyProtocol {
+	case "":
+		return nil
+	case "optional", "required":
+		if len(this.trustedProxies) == 0 {
+			return errors.New("proxy_protocol needs trusted_proxies")
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid proxy_protocol '%v'", this.ProxyProtocol)
+}
+
+// Accept wraps the connections of the listener to read their header.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, listener: l}, nil
+}
+
+// readHeader reads the connection's PROXY header, once. A failure closes
+// the connection, so nothing is answered to it, and is returned by every
+// read after.
+func (c *proxyConn) readHeader() error {
+	c.once.Do(func() {
+		c.err = c.parse()
+		if c.err != nil {
+			slog.Debug("Invalid PROXY protocol header", "client", c.Conn.RemoteAddr().String(), "err", c.err)
+			c.Conn.Close()
+		}
+	})
+	return c.err
+}
+
+func (c *proxyConn) parse() error {
+	c.reader = c.Conn
+	l := c.listener
+	peer, err := netip.ParseAddrPort(c.Conn.RemoteAddr().String())
+	if err != nil || !l.trusted.trusts(peer.Addr()) {
+		if l.required {
+			return errors.New("connection from an untrusted peer")
+		}
+		// its header, if any, is not believed and left to fail the
+		// protocol spoken after it
+		return nil
+	}
+	defer c.Conn.SetReadDeadline(time.Time{})
+	br := bufio.NewReaderSize(c.Conn, 512)
+	c.reader = br
+	if !l.required {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyPeekTimeout))
+		if _, err := br.Peek(1); err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				// nothing came
+				return nil
+			}
+			return err
+		}
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(readHeaderTimeout))
+
+	version, err := detectProxyHeader(br)
+	if err != nil {
+		return err
+	}
+	switch version {
+	case 1:
+		c.remote, c.local, err = readProxyV1(br)
+	case 2:
+		c.remote, c.local, err = readProxyV2(br)
+	default:
+		if l.required {
+			err = errors.New("no PROXY protocol header")
+		}
+	}
+	return err
+}
+
+// detectProxyHeader peeks at as few bytes as it takes to tell whether r
+// starts with a v1 or v2 header, returning its version or 0.
+func detectProxyHeader(r *bufio.Reader) (int, error) {
+	for n := 1; ; n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			return 0, err
+		}
+		v1, v2 := bytes.HasPrefix(proxyV1Signature, b), bytes.HasPrefix(proxyV2Signature, b)
+		switch {
+		case !v1 && !v2:
+			return 0, nil
+		case v1 && n == len(proxyV1Signature):
+			return 1, nil
+		case v2 && n == len(proxyV2Signature):
+			return 2, nil
+		}
+	}
+}
+
+// readProxyV1 reads a text header such as
+// "PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n". UNKNOWN keeps the
+// connection's addresses.
+func readProxyV1(r *bufio.Reader) (remote, local net.Addr, err error) {
+	var line []byte
+	for len(line) <= proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, nil, errors.New("PROXY v1 header not ended by CRLF within 107 bytes")
+	}
+	fields := strings.Split(text, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid PROXY v1 header %q", text)
+	}
+	src, srcErr := parseProxyV1Addr(fields[2], fields[4], fields[1])
+	dst, dstErr := parseProxyV1Addr(fields[3], fields[5], fields[1])
+	if srcErr != nil || dstErr != nil {
+		return nil, nil, fmt.Errorf("invalid PROXY v1 header %q", text)
+	}
+	return src, dst, nil
+}
+
+// parseProxyV1Addr parses an address and port of a v1 header of family.
+func parseProxyV1Addr(ip, port, family string) (*net.TCPAddr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() != (family == "TCP4") {
+		return nil, errors.New("invalid address")
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(n))), nil
+}
+
+// readProxyV2 reads a binary header. A LOCAL command, sent by the proxy's
+// own health checks, and address families other than TCP and UDP over IPv4
+// and IPv6 keep the connection's addresses.
+func readProxyV2(r *bufio.Reader) (remote, local net.Addr, err error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:])
+	if versionCommand>>4 != 2 || versionCommand&0xf > 1 {
+		return nil, nil, fmt.Errorf("invalid PROXY v2 version and command %#x", versionCommand)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	if versionCommand&0xf == 0 {
+		return nil, nil, nil
+	}
+	var size int
+	switch family >> 4 {
+	case 1:
+		size = 4
+	case 2:
+		size = 16
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, errors.New("PROXY v2 addresses cut short")
+	}
+	srcIP, _ := netip.AddrFromSlice(body[:size])
+	dstIP, _ := netip.AddrFromSlice(body[size : 2*size])
+	srcPort := binary.BigEndian.Uint16(body[2*size:])
+	dstPort := binary.BigEndian.Uint16(body[2*size+2:])
+	// the rest are TLVs, which goweb has no use for
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort)),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort)), nil
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr is the client's address from the header, read if need be.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr is the address the client connected to from the header.
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.readHeader() == nil && c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyConn) CloseWrite() error { return closeWrite(c.Conn) }
+
+// checkUpstreamProxyProtocol validates the host's upstream_proxy_protocol.
+func (host *Host) checkUpstreamProxyProtocol() error {
+	switch host.UpstreamProxyProtocol {
+	case "", "v1", "v2":
+		return nil
+	}
+	return fmt.Errorf("invalid upstream_proxy_protocol '%v' for host: %v", host.UpstreamProxyProtocol, host.Name)
+}
+
+// writeProxyHeader sends the PROXY header of the given version telling an
+// upstream the client's address src and the address dst it connected to.
+// Clients not on TCP, such as those of unix sockets, are sent as unknown.
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	var srcAddr, dstAddr netip.AddrPort
+	srcTCP, ok1 := src.(*net.TCPAddr)
+	dstTCP, ok2 := dst.(*net.TCPAddr)
+	known := ok1 && ok2
+	if known {
+		srcAddr, dstAddr = srcTCP.AddrPort(), dstTCP.AddrPort()
+		if srcAddr.Addr().Unmap().Is4() && dstAddr.Addr().Unmap().Is4() {
+			srcAddr = netip.AddrPortFrom(srcAddr.Addr().Unmap(), srcAddr.Port())
+			dstAddr = netip.AddrPortFrom(dstAddr.Addr().Unmap(), dstAddr.Port())
+		} else {
+			srcAddr = netip.AddrPortFrom(netip.AddrFrom16(srcAddr.Addr().As16()), srcAddr.Port())
+			dstAddr = netip.AddrPortFrom(netip.AddrFrom16(dstAddr.Addr().As16()), dstAddr.Port())
+		}
+	}
+	var header []byte
+	switch version {
+	case "v1":
+		if !known {
+			header = []byte("PROXY UNKNOWN\r\n")
+			break
+		}
+		family := "TCP6"
+		if srcAddr.Addr().Is4() {
+			family = "TCP4"
+		}
+		header = fmt.Appendf(nil, "PROXY %v %v %v %v %v\r\n", family,
+			srcAddr.Addr(), dstAddr.Addr(), srcAddr.Port(), dstAddr.Port())
+	case "v2":
+		header = append(header, proxyV2Signature...)
+		if !known {
+			// LOCAL, with no addresses
+			header = append(header, 0x20, 0x00, 0, 0)
+			break
+		}
+		family, srcIP, dstIP := byte(0x21), srcAddr.Addr().AsSlice(), dstAddr.Addr().AsSlice()
+		if srcAddr.Addr().Is4() {
+			family = 0x11
+		}
+		header = append(header, 0x21, family)
+		header = binary.BigEndian.AppendUint16(header, uint16(2*len(srcIP)+4))
+		header = append(header, srcIP...)
+		header = append(header, dstIP...)
+		header = binary.BigEndian.AppendUint16(header, srcAddr.Port())
+		header = binary.BigEndian.AppendUint16(header, dstAddr.Port())
+	default:
+		return nil
+	}
+	_, err := w.Write(header)
+	return err
+}
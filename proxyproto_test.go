@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readHeaderFrom parses the PROXY header data starts with, as a proxyConn
+// of a listener trusting the loopback peer would, returning the addresses it
+// gives, empty when they are the connection's own, and the bytes left after
+// it.
+func readHeaderFrom(t *testing.T, data []byte, required bool) (remote, local, rest string, err error) {
+	t.Helper()
+	trusted, _ := parseTrustedProxies("127.0.0.0/8")
+	listener := &proxyListener{Listener: listenLoopback(t), trusted: trusted, required: required}
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write(data)
+	client.(*net.TCPConn).CloseWrite()
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := accepted.(*proxyConn)
+	defer conn.Close()
+	if err := conn.readHeader(); err != nil {
+		return "", "", "", err
+	}
+	left, _ := io.ReadAll(conn)
+	if conn.RemoteAddr() != conn.Conn.RemoteAddr() {
+		remote = conn.RemoteAddr().String()
+	}
+	if conn.LocalAddr() != conn.Conn.LocalAddr() {
+		local = conn.LocalAddr().String()
+	}
+	return remote, local, string(left), nil
+}
+
+// listenLoopback listens on an ephemeral loopback port for the test.
+func listenLoopback(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+// proxyHeader is the header of the given version for src and dst.
+func proxyHeader(t *testing.T, version string, src, dst string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	srcAddr, _ := net.ResolveTCPAddr("tcp", src)
+	dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+	if err := writeProxyHeader(&buf, version, srcAddr, dstAddr); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	cases := []struct {
+		name       string
+		data       []byte
+		required   bool
+		wantRemote string
+		wantLocal  string
+		wantErr    string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.5 192.0.2.1 4711 443\r\nhello"), true, "203.0.113.5:4711", "192.0.2.1:443", ""},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::5 2001:db8::1 4711 443\r\nhello"), true, "[2001:db8::5]:4711", "[2001:db8::1]:443", ""},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\nhello"), true, "", "", ""},
+		{"v2 tcp4", append(proxyHeader(t, "v2", "203.0.113.5:4711", "192.0.2.1:443"), "hello"...), true, "203.0.113.5:4711", "192.0.2.1:443", ""},
+		{"v2 tcp6", append(proxyHeader(t, "v2", "[2001:db8::5]:4711", "[2001:db8::1]:443"), "hello"...), true, "[2001:db8::5]:4711", "[2001:db8::1]:443", ""},
+		{"v2 local", append([]byte("\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00"), "hello"...), true, "", "", ""},
+		{"v2 with tlvs", append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0f\xcb\x00\x71\x05\xc0\x00\x02\x01\x12\x67\x01\xbb\x04\x00\x00"), "hello"...),
+			true, "203.0.113.5:4711", "192.0.2.1:443", ""},
+		{"none optional", []byte("hello"), false, "", "", ""},
+		{"signature prefix optional", []byte("PROXhello"), false, "", "", ""},
+		{"none required", []byte("hello"), true, "", "", "no PROXY protocol header"},
+		{"v1 mixed families", []byte("PROXY TCP4 2001:db8::5 192.0.2.1 4711 443\r\n"), true, "", "", "invalid PROXY v1 header"},
+		{"v1 bad port", []byte("PROXY TCP4 203.0.113.5 192.0.2.1 70000 443\r\n"), true, "", "", "invalid PROXY v1 header"},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), true, "", "", "not ended by CRLF"},
+		{"v2 bad version", []byte("\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x00"), true, "", "", "invalid PROXY v2 version"},
+		{"v2 cut short", []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\xcb\x00\x71\x05"), true, "", "", "cut short"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			remote, local, rest, err := readHeaderFrom(t, c.data, c.required)
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("error = %v, want it to mention %q", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remote != c.wantRemote || local != c.wantLocal {
+				t.Errorf("addresses = %v -> %v, want %v -> %v", remote, local, c.wantRemote, c.wantLocal)
+			}
+			// without a header every byte is left
+			want := "hello"
+			if c.wantRemote == "" && !c.required {
+				want = string(c.data)
+			}
+			if rest != want {
+				t.Errorf("left %q after the header, want what followed it", rest)
+			}
+		})
+	}
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	if got := string(proxyHeader(t, "v1", "203.0.113.5:4711", "192.0.2.1:443")); got != "PROXY TCP4 203.0.113.5 192.0.2.1 4711 443\r\n" {
+		t.Errorf("v1 header = %q", got)
+	}
+	if got := string(proxyHeader(t, "v1", "[::ffff:203.0.113.5]:4711", "[2001:db8::1]:443")); got != "PROXY TCP6 ::ffff:203.0.113.5 2001:db8::1 4711 443\r\n" {
+		t.Errorf("v1 header of mixed families = %q", got)
+	}
+	var buf bytes.Buffer
+	writeProxyHeader(&buf, "v1", &net.UnixAddr{Name: "@", Net: "unix"}, &net.UnixAddr{Name: "/run/goweb.sock", Net: "unix"})
+	if got := buf.String(); got != "PROXY UNKNOWN\r\n" {
+		t.Errorf("v1 header of a unix socket client = %q", got)
+	}
+	buf.Reset()
+	writeProxyHeader(&buf, "v2", &net.UnixAddr{Name: "@", Net: "unix"}, &net.UnixAddr{Name: "/run/goweb.sock", Net: "unix"})
+	if remote, _, _, err := readHeaderFrom(t, buf.Bytes(), true); remote != "" || err != nil {
+		t.Errorf("v2 header of a unix socket client read as %v, %v, want LOCAL", remote, err)
+	}
+}
+
+// rawRequest sends data on a new connection to addr and returns all it gets
+// back.
+func rawRequest(t *testing.T, addr string, data []byte) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write(data)
+	got, _ := io.ReadAll(conn)
+	return string(got)
+}
+
+func TestProxyProtocolHTTPClientAddress(t *testing.T) {
+	const request = "GET / HTTP/1.1\r\nHost: a.example.com\r\nConnection: close\r\n\r\n"
+	cases := []struct {
+		name       string
+		mode       string
+		trusted    string
+		header     []byte
+		wantClient string // empty for a closed connection
+	}{
+		{"v1 required", "required", "127.0.0.1", []byte("PROXY TCP4 203.0.113.5 192.0.2.1 4711 80\r\n"), "203.0.113.5"},
+		{"v2 from a trusted peer", "required", "127.0.0.0/8", proxyHeader(t, "v2", "[2001:db8::5]:4711", "[2001:db8::1]:80"), "2001:db8::5"},
+		{"missing but optional", "optional", "127.0.0.0/8", nil, "127.0.0.1"},
+		{"missing and required", "required", "127.0.0.0/8", nil, ""},
+		{"untrusted peer required", "required", "10.0.0.0/8", []byte("PROXY TCP4 203.0.113.5 192.0.2.1 4711 80\r\n"), ""},
+		{"untrusted peer optional", "optional", "10.0.0.0/8", nil, "127.0.0.1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logs := captureAccessLog(t)
+			server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", AccessLog: true,
+				ProxyProtocol: c.mode, TrustedProxies: c.trusted, Hosts: []*Host{redirectHost("a.example.com")}}
+			startTestServer(t, server)
+
+			got := rawRequest(t, server.listener.Addr().String(), append(c.header, request...))
+			if c.wantClient == "" {
+				if got != "" {
+					t.Fatalf("got %q, want the connection closed", got)
+				}
+				return
+			}
+			if !strings.HasPrefix(got, "HTTP/1.1 301") {
+				t.Fatalf("got %q, want a redirect", got)
+			}
+			waitFor(t, "the access record", func() bool { return len(logs.records()) == 1 })
+			if record := parseRecord(t, logs.records()[0]); record["client"] != c.wantClient {
+				t.Errorf("access record client = %v, want %v", record["client"], c.wantClient)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolToTCPUpstream(t *testing.T) {
+	for _, version := range []string{"v1", "v2"} {
+		t.Run(version, func(t *testing.T) {
+			server := &Server{Name: "tcp-edge", Type: "tcp", Listen: "127.0.0.1:0", ProxyProtocol: "required",
+				TrustedProxies: "127.0.0.1", Hosts: []*Host{{Name: "db", Upstream: startEchoServer(t), UpstreamProxyProtocol: version}}}
+			if err := server.Start(); err != nil {
+				t.Fatalf("Start() = %v, want nil", err)
+			}
+			t.Cleanup(func() { server.Shutdown() })
+
+			conn, err := net.Dial("tcp", server.listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			conn.Write(append(proxyHeader(t, "v1", "203.0.113.5:4711", "192.0.2.1:5432"), "ping"...))
+			conn.(*net.TCPConn).CloseWrite()
+			got, _ := io.ReadAll(conn)
+			// the echo upstream sends back the header it got
+			want := append(proxyHeader(t, version, "203.0.113.5:4711", "192.0.2.1:5432"), "ping"...)
+			if !bytes.Equal(got, want) {
+				t.Errorf("read %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestStartRejectsInvalidProxyProtocol(t *testing.T) {
+	cases := []struct {
+		name   string
+		server *Server
+		want   string
+	}{
+		{"http mode", &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", ProxyProtocol: "yes",
+			Hosts: []*Host{redirectHost("a.example.com")}}, "invalid proxy_protocol 'yes'"},
+		{"tcp mode", &Server{Name: "edge", Type: "tcp", Listen: "127.0.0.1:0", ProxyProtocol: "v2",
+			Hosts: []*Host{{Name: "db", Upstream: "127.0.0.1:1"}}}, "invalid proxy_protocol 'v2'"},
+		{"no trusted proxies", &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", ProxyProtocol: "optional",
+			Hosts: []*Host{redirectHost("a.example.com")}}, "proxy_protocol needs trusted_proxies for server: edge"},
+		{"tcp trusted proxies", &Server{Name: "edge", Type: "tcp", Listen: "127.0.0.1:0", ProxyProtocol: "required", TrustedProxies: "lb.internal",
+			Hosts: []*Host{{Name: "db", Upstream: "127.0.0.1:1"}}}, "invalid trusted_proxies entry 'lb.internal'"},
+		{"upstream version", &Server{Name: "edge", Type: "tcp", Listen: "127.0.0.1:0",
+			Hosts: []*Host{{Name: "db", Upstream: "127.0.0.1:1", UpstreamProxyProtocol: "v3"}}}, "invalid upstream_proxy_protocol 'v3' for host: db"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.server.Start()
+			if err == nil {
+				c.server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %q, want it to mention %q", err, c.want)
+			}
+		})
+	}
+}
+
+// a slow client must not hold up the connections accepted after it
+func TestProxyProtocolDoesNotBlockAccept(t *testing.T) {
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", ProxyProtocol: "optional",
+		TrustedProxies: "127.0.0.1", Hosts: []*Host{redirectHost("a.example.com")}}
+	client := startTestServer(t, server)
+	idle, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	if resp := get(t, client, "http://a.example.com/"); resp.StatusCode != http.StatusMovedPermanently {
+		t.Errorf("status = %v, want 301", resp.StatusCode)
+	}
+}
+
+// an upstream speaking first is reached after a short wait for a header
+// that doesn't come, not after readHeaderTimeout
+func TestOptionalProxyProtocolServerSpeaksFirst(t *testing.T) {
+	greeter := listenLoopback(t)
+	go func() {
+		for {
+			conn, err := greeter.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "220 ready\r\n")
+			conn.Close()
+		}
+	}()
+	server := &Server{Name: "smtp", Type: "tcp", Listen: "127.0.0.1:0", ProxyProtocol: "optional", TrustedProxies: "127.0.0.1",
+		Hosts: []*Host{{Name: "mail", Upstream: greeter.Addr().String()}}}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() = %v, want nil", err)
+	}
+	t.Cleanup(func() { server.Shutdown() })
+
+	start := time.Now()
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if got, _ := io.ReadAll(conn); string(got) != "220 ready\r\n" {
+		t.Fatalf("read %q, want the greeting", got)
+	}
+	if elapsed := time.Since(start); elapsed > proxyPeekTimeout+time.Second {
+		t.Errorf("the greeting took %v, want about %v", elapsed, proxyPeekTimeout)
+	}
+}
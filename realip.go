@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxies is a parsed trusted_proxies list.
+type trustedProxies []netip.Prefix
+
+// peerKey is the request context key of the address of the trusted proxy a
+// request came from, whose RemoteAddr is then the client's.
+type peerKey struct{}
+
+// parseTrustedProxies parses a space separated list of IP addresses and
+// CIDR ranges.
+func parseTrustedProxies(list string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, entry := range strings.Fields(list) {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted_proxies entry '%v'", entry)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+// trusts reports whether ip is one of the proxies.
+func (proxies trustedProxies) trusts(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range proxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// realClient wraps next so requests from a trusted proxy carry the client
+// address it reports as their RemoteAddr, for logging, load balancing and
+// header rules alike. The proxy's own address is kept in the context for
+// the forwarded headers sent upstream.
+func (proxies trustedProxies) realClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil || !proxies.trusts(peer.Addr()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), peerKey{}, r.RemoteAddr))
+		if client, ok := proxies.forwardedClient(r.Header); ok {
+			// the client's port is unknown
+			r.RemoteAddr = net.JoinHostPort(client.String(), "0")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClient returns the client address the forwarding headers of a
+// request from a trusted proxy report: X-Forwarded-For, else Forwarded, else
+// X-Real-IP. Each proxy appends the address it got the request from, so the
+// last address that is not a trusted proxy is the client; anything left of
+// it may be forged. An address that can't be parsed ends the search at the
+// one right of it.
+func (proxies trustedProxies) forwardedClient(header http.Header) (netip.Addr, bool) {
+	var chain []string
+	if values := header.Values("X-Forwarded-For"); len(values) > 0 {
+		for _, value := range values {
+			chain = append(chain, strings.Split(value, ",")...)
+		}
+	} else if values := header.Values("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+					if strings.EqualFold(key, "for") {
+						chain = append(chain, value)
+					}
+				}
+			}
+		}
+	} else if value := header.Get("X-Real-IP"); value != "" {
+		chain = []string{value}
+	}
+	var client netip.Addr
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip, ok := parseForwardedIP(chain[i])
+		if !ok {
+			break
+		}
+		client = ip
+		if !proxies.trusts(ip) {
+			break
+		}
+	}
+	return client, client.IsValid()
+}
+
+// parseForwardedIP parses an address of a forwarding header, with or
+// without a port, quoted and bracketed as Forwarded has it.
+func parseForwardedIP(value string) (netip.Addr, bool) {
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+	if addrPort, err := netip.ParseAddrPort(value); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// setTrustedForwarded extends the forwarded headers a trusted proxy sent
+// instead of replacing them, as SetXForwarded does: X-Forwarded-For keeps
+// the proxies' chain and ends with the proxy itself, and X-Forwarded-Proto
+// and X-Forwarded-Host keep what the client first asked for.
+func setTrustedForwarded(r *httputil.ProxyRequest) {
+	peer, ok := r.In.Context().Value(peerKey{}).(string)
+	if !ok {
+		return
+	}
+	prior := strings.Join(r.In.Header.Values("X-Forwarded-For"), ", ")
+	if prior == "" && r.In.RemoteAddr != peer {
+		// reported by Forwarded or X-Real-IP
+		prior = clientIP(r.In.RemoteAddr)
+	}
+	forwardedFor := clientIP(peer)
+	if prior != "" {
+		forwardedFor = prior + ", " + forwardedFor
+	}
+	r.Out.Header.Set("X-Forwarded-For", forwardedFor)
+	for _, name := range []string{"X-Forwarded-Proto", "X-Forwarded-Host"} {
+		if value := r.In.Header.Get(name); value != "" {
+			r.Out.Header.Set(name, value)
+		}
+	}
+}
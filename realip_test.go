@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestForwardedClient(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8 192.0.2.1 2001:db8:ffff::/48")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{"none", http.Header{}, ""},
+		{"x-forwarded-for", http.Header{"X-Forwarded-For": {"203.0.113.5"}}, "203.0.113.5"},
+		{"with a port", http.Header{"X-Forwarded-For": {"203.0.113.5:4711"}}, "203.0.113.5"},
+		{"trusted hops skipped", http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.5, 10.0.0.2"}}, "203.0.113.5"},
+		{"several lines", http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.5", "10.0.0.2"}}, "203.0.113.5"},
+		{"only proxies", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"forged left part", http.Header{"X-Forwarded-For": {"nonsense, 203.0.113.5"}}, "203.0.113.5"},
+		{"unparsable client", http.Header{"X-Forwarded-For": {"203.0.113.5, nonsense"}}, ""},
+		{"forwarded", http.Header{"Forwarded": {`for=192.0.2.60;proto=http, for="[2001:db8::1]:4711"`}}, "2001:db8::1"},
+		{"forwarded by a trusted ipv6 proxy", http.Header{"Forwarded": {`for=198.51.100.7, For="[2001:db8:ffff::9]"`}}, "198.51.100.7"},
+		{"forwarded unknown", http.Header{"Forwarded": {"for=unknown"}}, ""},
+		{"x-real-ip", http.Header{"X-Real-Ip": {"203.0.113.9"}}, "203.0.113.9"},
+		{"x-forwarded-for first", http.Header{"X-Forwarded-For": {"203.0.113.5"}, "X-Real-Ip": {"203.0.113.9"}}, "203.0.113.5"},
+		{"ipv4-mapped", http.Header{"X-Forwarded-For": {"::ffff:203.0.113.5"}}, "203.0.113.5"},
+	}
+	for _, c := range cases {
+		client, ok := proxies.forwardedClient(c.header)
+		got := ""
+		if ok {
+			got = client.String()
+		}
+		if got != c.want {
+			t.Errorf("%v: client = %q, want %q", c.name, got, c.want)
+		}
+	}
+	if !proxies.trusts(netip.MustParseAddr("::ffff:10.1.2.3")) {
+		t.Error("an ipv4-mapped peer in a trusted range is not trusted")
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, list := range []string{"10.0.0.0/33", "example.com", "10.0.0.1-10.0.0.9"} {
+		if _, err := parseTrustedProxies(list); err == nil || !strings.Contains(err.Error(), "invalid trusted_proxies entry") {
+			t.Errorf("parseTrustedProxies(%q) = %v, want an invalid entry error", list, err)
+		}
+	}
+}
+
+// forwardedHeaders is an upstream answering with the forwarding headers it
+// got.
+func forwardedHeaders(t *testing.T) *httptest.Server {
+	t.Helper()
+	return echoServer(t, "", func(w http.ResponseWriter, r *http.Request) bool {
+		json.NewEncoder(w).Encode(map[string]string{
+			"for":     r.Header.Get("X-Forwarded-For"),
+			"proto":   r.Header.Get("X-Forwarded-Proto"),
+			"host":    r.Header.Get("X-Forwarded-Host"),
+			"real_ip": r.Header.Get("X-Real-Ip"),
+		})
+		return true
+	})
+}
+
+func TestTrustedProxyClientAddress(t *testing.T) {
+	cases := []struct {
+		name       string
+		trusted    string
+		wantClient string
+		wantFor    string
+		wantProto  string
+		wantHost   string
+	}{
+		{"trusted", "127.0.0.0/8", "203.0.113.5", "198.51.100.1, 203.0.113.5, 127.0.0.1", "https", "www.example.com"},
+		{"untrusted", "10.0.0.0/8", "127.0.0.1", "127.0.0.1", "http", "proxy.example.com"},
+		{"no trusted proxies", "", "127.0.0.1", "127.0.0.1", "http", "proxy.example.com"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logs := captureAccessLog(t)
+			server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", AccessLog: true, TrustedProxies: c.trusted,
+				Hosts: []*Host{{
+					Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: forwardedHeaders(t).URL,
+					RequestHeaders: []*HeaderRule{{Op: "set", Name: "X-Real-IP", Value: "{client_ip}"}},
+				}}}
+			client := startTestServer(t, server)
+
+			req, _ := http.NewRequest(http.MethodGet, "http://proxy.example.com/", nil)
+			req.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.5")
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("X-Forwarded-Host", "www.example.com")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]string
+			json.Unmarshal([]byte(bodyString(t, resp)), &got)
+			if got["for"] != c.wantFor || got["proto"] != c.wantProto || got["host"] != c.wantHost || got["real_ip"] != c.wantClient {
+				t.Errorf("upstream got %v, want X-Forwarded-For %q, proto %q, host %q and client %v",
+					got, c.wantFor, c.wantProto, c.wantHost, c.wantClient)
+			}
+			waitFor(t, "the access record", func() bool { return len(logs.records()) == 1 })
+			if record := parseRecord(t, logs.records()[0]); record["client"] != c.wantClient {
+				t.Errorf("access record client = %v, want %v", record["client"], c.wantClient)
+			}
+		})
+	}
+}
+
+func TestTrustedProxyClientsAreBalancedByTheirAddress(t *testing.T) {
+	one, two := echoServer(t, "one"), echoServer(t, "two")
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", TrustedProxies: "127.0.0.1", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: one.URL + " " + two.URL,
+	}}}
+	client := startTestServer(t, server)
+	names := []string{"one", "two"}
+	for _, ip := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.3", "203.0.113.4"} {
+		got := upstreamOf(t, client, "http://proxy.example.com/", func(r *http.Request) { r.Header.Set("X-Forwarded-For", ip) })
+		if want := names[hashIndex(ip, 2)]; got != want {
+			t.Errorf("client %v reached %v, want %v by its own address", ip, got, want)
+		}
+	}
+}
+
+func TestStartRejectsInvalidTrustedProxies(t *testing.T) {
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", TrustedProxies: "10.0.0.0/8 lb.internal",
+		Hosts: []*Host{redirectHost("a.example.com")}}
+	err := server.Start()
+	if err == nil {
+		server.Shutdown()
+		t.Fatal("Start() = nil, want an error")
+	}
+	if !strings.Contains(err.Error(), "invalid trusted_proxies entry 'lb.internal' for server: edge") {
+		t.Errorf("error = %q, want it to name the entry", err)
+	}
+}
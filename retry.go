@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// idempotentMethods can be sent again after a failure without doing twice
+// what the client asked for once.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// retryPolicy is a host's parsed retries, retry_on and retry_body_limit.
+type retryPolicy struct {
+	retries   int
+	onError   bool
+	statuses  map[int]bool
+	bodyLimit int64
+}
+
+// attemptKey is the request context key of the *proxyAttempt being made.
+type attemptKey struct{}
+
+// proxyAttempt is one try of a request on an upstream.
+type proxyAttempt struct {
+	retryable bool             // another upstream may be tried if this one fails
+	pick      func() *upstream // claims an upstream not tried yet, or returns nil
+	next      *upstream        // claimed by retry for the next attempt
+	err       error            // why a retried attempt failed; nothing was written
+}
+
+// retry claims the upstream of the next attempt, reporting false when the
+// attempt may not be retried or no upstream is left to take it, so that
+// this attempt's answer, or its error, goes to the client instead.
+func (attempt *proxyAttempt) retry() bool {
+	if attempt == nil || !attempt.retryable {
+		return false
+	}
+	if attempt.next == nil {
+		attempt.next = attempt.pick()
+	}
+	return attempt.next != nil
+}
+
+// retryStatusError fails an attempt answered with a status in retry_on.
+type retryStatusError struct {
+	status int
+}
+
+func (err *retryStatusError) Error() string {
+	return fmt.Sprintf("status %v", err.status)
+}
+
+// buildRetryPolicy validates the host's retry settings, which its
+// reverse_proxy upstreams are built with. Retries are off unless retries
+// is set.
+func (host *Host) buildRetryPolicy() error {
+	host.retryPolicy = nil
+	if host.Retries < 0 {
+		return fmt.Errorf("retries must not be negative for host: %v", host.Name)
+	}
+	if host.RetryBodyLimit < 0 {
+		return fmt.Errorf("retry_body_limit must not be negative for host: %v", host.Name)
+	}
+	if host.Retries == 0 {
+		return nil
+	}
+	policy := &retryPolicy{retries: host.Retries, statuses: map[int]bool{}, bodyLimit: host.RetryBodyLimit}
+	retryOn := strings.Fields(host.RetryOn)
+	if len(retryOn) == 0 {
+		retryOn = []string{"error"}
+	}
+	for _, condition := range retryOn {
+		if condition == "error" {
+			policy.onError = true
+			continue
+		}
+		status, err := strconv.Atoi(condition)
+		if err != nil || status < 400 || status > 599 {
+			return fmt.Errorf("invalid condition '%v' in retry_on, want error or a 4xx/5xx status, for host: %v", condition, host.Name)
+		}
+		policy.statuses[status] = true
+	}
+	host.retryPolicy = policy
+	return nil
+}
+
+// attemptOf returns the attempt r is part of, or nil.
+func attemptOf(r *http.Request) *proxyAttempt {
+	attempt, _ := r.Context().Value(attemptKey{}).(*proxyAttempt)
+	return attempt
+}
+
+// retryResponse reports whether res fails a retryable attempt, so the proxy
+// drops it and the next upstream is tried.
+func (policy *retryPolicy) retryResponse(res *http.Response) error {
+	if policy == nil || !policy.statuses[res.StatusCode] {
+		return nil
+	}
+	if attemptOf(res.Request).retry() {
+		return &retryStatusError{status: res.StatusCode}
+	}
+	return nil
+}
+
+// retryError reports whether the proxy error err ends a retryable attempt,
+// recording it so the next upstream is tried instead of answering.
+func (policy *retryPolicy) retryError(r *http.Request, err error) bool {
+	if policy == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var statusErr *retryStatusError
+	if !policy.onError && !errors.As(err, &statusErr) {
+		return false
+	}
+	attempt := attemptOf(r)
+	if !attempt.retry() {
+		return false
+	}
+	attempt.err = err
+	return true
+}
+
+// replayableBody reads r's body so every attempt can send it again. It
+// reports false, leaving the body to be read in full once, when it is
+// larger than limit.
+func replayableBody(r *http.Request, limit int64) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil, true
+	}
+	if r.ContentLength > limit {
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(body)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	return body, true
+}
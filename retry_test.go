@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// deadURL is the URL of an upstream refusing connections.
+func deadURL(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return srv.URL
+}
+
+// retryServer proxies to dead, where the client's IP hash lands, and to live.
+func retryServer(dead, live string, host *Host) *Server {
+	urls := []string{live, live}
+	urls[hashIndex("127.0.0.1", 2)] = dead
+	host.Name, host.Type, host.ForwardURLs = "proxy.example.com", "reverse_proxy", strings.Join(urls, " ")
+	return &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", AccessLog: true, Hosts: []*Host{host}}
+}
+
+func TestRetryMovesToAnotherUpstream(t *testing.T) {
+	logs := captureAccessLog(t)
+	good := echoServer(t, "good")
+	client := startTestServer(t, retryServer(deadURL(t), good.URL, &Host{Retries: 1}))
+
+	if got := upstreamOf(t, client, "http://proxy.example.com/"); got != "good" {
+		t.Fatalf("reached %q, want the request retried on good", got)
+	}
+	records := logs.records()
+	if len(records) != 1 {
+		t.Fatalf("wrote %v access records, want 1 for both attempts", len(records))
+	}
+	record := parseRecord(t, records[0])
+	if record["attempts"] != float64(2) || record["upstream"] != good.URL || record["status"] != float64(http.StatusOK) {
+		t.Errorf("access record = %v, want 2 attempts ending on %v", records[0], good.URL)
+	}
+}
+
+func TestRetrySkipsNonIdempotentRequests(t *testing.T) {
+	good := echoServer(t, "good")
+	client := startTestServer(t, retryServer(deadURL(t), good.URL, &Host{Retries: 1}))
+
+	resp, err := client.Post("http://proxy.example.com/", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("POST status = %v, want %v without a retry", resp.StatusCode, http.StatusBadGateway)
+	}
+}
+
+func TestRetryOnStatus(t *testing.T) {
+	bad, failing := failingServer(t, "bad")
+	good, _ := failingServer(t, "good")
+	failing.Store(true)
+
+	client := startTestServer(t, retryServer(bad.URL, good.URL, &Host{Retries: 1, RetryOn: "500 503", DisableCircuitBreaker: true}))
+	if got := upstreamOf(t, client, "http://proxy.example.com/"); got != "good" {
+		t.Errorf("reached %q, want a 500 retried on good", got)
+	}
+
+	client = startTestServer(t, retryServer(bad.URL, good.URL, &Host{Retries: 1, DisableCircuitBreaker: true}))
+	resp := get(t, client, "http://proxy.example.com/")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %v, want the 500 passed on when retry_on leaves it out", resp.StatusCode)
+	}
+}
+
+func TestRetryReplaysBody(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	t.Cleanup(good.Close)
+	client := startTestServer(t, retryServer(deadURL(t), good.URL, &Host{Retries: 1, RetryBodyLimit: 8}))
+
+	put := func(body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPut, "http://proxy.example.com/", strings.NewReader(body))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := put("12345678"); resp.StatusCode != http.StatusOK || bodyString(t, resp) != "12345678" {
+		t.Errorf("PUT within retry_body_limit = %v, want the body sent again to good", resp.Status)
+	}
+	resp := put("123456789")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("PUT over retry_body_limit = %v, want %v without a retry", resp.StatusCode, http.StatusBadGateway)
+	}
+}
+
+func TestRetryTriesEachUpstreamOnce(t *testing.T) {
+	logs := captureAccessLog(t)
+	client := startTestServer(t, retryServer(deadURL(t), deadURL(t), &Host{Retries: 5}))
+
+	resp := get(t, client, "http://proxy.example.com/")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %v, want %v once every upstream failed", resp.StatusCode, http.StatusBadGateway)
+	}
+	if record := parseRecord(t, logs.records()[0]); record["attempts"] != float64(2) {
+		t.Errorf("attempts = %v, want 2, one per upstream", record["attempts"])
+	}
+}
+
+func TestRetryAnswersWithLastResponseWhenNoUpstreamIsLeft(t *testing.T) {
+	good := echoServer(t, "good")
+	var other *upstream
+	busy := echoServer(t, "busy", func(w http.ResponseWriter, r *http.Request) bool {
+		// the only other upstream goes down while this one answers
+		other.down.Store(true)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "busy")
+		return true
+	})
+
+	server := retryServer(busy.URL, good.URL, &Host{Retries: 1, RetryOn: "503", DisableCircuitBreaker: true})
+	client := startTestServer(t, server)
+	for _, u := range server.Hosts[0].forwardPool.upstreams {
+		if u.target.String() == good.URL {
+			other = u
+		}
+	}
+
+	resp := get(t, client, "http://proxy.example.com/")
+	if body := bodyString(t, resp); resp.StatusCode != http.StatusServiceUnavailable || body != "busy" {
+		t.Errorf("got %v %q, want the upstream's own 503 with no upstream left to retry on", resp.StatusCode, body)
+	}
+}
+
+func TestStartRejectsInvalidRetries(t *testing.T) {
+	cases := []struct {
+		name string
+		host *Host
+		want string
+	}{
+		{"negative retries", &Host{Retries: -1}, "retries must not be negative"},
+		{"negative body limit", &Host{Retries: 1, RetryBodyLimit: -1}, "retry_body_limit must not be negative"},
+		{"unknown condition", &Host{Retries: 1, RetryOn: "timeout"}, "invalid condition 'timeout' in retry_on"},
+		{"not an error status", &Host{Retries: 1, RetryOn: "200"}, "invalid condition '200' in retry_on"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host := c.host
+			host.Name, host.Type, host.ForwardURLs = "proxy.example.com", "reverse_proxy", "http://127.0.0.1:1"
+			server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %q, want it to mention %q", err, c.want)
+			}
+		})
+	}
+}
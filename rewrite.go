@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// routeKey is the request context key of the *Route that rewrote the path
+// of a proxied request, for its upstream's redirects to be mapped back.
+type routeKey struct{}
+
+// buildPathRewrite validates the route's strip_prefix, add_prefix and
+// rewrite settings.
+func (route *Route) buildPathRewrite() error {
+	route.rewriteRegex, route.rewriteTo = nil, ""
+	if route.StripPrefix == "" && route.AddPrefix == "" && route.Rewrite == "" {
+		return nil
+	}
+	if route.Type != "reverse_proxy" {
+		return fmt.Errorf("strip_prefix, add_prefix and rewrite need type reverse_proxy")
+	}
+	for name, prefix := range map[string]string{"strip_prefix": route.StripPrefix, "add_prefix": route.AddPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("%v '%v' must start with /", name, prefix)
+		}
+	}
+	if route.Rewrite != "" {
+		// the replacement is all after the first space, spaces included
+		rewrite := strings.TrimSpace(route.Rewrite)
+		i := strings.IndexFunc(rewrite, unicode.IsSpace)
+		if i < 0 {
+			return fmt.Errorf("invalid rewrite '%v', want a regular expression and its replacement", route.Rewrite)
+		}
+		regex, err := regexp.Compile(rewrite[:i])
+		if err != nil {
+			return fmt.Errorf("invalid rewrite regex '%v': %v", rewrite[:i], err)
+		}
+		route.rewriteRegex, route.rewriteTo = regex, strings.TrimLeftFunc(rewrite[i:], unicode.IsSpace)
+	}
+	return nil
+}
+
+// rewritePath returns r with the path its upstream is sent: without
+// strip_prefix, rewritten by rewrite, then under add_prefix. The rules work
+// on the path as the client sent it, percent-encoded.
+func (route *Route) rewritePath(r *http.Request) *http.Request {
+	if route.StripPrefix == "" && route.AddPrefix == "" && route.rewriteRegex == nil {
+		return r
+	}
+	p := r.URL.EscapedPath()
+	if route.StripPrefix != "" {
+		p = strings.TrimPrefix(p, route.StripPrefix)
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+	}
+	if route.rewriteRegex != nil {
+		p = route.rewriteRegex.ReplaceAllString(p, route.rewriteTo)
+	}
+	p = strings.TrimSuffix(route.AddPrefix, "/") + p
+	u := *r.URL
+	u.RawPath = p
+	if path, err := url.PathUnescape(p); err == nil {
+		u.Path = path
+	} else {
+		u.Path, u.RawPath = p, ""
+	}
+	r = r.WithContext(context.WithValue(r.Context(), routeKey{}, route))
+	r.URL = &u
+	return r
+}
+
+// restoreLocation maps the path of a redirect from the upstream of a
+// rewritten request back into the client's view: add_prefix comes off and
+// strip_prefix goes back on. A rewrite can't be undone and is left alone.
+func restoreLocation(res *http.Response) {
+	route, ok := res.Request.Context().Value(routeKey{}).(*Route)
+	if !ok || (route.StripPrefix == "" && route.AddPrefix == "") {
+		return
+	}
+	location := res.Header.Get("Location")
+	// only paths on this host: "/..." but not "//elsewhere/..."
+	if !strings.HasPrefix(location, "/") || strings.HasPrefix(location, "//") {
+		return
+	}
+	if added := strings.TrimSuffix(route.AddPrefix, "/"); added != "" {
+		rest, found := strings.CutPrefix(location, added)
+		if !found || (rest != "" && !strings.HasPrefix(rest, "/") && !strings.HasPrefix(rest, "?")) {
+			return
+		}
+		location = "/" + strings.TrimPrefix(rest, "/")
+	}
+	if stripped := strings.TrimSuffix(route.StripPrefix, "/"); stripped != "" {
+		location = stripped + location
+	}
+	res.Header.Set("Location", location)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRewritePath(t *testing.T) {
+	cases := []struct {
+		route   Route
+		in      string
+		want    string
+		wantRaw string
+	}{
+		{Route{StripPrefix: "/app"}, "/app/x", "/x", "/x"},
+		{Route{StripPrefix: "/app/"}, "/app/x", "/x", "/x"},
+		{Route{StripPrefix: "/app"}, "/app", "/", "/"},
+		{Route{StripPrefix: "/app"}, "/other", "/other", "/other"},
+		{Route{AddPrefix: "/v2/"}, "/x", "/v2/x", "/v2/x"},
+		{Route{Rewrite: "^/old/(.*) /new/$1"}, "/old/a/b", "/new/a/b", "/new/a/b"},
+		{Route{StripPrefix: "/app", Rewrite: "^/(.*)\\.php$ /$1", AddPrefix: "/v2"}, "/app/index.php", "/v2/index", "/v2/index"},
+		// a group followed by a letter needs braces, a replacement may hold spaces
+		{Route{Rewrite: "^/(.*)$ /${1}x"}, "/a", "/ax", "/ax"},
+		{Route{Rewrite: "^/(.*)$  /my files/$1"}, "/a", "/my files/a", "/my%20files/a"},
+		// an encoded slash stays encoded
+		{Route{StripPrefix: "/app"}, "/app/a%2Fb", "/a/b", "/a%2Fb"},
+	}
+	for _, c := range cases {
+		route := c.route
+		route.Type = "reverse_proxy"
+		if err := route.buildPathRewrite(); err != nil {
+			t.Fatal(err)
+		}
+		r := route.rewritePath(httptest.NewRequest(http.MethodGet, c.in+"?q=1", nil))
+		if r.URL.Path != c.want || r.URL.EscapedPath() != c.wantRaw || r.URL.RawQuery != "q=1" {
+			t.Errorf("%+v: %v became %v (%v), want %v (%v)", c.route, c.in, r.URL.Path, r.URL.EscapedPath(), c.want, c.wantRaw)
+		}
+	}
+}
+
+func TestReverseProxyStripsPrefix(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/private" {
+			http.Redirect(w, r, "/v2/login?next=private", http.StatusFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"path": r.URL.Path})
+	}))
+	t.Cleanup(upstream.Close)
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: upstream.URL, StripPrefix: "/app", AddPrefix: "/v2",
+		Routes: []*Route{{Prefix: "/api/", Type: "reverse_proxy", ForwardURLs: upstream.URL, StripPrefix: "/api"}},
+	}}}
+	client := startTestServer(t, server)
+
+	for uri, want := range map[string]string{
+		"/app/users": "/v2/users",
+		"/api/users": "/users",
+	} {
+		var body map[string]string
+		json.Unmarshal([]byte(bodyString(t, get(t, client, "http://proxy.example.com"+uri))), &body)
+		if body["path"] != want {
+			t.Errorf("%v reached the upstream as %v, want %v", uri, body["path"], want)
+		}
+	}
+
+	resp := get(t, client, "http://proxy.example.com/app/private")
+	resp.Body.Close()
+	if got := resp.Header.Get("Location"); got != "/app/login?next=private" {
+		t.Errorf("Location = %q, want the upstream's redirect under /app", got)
+	}
+}
+
+func TestRestoreLocation(t *testing.T) {
+	route := &Route{Type: "reverse_proxy", StripPrefix: "/app/", AddPrefix: "/v2"}
+	cases := map[string]string{
+		"/v2/login":           "/app/login",
+		"/v2":                 "/app/",
+		"/v2?a=b":             "/app/?a=b",
+		"/v2x/login":          "/v2x/login", // not under add_prefix
+		"/elsewhere":          "/elsewhere",
+		"//cdn.example.com/a": "//cdn.example.com/a",
+		"https://example.com": "https://example.com",
+	}
+	for location, want := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = route.rewritePath(req)
+		res := &http.Response{Header: http.Header{"Location": {location}}, Request: req}
+		restoreLocation(res)
+		if got := res.Header.Get("Location"); got != want {
+			t.Errorf("Location %v became %v, want %v", location, got, want)
+		}
+	}
+}
+
+func TestStartRejectsInvalidPathRewrite(t *testing.T) {
+	cases := []struct {
+		name string
+		host *Host
+		want string
+	}{
+		{"not proxied", &Host{Type: "301_redirect", RedirectURL: "https://example.com", StripPrefix: "/app"}, "need type reverse_proxy"},
+		{"relative prefix", &Host{StripPrefix: "app"}, "strip_prefix 'app' must start with /"},
+		{"relative add prefix", &Host{AddPrefix: "v2"}, "add_prefix 'v2' must start with /"},
+		{"no replacement", &Host{Rewrite: "^/old"}, "invalid rewrite '^/old'"},
+		{"bad regex", &Host{Rewrite: "^/(old /new"}, "invalid rewrite regex '^/(old'"},
+		{"in a route", &Host{Routes: []*Route{{Prefix: "/a/", Type: "serve_static", Path: ".", StripPrefix: "/a"}}}, "in route 1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host := c.host
+			host.Name = "proxy.example.com"
+			if host.Type == "" {
+				host.Type, host.ForwardURLs = "reverse_proxy", "http://127.0.0.1:1"
+			}
+			server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %q, want it to mention %q", err, c.want)
+			}
+		})
+	}
+}
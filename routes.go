@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// buildRoutes validates the host's routes and builds what each one serves
+// with, then wraps the host's own settings as the route for requests no route
+// matches. The host's type-specific state must already be built.
+func (host *Host) buildRoutes() error {
+	for i, route := range host.Routes {
+		if err := host.buildRoute(route); err != nil {
+			return fmt.Errorf("%v in route %v for host: %v", err, i+1, host.Name)
+		}
+	}
+	host.ownRoute = &Route{
+		Type:              host.Type,
+		Path:              host.Path,
+		ForwardURLs:       host.ForwardURLs,
+		RedirectURL:       host.RedirectURL,
+		DisableDirListing: host.DisableDirListing,
+		StripPrefix:       host.StripPrefix,
+		AddPrefix:         host.AddPrefix,
+		Rewrite:           host.Rewrite,
+		fileServer:        host.fileServer,
+		forwardPool:       host.forwardPool,
+		groups:            host.upstreamGroups,
+	}
+	if err := host.ownRoute.buildPathRewrite(); err != nil {
+		return fmt.Errorf("%v for host: %v", err, host.Name)
+	}
+	return nil
+}
+
+func (host *Host) buildRoute(route *Route) error {
+	matchers := 0
+	for _, matcher := range []string{route.Prefix, route.Exact, route.Regex} {
+		if matcher != "" {
+			matchers++
+		}
+	}
+	if matchers != 1 {
+		return fmt.Errorf("exactly one of prefix, exact and regex is required")
+	}
+	route.regex = nil
+	if route.Regex != "" {
+		regex, err := regexp.Compile(route.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid regex '%v': %v", route.Regex, err)
+		}
+		route.regex = regex
+	}
+	switch route.Type {
+	case "serve_static":
+		route.fileServer = http.FileServer(http.Dir(route.Path))
+	case "301_redirect":
+		// nothing to prepare
+	case "reverse_proxy":
+		pool, err := host.newProxies(route.ForwardURLs)
+		if err != nil {
+			return err
+		}
+		route.forwardPool = pool
+	default:
+		return fmt.Errorf("unknown route type '%v'", route.Type)
+	}
+	return route.buildPathRewrite()
+}
+
+// matchRoute returns the first route matching r, or the host's own route
+// when none does.
+func (host *Host) matchRoute(r *http.Request) *Route {
+	for _, route := range host.Routes {
+		if route.matches(r) {
+			return route
+		}
+	}
+	return host.ownRoute
+}
+
+func (route *Route) matches(r *http.Request) bool {
+	if route.Methods != "" && !containsFold(strings.Fields(route.Methods), r.Method) {
+		return false
+	}
+	switch {
+	case route.Prefix != "":
+		return strings.HasPrefix(r.URL.Path, route.Prefix)
+	case route.Exact != "":
+		return r.URL.Path == route.Exact
+	default:
+		return route.regex.MatchString(r.URL.Path)
+	}
+}
+
+// containsFold reports whether list holds s, ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
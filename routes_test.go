@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouteMatches(t *testing.T) {
+	cases := []struct {
+		name   string
+		route  *Route
+		method string
+		path   string
+		want   bool
+	}{
+		{"prefix", &Route{Prefix: "/api/"}, "GET", "/api/users", true},
+		{"prefix is not a path segment match", &Route{Prefix: "/api"}, "GET", "/apiary", true},
+		{"prefix elsewhere", &Route{Prefix: "/api/"}, "GET", "/v1/api/", false},
+		{"exact", &Route{Exact: "/health"}, "GET", "/health", true},
+		{"exact rejects longer paths", &Route{Exact: "/health"}, "GET", "/health/deep", false},
+		{"regex", &Route{Regex: `^/users/\d+$`}, "GET", "/users/42", true},
+		{"regex miss", &Route{Regex: `^/users/\d+$`}, "GET", "/users/me", false},
+		{"method match ignores case", &Route{Prefix: "/", Methods: "get post"}, "POST", "/", true},
+		{"method miss", &Route{Prefix: "/", Methods: "GET HEAD"}, "DELETE", "/", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host := &Host{Name: "example.com", Type: "301_redirect", Routes: []*Route{c.route}}
+			c.route.Type = "301_redirect"
+			if err := host.buildRoutes(); err != nil {
+				t.Fatalf("buildRoutes() = %v, want nil", err)
+			}
+			if got := c.route.matches(httptest.NewRequest(c.method, c.path, nil)); got != c.want {
+				t.Errorf("matches(%v %v) = %v, want %v", c.method, c.path, got, c.want)
+			}
+		})
+	}
+}
+
+func TestStartRejectsInvalidRoutes(t *testing.T) {
+	cases := []struct {
+		name  string
+		route *Route
+		want  string
+	}{
+		{"no matcher", &Route{Type: "301_redirect"}, "exactly one of prefix, exact and regex"},
+		{"two matchers", &Route{Prefix: "/a/", Exact: "/a", Type: "301_redirect"}, "exactly one of prefix, exact and regex"},
+		{"bad regex", &Route{Regex: "([", Type: "301_redirect"}, "invalid regex"},
+		{"unknown type", &Route{Prefix: "/", Type: "carrier_pigeon"}, "unknown route type"},
+		{"proxy without upstreams", &Route{Prefix: "/", Type: "reverse_proxy"}, "no forward URLs"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host := redirectHost("a.example.com")
+			host.Routes = []*Route{c.route}
+			server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) || !strings.Contains(err.Error(), "route 1") {
+				t.Errorf("error = %q, want it to mention %q and the route", err, c.want)
+			}
+			if host.Status == "" {
+				t.Error("host Status is empty, want the reason recorded for the admin UI")
+			}
+			if server.listener != nil {
+				t.Error("listener is non-nil, want no port bound for an invalid route")
+			}
+		})
+	}
+}
+
+// The case routes exist for: a static site on / with its API proxied from
+// the same name, and the host's own type serving whatever no route matches.
+func TestHandleRoutes(t *testing.T) {
+	root := staticRoot(t)
+	api := echoServer(t, "api")
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "app.example.com",
+		Type: "serve_static",
+		Path: root,
+		Routes: []*Route{
+			{Exact: "/old", Type: "301_redirect", RedirectURL: "https://new.example.com"},
+			{Prefix: "/api/", Methods: "GET POST", Type: "reverse_proxy", ForwardURLs: api.URL},
+			{Regex: `\.php$`, Type: "301_redirect", RedirectURL: "https://legacy.example.com"},
+		},
+	}}}
+	client := startTestServer(t, server)
+
+	resp := get(t, client, "http://app.example.com/file.txt")
+	if got := bodyString(t, resp); got != "hello" {
+		t.Errorf("unrouted path: body = %q, want the static file", got)
+	}
+
+	resp = get(t, client, "http://app.example.com/api/users?id=1")
+	var body map[string]string
+	if err := json.Unmarshal([]byte(bodyString(t, resp)), &body); err != nil {
+		t.Fatalf("decoding upstream response: %v", err)
+	}
+	if body["upstream"] != "api" || body["path"] != "/api/users" || body["query"] != "id=1" {
+		t.Errorf("upstream saw %v, want the api upstream to get /api/users?id=1", body)
+	}
+
+	// a method the route does not list falls through to the host's own type
+	req, err := http.NewRequest(http.MethodDelete, "http://app.example.com/api/users", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("DELETE status = %v, want it not proxied", resp.StatusCode)
+	}
+
+	for url, want := range map[string]string{
+		"http://app.example.com/old":         "https://new.example.com/old",
+		"http://app.example.com/x/index.php": "https://legacy.example.com/x/index.php",
+	} {
+		resp := get(t, client, url)
+		if got := resp.Header.Get("Location"); got != want {
+			t.Errorf("%v: Location = %q, want %q", url, got, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"time"
+)
+
+// errHelloRead stops the handshake peekClientHello runs once the ClientHello
+// has been read.
+var errHelloRead = errors.New("client hello read")
+
+// buildSNIRoutes sets up the host lookup of a tcp server with sni_routing,
+// the same way http servers match host names.
+func (this *Server) buildSNIRoutes(hosts []*Host) error {
+	this.hostMap = make(map[string]*Host, len(hosts))
+	this.wildcards = nil
+	this.defaultHost = nil
+	for _, host := range hosts {
+		if host.Name == "" {
+			host.Status = fmt.Sprintf("Host name is required, server: %v, %v", this.Name, this.Listen)
+			return errors.New(host.Status)
+		}
+		for _, name := range host.names() {
+			if err := validateHostName(name); err != nil {
+				host.Status = fmt.Sprintf("%v for host: %v, server: %v, %v", err, host.Name, this.Name, this.Listen)
+				return errors.New(host.Status)
+			}
+		}
+		this.addHost(host)
+		if this.DefaultHost != "" && host.answersTo(this.DefaultHost) {
+			this.defaultHost = host
+		}
+	}
+	sortWildcards(this.wildcards)
+	if this.DefaultHost != "" && this.defaultHost == nil {
+		this.Status = fmt.Sprintf("Default host '%v' not found for server: %v, %v", this.DefaultHost, this.Name, this.Listen)
+		return errors.New(this.Status)
+	}
+	return nil
+}
+
+// peekClientHello reads the TLS ClientHello from conn without answering it,
+// and returns it together with a conn that replays the bytes read, so the
+// handshake can be passed on untouched. crypto/tls does the parsing, which
+// copes with hellos split across records.
+func peekClientHello(conn net.Conn, timeout time.Duration) (*tls.ClientHelloInfo, net.Conn, error) {
+	var buf bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	err := tls.Server(&helloConn{Conn: conn, reader: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = &tls.ClientHelloInfo{
+				ServerName:      info.ServerName,
+				SupportedProtos: slices.Clone(info.SupportedProtos),
+			}
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+	if hello == nil {
+		return nil, nil, err
+	}
+	return hello, &peekedConn{Conn: conn, reader: io.MultiReader(&buf, conn)}, nil
+}
+
+// helloConn feeds a handshake from reader and swallows whatever the
+// handshake tries to send back.
+type helloConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *helloConn) Read(p []byte) (int, error) { return c.reader.Read(p) }
+
+func (c *helloConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// peekedConn is a connection whose first bytes were already read, replaying
+// them before the rest.
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) { return c.reader.Read(p) }
+
+func (c *peekedConn) CloseWrite() error { return closeWrite(c.Conn) }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tlsBackend is an upstream terminating TLS itself, answering with its name.
+func tlsBackend(t *testing.T, name string) string {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+// passthroughGet fetches https://serverName/ through the proxy at addr,
+// returning the body and the protocol the backend negotiated.
+func passthroughGet(t *testing.T, addr, serverName string) (string, string, error) {
+	t.Helper()
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+			// one connection per request, so its access log record is
+			// written once the request is done
+			DisableKeepAlives: true,
+		},
+		Timeout: 10 * time.Second,
+	}
+	resp, err := client.Get("https://" + serverName + "/")
+	if err != nil {
+		return "", "", err
+	}
+	return bodyString(t, resp), resp.Proto, nil
+}
+
+func TestSNIRouting(t *testing.T) {
+	logs := captureAccessLog(t)
+	a := tlsBackend(t, "backend-a")
+	b := tlsBackend(t, "backend-b")
+	server := &Server{
+		Name:       "tls-edge",
+		Type:       "tcp",
+		Listen:     "127.0.0.1:0",
+		AccessLog:  true,
+		SNIRouting: true,
+		Hosts: []*Host{
+			{Name: "a.example.com", Upstream: a},
+			{Name: "*.b.example.com", Aliases: "b.example.com", Upstream: b},
+			{Name: "gone.example.com", Upstream: a, Disabled: true},
+		},
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() = %v, want nil", err)
+	}
+	t.Cleanup(func() { server.Shutdown() })
+	addr := server.listener.Addr().String()
+
+	for name, want := range map[string]string{
+		"a.example.com":     "backend-a",
+		"b.example.com":     "backend-b",
+		"www.b.example.com": "backend-b",
+	} {
+		body, proto, err := passthroughGet(t, addr, name)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if body != want {
+			t.Errorf("%v: reached %q, want %q", name, body, want)
+		}
+		// the backend negotiating h2 shows the handshake passed through
+		// untouched, ALPN included
+		if proto != "HTTP/2.0" {
+			t.Errorf("%v: protocol = %v, want HTTP/2.0 from the backend", name, proto)
+		}
+	}
+
+	for _, name := range []string{"unknown.example.com", "gone.example.com"} {
+		if _, _, err := passthroughGet(t, addr, name); err == nil {
+			t.Errorf("%v: request succeeded, want the connection closed", name)
+		}
+	}
+
+	waitFor(t, "the access log records", func() bool { return len(logs.records()) >= 3 })
+	record := parseRecord(t, logs.records()[0])
+	if record["sni"] != "a.example.com" && record["sni"] != "b.example.com" && record["sni"] != "www.b.example.com" {
+		t.Errorf("sni = %v, want the server name recorded", record["sni"])
+	}
+	if alpn, _ := record["alpn"].(string); !strings.Contains(alpn, "h2") {
+		t.Errorf("alpn = %q, want the offered protocols recorded", alpn)
+	}
+}
+
+func TestSNIRoutingDefaultHost(t *testing.T) {
+	a := tlsBackend(t, "backend-a")
+	fallback := tlsBackend(t, "fallback")
+	server := &Server{
+		Name:        "tls-edge",
+		Type:        "tcp",
+		Listen:      "127.0.0.1:0",
+		SNIRouting:  true,
+		DefaultHost: "fallback.example.org",
+		Hosts: []*Host{
+			{Name: "a.example.com", Upstream: a},
+			{Name: "fallback.example.com", Aliases: "fallback.example.org", Upstream: fallback},
+		},
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() = %v, want nil", err)
+	}
+	t.Cleanup(func() { server.Shutdown() })
+	addr := server.listener.Addr().String()
+
+	// connecting by IP sends no server name at all
+	body, _, err := passthroughGet(t, addr, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("GET by IP: %v", err)
+	}
+	if body != "fallback" {
+		t.Errorf("reached %q, want the default host's upstream", body)
+	}
+
+	// plain text is not TLS and has no server name to route by
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.0\r\n\r\n")
+	if got, _ := io.ReadAll(conn); len(got) != 0 {
+		t.Errorf("plain text got %q back, want the connection closed", got)
+	}
+}
+
+func TestStartRejectsInvalidSNIRouting(t *testing.T) {
+	cases := []struct {
+		name   string
+		server *Server
+		want   string
+	}{
+		{"bad host name", &Server{Hosts: []*Host{{Name: "a.*.example.com", Upstream: "127.0.0.1:1"}}}, "a.*.example.com"},
+		{"missing default host", &Server{DefaultHost: "nope.example.com", Hosts: []*Host{{Name: "a.example.com", Upstream: "127.0.0.1:1"}}}, "Default host 'nope.example.com' not found"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := c.server
+			server.Name, server.Type, server.Listen, server.SNIRouting = "tls-edge", "tcp", "127.0.0.1:0", true
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %q, want it to mention %q", err, c.want)
+			}
+			if server.listener != nil {
+				t.Error("listener is non-nil, want no port bound")
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// stickyMaxPins caps the pools a sticky cookie remembers an upstream for,
+// dropping the least recently used.
+const stickyMaxPins = 8
+
+// stickyCookie is a host's parsed sticky_cookie settings.
+type stickyCookie struct {
+	name     string
+	ttl      time.Duration // 0 for a session cookie
+	secure   bool
+	httpOnly bool
+}
+
+// buildStickyCookie validates the host's sticky cookie settings, which its
+// reverse_proxy upstreams are built with. Sticky sessions are off unless
+// sticky_cookie names the cookie.
+func (host *Host) buildStickyCookie() error {
+	host.stickyCookie = nil
+	if host.StickyCookie == "" {
+		if host.StickyCookieTTL != "" {
+			return fmt.Errorf("sticky_cookie_ttl needs sticky_cookie for host: %v", host.Name)
+		}
+		return nil
+	}
+	if err := (&http.Cookie{Name: host.StickyCookie}).Valid(); err != nil {
+		return fmt.Errorf("invalid sticky_cookie '%v' for host: %v", host.StickyCookie, host.Name)
+	}
+	sticky := &stickyCookie{name: host.StickyCookie, secure: host.StickyCookieSecure, httpOnly: host.StickyCookieHTTPOnly}
+	if host.StickyCookieTTL != "" {
+		d, err := time.ParseDuration(host.StickyCookieTTL)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid sticky_cookie_ttl '%v' for host: %v", host.StickyCookieTTL, host.Name)
+		}
+		sticky.ttl = d
+	}
+	host.stickyCookie = sticky
+	return nil
+}
+
+// stickyID is the sticky cookie ID of the upstream with target, or of the
+// pool of the upstreams with the space separated targets. It is derived from
+// the URLs alone, so pins outlive a reapply of the config, and doesn't give
+// the upstreams' addresses away.
+func stickyID(target string) string {
+	return fmt.Sprintf("%08x", hash32(target))
+}
+
+// pins returns the pins of r's sticky cookie, most recently used first. A
+// pin is a pool's sticky ID and the ID of the upstream it pins the client
+// to, joined by a colon, so the host and each of its routes and upstream
+// groups keep a pin of their own.
+func (sticky *stickyCookie) pins(r *http.Request) []string {
+	cookie, err := r.Cookie(sticky.name)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	return strings.Split(cookie.Value, ".")
+}
+
+// pinnedIn returns the upstream of pool r's sticky cookie pins it to, or
+// nil when there is none.
+func (sticky *stickyCookie) pinnedIn(r *http.Request, pool *upstreamPool) *upstream {
+	for _, pin := range sticky.pins(r) {
+		if key, id, _ := strings.Cut(pin, ":"); key == pool.stickyID {
+			i := slices.IndexFunc(pool.upstreams, func(u *upstream) bool { return u.stickyID == id })
+			if i < 0 {
+				return nil
+			}
+			return pool.upstreams[i]
+		}
+	}
+	return nil
+}
+
+// pinned returns the available upstream r's sticky cookie pins it to in
+// pool, or nil when there is none.
+func (sticky *stickyCookie) pinned(r *http.Request, pool *upstreamPool) *upstream {
+	if sticky == nil {
+		return nil
+	}
+	u := sticky.pinnedIn(r, pool)
+	if u == nil || !u.acquire(time.Now()) {
+		return nil
+	}
+	return u
+}
+
+// pin sets the sticky cookie on the response to r to pin it to u in pool,
+// first among its pins, replacing the cookie set by the previous attempt.
+// The cookie is left alone when it doesn't change, unless sticky_cookie_ttl
+// is set: then it is sent on every response, so it expires that long after
+// the client's last request rather than its first. It returns the
+// Set-Cookie header added.
+func (sticky *stickyCookie) pin(w http.ResponseWriter, r *http.Request, pool *upstreamPool, u *upstream, previous string) string {
+	if sticky == nil {
+		return ""
+	}
+	header := w.Header()
+	if previous != "" {
+		header["Set-Cookie"] = slices.DeleteFunc(header["Set-Cookie"], func(v string) bool { return v == previous })
+	}
+	current := sticky.pins(r)
+	pins := []string{pool.stickyID + ":" + u.stickyID}
+	for _, pin := range current {
+		if key, _, _ := strings.Cut(pin, ":"); key != pool.stickyID && len(pins) < stickyMaxPins {
+			pins = append(pins, pin)
+		}
+	}
+	if sticky.ttl == 0 && slices.Equal(pins, current) {
+		return ""
+	}
+	cookie := &http.Cookie{
+		Name:     sticky.name,
+		Value:    strings.Join(pins, "."),
+		Path:     "/",
+		Secure:   sticky.secure,
+		HttpOnly: sticky.httpOnly,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if sticky.ttl > 0 {
+		cookie.MaxAge = int(sticky.ttl / time.Second)
+	}
+	v := cookie.String()
+	header.Add("Set-Cookie", v)
+	return v
+}
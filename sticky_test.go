@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// stickyServer proxies round robin to one and two, pinning clients with the
+// cookie sticky.
+func stickyServer(one, two string) *Server {
+	return &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: one + " " + two,
+		LBPolicy: "round_robin", StickyCookie: "sticky",
+	}}}
+}
+
+// stickyGet requests the proxy with the sticky cookie set to pin, if any,
+// and returns the upstream reached and the sticky cookie set in response.
+func stickyGet(t *testing.T, client *http.Client, pin string) (string, *http.Cookie) {
+	t.Helper()
+	return stickyGetURL(t, client, "http://proxy.example.com/", pin)
+}
+
+// stickyGetURL is stickyGet for url.
+func stickyGetURL(t *testing.T, client *http.Client, url, pin string) (string, *http.Cookie) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if pin != "" {
+		req.AddCookie(&http.Cookie{Name: "sticky", Value: pin})
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := answeredBy(t, resp)
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "sticky" {
+			return upstream, cookie
+		}
+	}
+	return upstream, nil
+}
+
+func TestStickyCookiePinsClient(t *testing.T) {
+	one, two := echoServer(t, "one"), echoServer(t, "two")
+	client := startTestServer(t, stickyServer(one.URL, two.URL))
+
+	first, cookie := stickyGet(t, client, "")
+	if cookie == nil {
+		t.Fatal("no sticky cookie set on the first response")
+	}
+	if cookie.Path != "/" || cookie.MaxAge != 0 || cookie.Secure || cookie.HttpOnly {
+		t.Errorf("cookie = %v, want a session cookie for / without flags", cookie)
+	}
+	if strings.Contains(cookie.Value, "127.0.0.1") {
+		t.Errorf("cookie value %q gives the upstream address away", cookie.Value)
+	}
+	// round robin would alternate, the cookie keeps the client in place
+	for i := range 4 {
+		got, again := stickyGet(t, client, cookie.Value)
+		if got != first {
+			t.Fatalf("request %v reached %v, want %v it is pinned to", i+1, got, first)
+		}
+		if again != nil {
+			t.Errorf("request %v set the cookie again to %v, want it left alone", i+1, again.Value)
+		}
+	}
+
+	// a new server built from the same config, as by a reapply, honors it
+	client = startTestServer(t, stickyServer(one.URL, two.URL))
+	for range 2 {
+		if got, _ := stickyGet(t, client, cookie.Value); got != first {
+			t.Fatalf("reached %v after a reapply, want %v the client is pinned to", got, first)
+		}
+	}
+}
+
+func TestStickyCookieFallsBackToLBPolicy(t *testing.T) {
+	one, two := echoServer(t, "one"), echoServer(t, "two")
+	server := stickyServer(one.URL, two.URL)
+	client := startTestServer(t, server)
+
+	// a pin to an upstream removed from forward_urls
+	pool := server.Hosts[0].forwardPool
+	got, cookie := stickyGet(t, client, pool.stickyID+":"+stickyID("http://127.0.0.1:1"))
+	if got == "" || cookie == nil {
+		t.Fatalf("reached %q setting cookie %v, want the client balanced and pinned anew", got, cookie)
+	}
+
+	// a pin to an upstream that went down
+	pinned := pool.upstreams[0]
+	if cookie.Value != pool.stickyID+":"+pinned.stickyID {
+		pinned = pool.upstreams[1]
+	}
+	pinned.down.Store(true)
+	moved, moved2 := stickyGet(t, client, cookie.Value)
+	if moved == got || moved2 == nil || moved2.Value == cookie.Value {
+		t.Fatalf("reached %v setting cookie %v with %v down, want the client moved and pinned to the other", moved, moved2, got)
+	}
+	pinned.down.Store(false)
+	if again, _ := stickyGet(t, client, moved2.Value); again != moved {
+		t.Errorf("reached %v, want the client staying on %v once the old upstream is back", again, moved)
+	}
+}
+
+func TestStickyCookieAttributes(t *testing.T) {
+	one := echoServer(t, "one")
+	server := stickyServer(one.URL, one.URL)
+	host := server.Hosts[0]
+	host.StickyCookieTTL, host.StickyCookieSecure, host.StickyCookieHTTPOnly = "1h", true, true
+	client := startTestServer(t, server)
+
+	_, cookie := stickyGet(t, client, "")
+	if cookie == nil || cookie.MaxAge != 3600 || !cookie.Secure || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("cookie = %v, want Max-Age=3600; Secure; HttpOnly; SameSite=Lax", cookie)
+	}
+}
+
+func TestStickyCookieTTLSlides(t *testing.T) {
+	one := echoServer(t, "one")
+	server := stickyServer(one.URL, one.URL)
+	server.Hosts[0].StickyCookieTTL = "1h"
+	client := startTestServer(t, server)
+
+	_, cookie := stickyGet(t, client, "")
+	for i := range 3 {
+		_, again := stickyGet(t, client, cookie.Value)
+		if again == nil || again.Value != cookie.Value || again.MaxAge != 3600 {
+			t.Fatalf("request %v set cookie %v, want the same pin sent again to renew it", i+1, again)
+		}
+	}
+}
+
+func TestStickyCookiePinsPerPool(t *testing.T) {
+	one, two := echoServer(t, "one"), echoServer(t, "two")
+	three, four := echoServer(t, "three"), echoServer(t, "four")
+	server := stickyServer(one.URL, two.URL)
+	server.Hosts[0].Routes = []*Route{{Prefix: "/api/", Type: "reverse_proxy", ForwardURLs: three.URL + " " + four.URL}}
+	client := startTestServer(t, server)
+
+	first, cookie := stickyGetURL(t, client, "http://proxy.example.com/", "")
+	api, cookie := stickyGetURL(t, client, "http://proxy.example.com/api/", cookie.Value)
+	if cookie == nil || len(strings.Split(cookie.Value, ".")) != 2 {
+		t.Fatalf("cookie = %v, want a pin for the host and one for the route", cookie)
+	}
+	// round robin would alternate, each pool keeps its own pin
+	for i := range 4 {
+		if got, _ := stickyGetURL(t, client, "http://proxy.example.com/", cookie.Value); got != first {
+			t.Fatalf("request %v reached %v, want %v the host pins it to", i+1, got, first)
+		}
+		if got, again := stickyGetURL(t, client, "http://proxy.example.com/api/", cookie.Value); got != api || again != nil {
+			t.Fatalf("api request %v reached %v setting %v, want %v the route pins it to and the cookie left alone", i+1, got, again, api)
+		}
+	}
+}
+
+func TestStartRejectsInvalidStickyCookie(t *testing.T) {
+	cases := []struct {
+		name string
+		host *Host
+		want string
+	}{
+		{"bad name", &Host{StickyCookie: "a b"}, "invalid sticky_cookie 'a b'"},
+		{"bad ttl", &Host{StickyCookie: "sticky", StickyCookieTTL: "forever"}, "invalid sticky_cookie_ttl 'forever'"},
+		{"ttl without cookie", &Host{StickyCookieTTL: "1h"}, "sticky_cookie_ttl needs sticky_cookie"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host := c.host
+			host.Name, host.Type, host.ForwardURLs = "proxy.example.com", "reverse_proxy", "http://127.0.0.1:1"
+			server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %q, want it to mention %q", err, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+}
+
+// tlsPolicy builds the server's base TLS config from its tls_* and alpn
+// settings, together with the HTTP versions the http.Server should speak,
+// which a tls server has none of.
+// Every setting is checked here, before the port is bound, so a policy
+// crypto/tls or HTTP/2 would reject only at the first handshake fails Start.
+func (this *Server) tlsPolicy() (*tls.Config, *http.Protocols, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if this.TLSMinVersion != "" {
+		version, ok := tlsVersions[this.TLSMinVersion]
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid tls_min_version '%v', want 1.0, 1.1, 1.2 or 1.3", this.TLSMinVersion)
+		}
+		config.MinVersion = version
+	}
+	if this.TLSMaxVersion != "" {
+		version, ok := tlsVersions[this.TLSMaxVersion]
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid tls_max_version '%v', want 1.0, 1.1, 1.2 or 1.3", this.TLSMaxVersion)
+		}
+		if version < config.MinVersion {
+			return nil, nil, fmt.Errorf("tls_max_version %v is below the minimum version %v",
+				this.TLSMaxVersion, tls.VersionName(config.MinVersion))
+		}
+		config.MaxVersion = version
+	}
+
+	for _, name := range strings.Fields(this.TLSCipherSuites) {
+		suite, err := cipherSuite(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.CipherSuites = append(config.CipherSuites, suite)
+	}
+	if config.CipherSuites != nil && config.MinVersion == tls.VersionTLS13 {
+		return nil, nil, fmt.Errorf("tls_cipher_suites has no effect with tls_min_version 1.3")
+	}
+
+	for _, name := range strings.Fields(this.TLSCurves) {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown curve '%v' in tls_curves, want X25519, X25519MLKEM768, P256, P384 or P521", name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+
+	// A tls server hands the plaintext to a tcp upstream, so it offers
+	// whatever protocols that upstream speaks, or none.
+	if this.Type == "tls" {
+		config.NextProtos = strings.Fields(this.ALPN)
+		return config, nil, nil
+	}
+
+	protocols := new(http.Protocols)
+	alpn := strings.Fields(this.ALPN)
+	if len(alpn) == 0 {
+		alpn = []string{"h2", "http/1.1"}
+	}
+	for _, proto := range alpn {
+		switch proto {
+		case "h2":
+			protocols.SetHTTP2(true)
+		case "http/1.1":
+			protocols.SetHTTP1(true)
+		default:
+			return nil, nil, fmt.Errorf("unsupported protocol '%v' in alpn, want h2 and/or http/1.1", proto)
+		}
+	}
+	if protocols.HTTP2() && config.CipherSuites != nil && !hasHTTP2CipherSuite(config.CipherSuites) {
+		return nil, nil, fmt.Errorf("h2 needs TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 in tls_cipher_suites")
+	}
+	// Spelled out rather than left to ServeTLS so the per-host configs
+	// cloned from this one offer the same protocols.
+	config.NextProtos = alpn
+	return config, protocols, nil
+}
+
+// cipherSuite looks up a TLS 1.0-1.2 cipher suite by its IANA name. TLS 1.3
+// suites are not configurable in crypto/tls, and insecure ones are refused.
+func cipherSuite(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name != name {
+			continue
+		}
+		for _, version := range suite.SupportedVersions {
+			if version != tls.VersionTLS13 {
+				return suite.ID, nil
+			}
+		}
+		return 0, fmt.Errorf("TLS 1.3 cipher suite '%v' in tls_cipher_suites is not configurable", name)
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return 0, fmt.Errorf("insecure cipher suite '%v' in tls_cipher_suites", name)
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite '%v' in tls_cipher_suites", name)
+}
+
+// hasHTTP2CipherSuite reports whether suites hold one of the cipher suites
+// HTTP/2 requires over TLS 1.2.
+func hasHTTP2CipherSuite(suites []uint16) bool {
+	for _, suite := range suites {
+		if suite == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || suite == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsSetup is what a server terminating TLS needs once its port is open:
+// the config to serve with and the hosts whose certificates need upkeep.
+type tlsSetup struct {
+	config    *tls.Config
+	protocols *http.Protocols
+	acmeHosts []*Host
+	certHosts []*Host
+}
+
+// buildTLS prepares TLS termination for an https or tls server: it checks
+// the TLS policy and ocsp_responder, loads the certificates of hosts, and
+// sets up client certificate authentication.
+func (this *Server) buildTLS(hosts []*Host) (*tlsSetup, error) {
+	config, protocols, err := this.tlsPolicy()
+	if err != nil {
+		this.Status = fmt.Sprintf("%v for server: %v, %v", err, this.Name, this.Listen)
+		return nil, errors.New(this.Status)
+	}
+	if this.OCSPResponder != "" {
+		if u, err := url.Parse(this.OCSPResponder); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			this.Status = fmt.Sprintf("Invalid ocsp_responder '%v' for server: %v, %v", this.OCSPResponder, this.Name, this.Listen)
+			return nil, errors.New(this.Status)
+		}
+	}
+
+	setup := &tlsSetup{config: config, protocols: protocols}
+	loaded := 0
+	for _, host := range hosts {
+		if host.ACME {
+			if err := this.prepareACME(host); err != nil {
+				host.Status = fmt.Sprintf("%v for host: %v, server: %v, %v", err, host.Name, this.Name, this.Listen)
+				return nil, errors.New(host.Status)
+			}
+			if !host.Disabled {
+				setup.acmeHosts = append(setup.acmeHosts, host)
+			}
+			continue
+		}
+		setup.certHosts = append(setup.certHosts, host)
+		if err := this.loadCertificate(host); err != nil {
+			// Certificate files drift at runtime — a renewal can remove
+			// them with no config change — so an unloadable pair degrades
+			// this one host instead of failing the whole server. Every
+			// other host on the listener keeps working; TLS for this name
+			// gets another host's certificate until its files are fixed
+			// and watchCertificates picks them up.
+			host.Status = fmt.Sprintf("%v for host: %v, server: %v, %v", err, host.Name, this.Name, this.Listen)
+			level := slog.LevelError
+			if host.Disabled {
+				level = slog.LevelWarn
+			}
+			slog.Log(context.Background(), level, "Failed to load certificate, serving remaining hosts",
+				"host", host.Name, "server", this.Name, "listen", this.Listen, "err", err)
+		} else {
+			loaded++
+			this.logCertificate("Certificate loaded", host)
+		}
+	}
+
+	// With no certificate at all there is nothing TLS can serve, and every
+	// handshake would only fail after the port is bound, leaving clients to
+	// hang in the accept backlog. Fail while the port is still closed
+	// instead. ACME hosts are the exception: they can only get their
+	// certificates once the port is open to answer the challenges.
+	if loaded == 0 && len(setup.acmeHosts) == 0 {
+		this.Status = fmt.Sprintf("No usable certificate for server: %v, %v", this.Name, this.Listen)
+		return nil, errors.New(this.Status)
+	}
+	config.GetCertificate = this.getCertificate
+	config.GetConfigForClient = this.getConfigForClient
+	for _, host := range hosts {
+		if host.Disabled {
+			continue
+		}
+		if err := host.buildClientAuth(config); err != nil {
+			host.Status = fmt.Sprintf("%v for host: %v, server: %v, %v", err, host.Name, this.Name, this.Listen)
+			return nil, errors.New(host.Status)
+		}
+	}
+	return setup, nil
+}
+
+// runTLS starts the background work keeping the certificates of setup
+// current, until done is closed.
+func (this *Server) runTLS(setup *tlsSetup, done <-chan struct{}) {
+	if len(setup.acmeHosts) > 0 {
+		go this.manageACME(setup.acmeHosts, done)
+	}
+	if len(setup.certHosts) > 0 {
+		go this.watchCertificates(setup.certHosts, done)
+	}
+	if !this.DisableOCSPStapling {
+		go this.manageOCSP(ocspCheckInterval, done)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+// startPolicyServer starts an https server with one host and the TLS policy
+// set by configure, and returns its address.
+func startPolicyServer(t *testing.T, configure func(*Server)) string {
+	t.Helper()
+	certPath, keyPath := writeSelfSignedCert(t, t.TempDir(), "a.example.com")
+	host := redirectHost("a.example.com")
+	host.CertPath, host.KeyPath = certPath, keyPath
+	server := &Server{Name: "edge", Type: "https", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+	configure(server)
+	startTestServer(t, server)
+	return server.listener.Addr().String()
+}
+
+func handshake(addr string, config *tls.Config) (tls.ConnectionState, error) {
+	config.ServerName = "a.example.com"
+	config.InsecureSkipVerify = true
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState(), nil
+}
+
+func TestTLSPolicy(t *testing.T) {
+	t.Run("default offers h2 from TLS 1.2", func(t *testing.T) {
+		addr := startPolicyServer(t, func(*Server) {})
+		state, err := handshake(addr, &tls.Config{NextProtos: []string{"h2", "http/1.1"}})
+		if err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+		if state.NegotiatedProtocol != "h2" {
+			t.Errorf("protocol = %q, want h2", state.NegotiatedProtocol)
+		}
+		if _, err := handshake(addr, &tls.Config{MaxVersion: tls.VersionTLS11}); err == nil {
+			t.Error("TLS 1.1 handshake succeeded, want it refused by default")
+		}
+	})
+
+	t.Run("versions", func(t *testing.T) {
+		addr := startPolicyServer(t, func(s *Server) { s.TLSMinVersion = "1.3" })
+		if _, err := handshake(addr, &tls.Config{MaxVersion: tls.VersionTLS12}); err == nil {
+			t.Error("TLS 1.2 handshake succeeded, want it refused below tls_min_version")
+		}
+		addr = startPolicyServer(t, func(s *Server) { s.TLSMaxVersion = "1.2" })
+		state, err := handshake(addr, &tls.Config{})
+		if err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+		if state.Version != tls.VersionTLS12 {
+			t.Errorf("version = %v, want TLS 1.2", tls.VersionName(state.Version))
+		}
+	})
+
+	t.Run("cipher suites and curves", func(t *testing.T) {
+		addr := startPolicyServer(t, func(s *Server) {
+			s.TLSCipherSuites = "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"
+			s.TLSCurves = "P384"
+		})
+		state, err := handshake(addr, &tls.Config{
+			MaxVersion:   tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+		})
+		if err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+		if state.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 {
+			t.Errorf("cipher suite = %v, want the one allowed", tls.CipherSuiteName(state.CipherSuite))
+		}
+		if state.CurveID != tls.CurveP384 {
+			t.Errorf("curve = %v, want P384", state.CurveID)
+		}
+	})
+
+	t.Run("alpn without h2", func(t *testing.T) {
+		addr := startPolicyServer(t, func(s *Server) { s.ALPN = "http/1.1" })
+		state, err := handshake(addr, &tls.Config{NextProtos: []string{"h2", "http/1.1"}})
+		if err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+		if state.NegotiatedProtocol != "http/1.1" {
+			t.Errorf("protocol = %q, want http/1.1 with h2 turned off", state.NegotiatedProtocol)
+		}
+	})
+}
+
+func TestStartRejectsInvalidTLSPolicy(t *testing.T) {
+	cases := []struct {
+		name      string
+		configure func(*Server)
+		want      string
+	}{
+		{"unknown min version", func(s *Server) { s.TLSMinVersion = "1.4" }, "invalid tls_min_version"},
+		{"unknown max version", func(s *Server) { s.TLSMaxVersion = "TLS1.3" }, "invalid tls_max_version"},
+		{"max below min", func(s *Server) { s.TLSMaxVersion = "1.1" }, "below the minimum version TLS 1.2"},
+		{"unknown cipher suite", func(s *Server) { s.TLSCipherSuites = "TLS_FAST_AND_LOOSE" }, "unknown cipher suite"},
+		{"insecure cipher suite", func(s *Server) { s.TLSCipherSuites = "TLS_RSA_WITH_RC4_128_SHA" }, "insecure cipher suite"},
+		{"TLS 1.3 cipher suite", func(s *Server) { s.TLSCipherSuites = "TLS_AES_128_GCM_SHA256" }, "not configurable"},
+		{"cipher suites with TLS 1.3 only", func(s *Server) {
+			s.TLSMinVersion = "1.3"
+			s.TLSCipherSuites = "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"
+		}, "no effect"},
+		{"unknown curve", func(s *Server) { s.TLSCurves = "X25519 P224" }, "unknown curve 'P224'"},
+		{"unknown protocol", func(s *Server) { s.ALPN = "h3" }, "unsupported protocol 'h3'"},
+		{"h2 without its cipher suite", func(s *Server) { s.TLSCipherSuites = "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384" }, "h2 needs"},
+	}
+	certPath, keyPath := writeSelfSignedCert(t, t.TempDir(), "a.example.com")
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host := redirectHost("a.example.com")
+			host.CertPath, host.KeyPath = certPath, keyPath
+			server := &Server{Name: "edge", Type: "https", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+			c.configure(server)
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) || !strings.Contains(server.Status, c.want) {
+				t.Errorf("error = %q, Status = %q, want both to mention %q", err, server.Status, c.want)
+			}
+			if server.listener != nil {
+				t.Error("listener is non-nil, want no port bound")
+			}
+		})
+	}
+}
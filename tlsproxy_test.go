@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nameServer is a tcp upstream writing its name to every connection.
+func nameServer(t *testing.T, name string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, name)
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// tlsDial connects to a tls server at addr asking for serverName.
+func tlsDial(t *testing.T, addr, serverName string, config *tls.Config) (*tls.Conn, error) {
+	t.Helper()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config.ServerName = serverName
+	config.InsecureSkipVerify = true
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn, nil
+}
+
+func TestTLSServer(t *testing.T) {
+	logs := captureAccessLog(t)
+	dir := t.TempDir()
+	certA, keyA := writeSelfSignedCert(t, dir, "a.example.com")
+	certB, keyB := writeSelfSignedCert(t, dir, "b.example.com")
+	server := &Server{
+		Name:      "tls-edge",
+		Type:      "tls",
+		Listen:    "127.0.0.1:0",
+		AccessLog: true,
+		ALPN:      "postgresql",
+		Hosts: []*Host{
+			{Name: "a.example.com", CertPath: certA, KeyPath: keyA, Upstream: nameServer(t, "upstream-a")},
+			{Name: "b.example.com", CertPath: certB, KeyPath: keyB, Upstream: startEchoServer(t)},
+			{Name: "gone.example.com", CertPath: certA, KeyPath: keyA, Upstream: nameServer(t, "gone"), Disabled: true},
+		},
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() = %v, want nil", err)
+	}
+	t.Cleanup(func() { server.Shutdown() })
+	addr := server.listener.Addr().String()
+
+	conn, err := tlsDial(t, addr, "a.example.com", &tls.Config{NextProtos: []string{"postgresql"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := conn.ConnectionState()
+	if got := state.PeerCertificates[0].Subject.CommonName; got != "a.example.com" {
+		t.Errorf("certificate for %v, want a.example.com's own", got)
+	}
+	if state.NegotiatedProtocol != "postgresql" {
+		t.Errorf("negotiated %q, want the configured alpn", state.NegotiatedProtocol)
+	}
+	if got, _ := io.ReadAll(conn); string(got) != "upstream-a" {
+		t.Errorf("read %q, want the plaintext from upstream-a", got)
+	}
+	conn.Close()
+
+	// plaintext goes both ways, and closing the write side reaches the
+	// upstream, which then ends the connection
+	conn, err = tlsDial(t, addr, "b.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "ping")
+	conn.CloseWrite()
+	if got, _ := io.ReadAll(conn); string(got) != "ping" {
+		t.Errorf("echo = %q, want ping", got)
+	}
+	conn.Close()
+
+	for _, name := range []string{"unknown.example.com", "gone.example.com"} {
+		conn, err := tlsDial(t, addr, name, nil)
+		if err != nil {
+			continue
+		}
+		if got, _ := io.ReadAll(conn); len(got) != 0 {
+			t.Errorf("%v: read %q, want the connection closed", name, got)
+		}
+		conn.Close()
+	}
+
+	waitFor(t, "the access log records", func() bool { return len(logs.records()) >= 2 })
+	record := parseRecord(t, logs.records()[0])
+	if record["sni"] != "a.example.com" || record["alpn"] != "postgresql" || record["host"] != "a.example.com" {
+		t.Errorf("record = %v, want the server name and negotiated protocol", record)
+	}
+}
+
+func TestTLSServerDefaultHostAndClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeSelfSignedCert(t, dir, "db.example.com")
+	caPath, clientCert := writeClientCA(t, dir, "app")
+	server := &Server{
+		Name:        "tls-edge",
+		Type:        "tls",
+		Listen:      "127.0.0.1:0",
+		DefaultHost: "db.example.com",
+		Hosts: []*Host{{
+			Name: "db.example.com", CertPath: cert, KeyPath: key, Upstream: nameServer(t, "db"),
+			ClientAuth: "require", ClientCAPath: caPath,
+		}},
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() = %v, want nil", err)
+	}
+	t.Cleanup(func() { server.Shutdown() })
+	addr := server.listener.Addr().String()
+
+	// connecting by IP sends no server name, so the default host answers
+	conn, err := tlsDial(t, addr, "127.0.0.1", &tls.Config{Certificates: []tls.Certificate{clientCert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(conn); string(got) != "db" {
+		t.Errorf("read %q, want the default host's upstream", got)
+	}
+	conn.Close()
+
+	// with TLS 1.3 the missing certificate is only reported on the first read
+	conn, err = tlsDial(t, addr, "db.example.com", nil)
+	if err == nil {
+		got, _ := io.ReadAll(conn)
+		conn.Close()
+		if len(got) != 0 {
+			t.Errorf("read %q without a client certificate, want the handshake refused", got)
+		}
+	}
+}
+
+func TestStartRejectsInvalidTLSServers(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeSelfSignedCert(t, dir, "a.example.com")
+	cases := []struct {
+		name   string
+		server *Server
+		want   string
+	}{
+		{"no usable certificate", &Server{Hosts: []*Host{{Name: "a.example.com", CertPath: dir + "/nope.crt", KeyPath: dir + "/nope.key", Upstream: "127.0.0.1:1"}}}, "No usable certificate"},
+		{"bad upstream", &Server{Hosts: []*Host{{Name: "a.example.com", CertPath: cert, KeyPath: key, Upstream: "127.0.0.1"}}}, "Invalid upstream"},
+		{"bad tls policy", &Server{TLSMinVersion: "2.0", Hosts: []*Host{{Name: "a.example.com", CertPath: cert, KeyPath: key, Upstream: "127.0.0.1:1"}}}, "invalid tls_min_version"},
+		{"missing default host", &Server{DefaultHost: "nope.example.com", Hosts: []*Host{{Name: "a.example.com", CertPath: cert, KeyPath: key, Upstream: "127.0.0.1:1"}}}, "Default host 'nope.example.com' not found"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := c.server
+			server.Name, server.Type, server.Listen = "tls-edge", "tls", "127.0.0.1:0"
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %q, want it to mention %q", err, c.want)
+			}
+			if server.listener != nil {
+				t.Error("listener is non-nil, want no port bound")
+			}
+		})
+	}
+}
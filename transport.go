@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Upstream transport defaults, used when the host leaves the setting out.
+// They are those of http.DefaultTransport, with more idle connections kept
+// per upstream than its 2, which a busy proxy would keep reopening.
+const (
+	upstreamDialTimeout           = 30 * time.Second
+	upstreamKeepAlive             = 30 * time.Second
+	upstreamTLSHandshakeTimeout   = 10 * time.Second
+	upstreamIdleConnTimeout       = 90 * time.Second
+	upstreamExpectContinueTimeout = time.Second
+	upstreamMaxIdleConns          = 32
+)
+
+// buildTransport builds the transport the host's reverse_proxy upstreams
+// are reached with, from its timeout and connection pool settings.
+func (host *Host) buildTransport() error {
+	host.transport = nil
+	durations := []struct {
+		name  string
+		value string
+		d     time.Duration
+	}{
+		{"dial_timeout", host.DialTimeout, upstreamDialTimeout},
+		{"tls_handshake_timeout", host.TLSHandshakeTimeout, upstreamTLSHandshakeTimeout},
+		{"response_header_timeout", host.ResponseHeaderTimeout, 0},
+		{"idle_conn_timeout", host.IdleConnTimeout, upstreamIdleConnTimeout},
+		{"keep_alive", host.KeepAlive, upstreamKeepAlive},
+		{"expect_continue_timeout", host.ExpectContinueTimeout, upstreamExpectContinueTimeout},
+	}
+	for i, setting := range durations {
+		if setting.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(setting.value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid %v '%v' for host: %v", setting.name, setting.value, host.Name)
+		}
+		durations[i].d = d
+	}
+	if host.MaxIdleConns < 0 {
+		return fmt.Errorf("max_idle_conns must not be negative for host: %v", host.Name)
+	}
+	if host.MaxConns < 0 {
+		return fmt.Errorf("max_conns must not be negative for host: %v", host.Name)
+	}
+	tlsConfig, err := host.upstreamTLSConfig()
+	if err != nil {
+		return err
+	}
+	maxIdleConns := upstreamMaxIdleConns
+	if host.MaxIdleConns > 0 {
+		maxIdleConns = host.MaxIdleConns
+	}
+	dialer := &net.Dialer{Timeout: durations[0].d, KeepAlive: durations[4].d}
+	host.transport = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   durations[1].d,
+		ResponseHeaderTimeout: durations[2].d,
+		IdleConnTimeout:       durations[3].d,
+		ExpectContinueTimeout: durations[5].d,
+		MaxIdleConnsPerHost:   maxIdleConns,
+		MaxConnsPerHost:       host.MaxConns,
+	}
+	return nil
+}
+
+// closeIdleConnections closes the idle connections the host's proxies keep
+// to their upstreams.
+func (host *Host) closeIdleConnections() {
+	for _, pool := range host.pools() {
+		for _, u := range pool.upstreams {
+			if transport, ok := u.transport.(*http.Transport); ok {
+				transport.CloseIdleConnections()
+			}
+		}
+	}
+	if host.mirror != nil {
+		for _, t := range host.mirror.targets {
+			if transport, ok := t.proxy.Transport.(*http.Transport); ok {
+				transport.CloseIdleConnections()
+			}
+		}
+	}
+}
+
+// upstreamTLSConfig builds the TLS config https upstreams are verified and
+// reached with, or returns nil for the defaults: the system roots and the
+// server name of the forward URL.
+func (host *Host) upstreamTLSConfig() (*tls.Config, error) {
+	if host.UpstreamCAPath == "" && host.UpstreamCertPath == "" && host.UpstreamKeyPath == "" &&
+		host.UpstreamServerName == "" && !host.UpstreamInsecureSkipVerify {
+		return nil, nil
+	}
+	config := &tls.Config{ServerName: host.UpstreamServerName, MinVersion: tls.VersionTLS12}
+	if host.UpstreamCAPath != "" {
+		pem, err := os.ReadFile(host.UpstreamCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("%v for host: %v", err, host.Name)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in upstream_ca_path '%v' for host: %v", host.UpstreamCAPath, host.Name)
+		}
+	}
+	if (host.UpstreamCertPath == "") != (host.UpstreamKeyPath == "") {
+		return nil, fmt.Errorf("upstream_cert_path and upstream_key_path must be set together for host: %v", host.Name)
+	}
+	if host.UpstreamCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(host.UpstreamCertPath, host.UpstreamKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("%v for host: %v", err, host.Name)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if host.UpstreamInsecureSkipVerify {
+		slog.Warn("Upstream certificates are NOT verified, anyone on the path to the upstreams can read and change the traffic",
+			"host", host.Name, "upstream_insecure_skip_verify", true)
+		config.InsecureSkipVerify = true
+	}
+	return config, nil
+}
+
+// isTimeout reports whether the proxy error err is an upstream taking too
+// long, rather than failing.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// writeProxyError answers a request no upstream could serve, err being
+// why the last one failed: 504 when it timed out, 502 otherwise.
+func writeProxyError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if isTimeout(err) {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		fmt.Fprint(w, `{"err":"gateway timeout"}`)
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+	fmt.Fprint(w, `{"err":"bad gateway"}`)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildTransport(t *testing.T) {
+	host := &Host{Name: "proxy.example.com"}
+	if err := host.buildTransport(); err != nil {
+		t.Fatal(err)
+	}
+	transport := host.transport
+	if transport.ResponseHeaderTimeout != 0 || transport.IdleConnTimeout != upstreamIdleConnTimeout ||
+		transport.MaxIdleConnsPerHost != upstreamMaxIdleConns || transport.MaxConnsPerHost != 0 {
+		t.Errorf("transport = %+v, want the defaults", transport)
+	}
+
+	host = &Host{Name: "proxy.example.com", ResponseHeaderTimeout: "3s", IdleConnTimeout: "1m",
+		TLSHandshakeTimeout: "2s", ExpectContinueTimeout: "500ms", MaxIdleConns: 8, MaxConns: 16}
+	if err := host.buildTransport(); err != nil {
+		t.Fatal(err)
+	}
+	transport = host.transport
+	if transport.ResponseHeaderTimeout != 3*time.Second || transport.IdleConnTimeout != time.Minute ||
+		transport.TLSHandshakeTimeout != 2*time.Second || transport.ExpectContinueTimeout != 500*time.Millisecond ||
+		transport.MaxIdleConnsPerHost != 8 || transport.MaxConnsPerHost != 16 {
+		t.Errorf("transport = %+v, want the host's settings", transport)
+	}
+}
+
+func TestReverseProxyTimeoutIsGatewayTimeout(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: slow.URL, ResponseHeaderTimeout: "50ms",
+	}}}
+	client := startTestServer(t, server)
+
+	resp := get(t, client, "http://proxy.example.com/")
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status = %v, want %v", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+	if got := errField(t, resp); got != "gateway timeout" {
+		t.Errorf("err = %q, want gateway timeout", got)
+	}
+
+	// a refused connection is not a timeout
+	server = &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: deadURL(t),
+	}}}
+	client = startTestServer(t, server)
+	resp = get(t, client, "http://proxy.example.com/")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %v, want %v for a refused connection", resp.StatusCode, http.StatusBadGateway)
+	}
+}
+
+func TestStartRejectsInvalidTransport(t *testing.T) {
+	cases := []struct {
+		name string
+		host *Host
+		want string
+	}{
+		{"bad dial_timeout", &Host{DialTimeout: "fast"}, "invalid dial_timeout 'fast'"},
+		{"zero response_header_timeout", &Host{ResponseHeaderTimeout: "0s"}, "invalid response_header_timeout '0s'"},
+		{"bad keep_alive", &Host{KeepAlive: "-1s"}, "invalid keep_alive '-1s'"},
+		{"negative max_idle_conns", &Host{MaxIdleConns: -1}, "max_idle_conns must not be negative"},
+		{"negative max_conns", &Host{MaxConns: -1}, "max_conns must not be negative"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host := c.host
+			host.Name, host.Type, host.ForwardURLs = "proxy.example.com", "reverse_proxy", "http://127.0.0.1:1"
+			server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %q, want it to mention %q", err, c.want)
+			}
+		})
+	}
+}
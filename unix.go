@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// unixAddress is where requests to a unix socket upstream are sent. The
+// host is a stand-in, the transport dials the socket whatever it is, and
+// the request keeps the client's Host header as for any upstream.
+var unixAddress = &url.URL{Scheme: "http", Host: "localhost"}
+
+// unixTransport is the host's transport dialing the unix socket at path
+// instead of the address of the request URL.
+func (host *Host) unixTransport(path string) *http.Transport {
+	base := host.transport
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	transport := base.Clone()
+	dial := base.DialContext
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dial(ctx, "unix", path)
+	}
+	return transport
+}
+
+// upstreamAddr splits the upstream of a tcp host into the network and
+// address to dial: host:port over tcp, or unix:///path/to.sock.
+func upstreamAddr(upstream string) (network, address string, err error) {
+	if path, ok := strings.CutPrefix(upstream, "unix://"); ok {
+		if !strings.HasPrefix(path, "/") {
+			return "", "", errors.New("unix socket path must be absolute")
+		}
+		return "unix", path, nil
+	}
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		return "", "", err
+	}
+	return "tcp", upstream, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// socketPath returns a path for a unix socket in a fresh directory, short
+// enough for the limit on socket path lengths.
+func socketPath(t *testing.T, name string) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "goweb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, name)
+}
+
+// unixEchoServer is echoServer listening on a unix socket.
+func unixEchoServer(t *testing.T, name string) string {
+	t.Helper()
+	path := socketPath(t, name+".sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"upstream": name, "host": r.Host, "path": r.URL.Path})
+	}))
+	srv.Listener = listener
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return path
+}
+
+func TestReverseProxyUnixSocket(t *testing.T) {
+	logs := captureAccessLog(t)
+	path := unixEchoServer(t, "app")
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", AccessLog: true, Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: "unix://" + path,
+		HealthCheckPath: "/healthz", HealthCheckInterval: "20ms",
+	}}}
+	client := startTestServer(t, server)
+
+	resp := get(t, client, "http://proxy.example.com/hello")
+	var body map[string]string
+	json.Unmarshal([]byte(bodyString(t, resp)), &body)
+	if body["upstream"] != "app" || body["host"] != "proxy.example.com" || body["path"] != "/hello" {
+		t.Errorf("upstream saw %v, want app to get /hello for proxy.example.com", body)
+	}
+	record := parseRecord(t, logs.records()[0])
+	if record["upstream"] != "unix://"+path {
+		t.Errorf("access record upstream = %v, want unix://%v", record["upstream"], path)
+	}
+	waitFor(t, "a passed health check", func() bool {
+		states := server.upstreamStates()
+		return len(states) == 1 && states[0].LastCheck != nil && states[0].LastError == "" && states[0].URL == "unix://"+path
+	})
+}
+
+func TestReverseProxyUnixSocketKeepsLocalhostRedirects(t *testing.T) {
+	path := socketPath(t, "app.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.RedirectHandler("http://localhost/elsewhere", http.StatusFound))
+	srv.Listener = listener
+	srv.Start()
+	t.Cleanup(srv.Close)
+	client := startTestServer(t, &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: "unix://" + path,
+	}}})
+
+	resp := get(t, client, "http://proxy.example.com/")
+	if got := resp.Header.Get("Location"); got != "http://localhost/elsewhere" {
+		t.Errorf("Location = %q, want a redirect to localhost passed on as the upstream sent it", got)
+	}
+}
+
+func TestTCPProxyUnixSocket(t *testing.T) {
+	path := socketPath(t, "echo.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	server := &Server{Name: "tcp-edge", Type: "tcp", Listen: "127.0.0.1:0", Hosts: []*Host{{Name: "db", Upstream: "unix://" + path}}}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() = %v, want nil", err)
+	}
+	t.Cleanup(func() { server.Shutdown() })
+
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte("ping"))
+	conn.(*net.TCPConn).CloseWrite()
+	if got, _ := io.ReadAll(conn); string(got) != "ping" {
+		t.Errorf("read %q, want %q through the socket", got, "ping")
+	}
+}
+
+func TestStartRejectsInvalidUnixUpstreams(t *testing.T) {
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: "unix://app.sock",
+	}}}
+	if err := server.Start(); err == nil || !strings.Contains(err.Error(), "invalid forward URL 'unix://app.sock'") {
+		server.Shutdown()
+		t.Errorf("Start() = %v, want the relative socket path rejected", err)
+	}
+
+	server = &Server{Name: "tcp-edge", Type: "tcp", Listen: "127.0.0.1:0", Hosts: []*Host{{Name: "db", Upstream: "unix://db.sock"}}}
+	if err := server.Start(); err == nil || !strings.Contains(err.Error(), "unix socket path must be absolute") {
+		server.Shutdown()
+		t.Errorf("Start() = %v, want the relative socket path rejected", err)
+	}
+}
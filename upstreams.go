@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Health check defaults, used when the host leaves the setting out.
+const (
+	healthCheckInterval = 10 * time.Second
+	healthCheckTimeout  = 5 * time.Second
+	healthCheckRise     = 2
+	healthCheckFall     = 3
+)
+
+// healthCheckClient probes upstreams. Redirects are not followed: a 3xx is
+// the answer of the upstream itself.
+var healthCheckClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// upstreamPool is the upstreams of a reverse_proxy host or route, and the
+// host's lb_policy choosing between them.
+type upstreamPool struct {
+	upstreams []*upstream
+	policy    string
+	key       string        // lb_key
+	next      atomic.Uint64 // round_robin position
+	ring      []ringNode    // for consistent_hash, sorted by hash
+	retry     *retryPolicy  // nil when the host doesn't retry
+	sticky    *stickyCookie // nil without sticky sessions
+	stickyID  string        // the pool's part of sticky cookie pins
+	mirror    *mirror       // nil when the host doesn't mirror
+	mu        sync.Mutex    // guards the scores of weighted
+}
+
+// upstream is one forward URL with the proxy serving it and its health as
+// seen by the active health checks and by the requests it serves.
+type upstream struct {
+	target    *url.URL
+	address   *url.URL          // where requests go: target, or a stand-in for a unix socket
+	transport http.RoundTripper // nil for the default
+	stickyID  string            // the sticky cookie value pinning clients to it
+	proxy     *httputil.ReverseProxy
+	breaker   *circuitBreaker // nil when the host disables it
+	weight    int             // from ;weight=N in forward_urls, 1 by default
+	score     int             // smooth weighted round robin state, guarded by the pool's mu
+	active    atomic.Int64    // requests in flight
+	down      atomic.Bool     // out of the rotation, see record
+
+	mu        sync.Mutex // guards the health check and circuit state below
+	successes int        // consecutive passed checks
+	failures  int        // consecutive failed checks
+	lastCheck time.Time
+	lastErr   string
+	fails     int           // consecutive failed requests
+	openUntil time.Time     // the circuit is open until then, zero when closed
+	backoff   time.Duration // how long the circuit last opened for
+	trial     bool          // the half-open circuit's trial request is in flight
+}
+
+// healthCheck is a host's parsed health_check_* settings.
+type healthCheck struct {
+	path     string
+	interval time.Duration
+	timeout  time.Duration
+	status   int // 0 for any 2xx
+	rise     int
+	fall     int
+}
+
+// ServeHTTP proxies r to the upstream its sticky cookie pins it to, if
+// that one is available, or else to the one pick chooses. Idempotent requests
+// failing by the host's retry policy are tried again on other upstreams,
+// each one at most once. A copy of r goes to the host's mirrors first.
+func (pool *upstreamPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = pool.mirror.send(r)
+	attempts := 1
+	var body []byte
+	if pool.retry != nil && idempotentMethods[r.Method] {
+		var ok bool
+		if body, ok = replayableBody(r, pool.retry.bodyLimit); ok {
+			attempts += pool.retry.retries
+		}
+	}
+	u := pool.sticky.pinned(r, pool)
+	if u == nil {
+		u = pool.pick(r)
+	}
+	tried := []*upstream{u}
+	pin := ""
+	for {
+		pin = pool.sticky.pin(w, r, pool, u, pin)
+		attempt := &proxyAttempt{retryable: len(tried) < attempts, pick: func() *upstream {
+			return pool.pickFrom(r, pool.untried(time.Now(), tried))
+		}}
+		req := r.WithContext(context.WithValue(r.Context(), attemptKey{}, attempt))
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		func() {
+			// ReverseProxy panics with http.ErrAbortHandler when copying
+			// a response body fails
+			u.active.Add(1)
+			defer u.active.Add(-1)
+			u.proxy.ServeHTTP(w, req)
+		}()
+		if attempt.err == nil {
+			break
+		}
+		u = attempt.next
+		tried = append(tried, u)
+	}
+	addAccessAttrs(w, "upstream", u.target.String(), "attempts", len(tried))
+}
+
+// pick chooses the upstream for r by the pool's policy among the available
+// upstreams, so clients of an upstream that is down or ejected move to the
+// remaining ones. When none is available it picks among all of them, as a
+// failing health check endpoint is more likely than every upstream being
+// down.
+func (pool *upstreamPool) pick(r *http.Request) *upstream {
+	if u := pool.pickFrom(r, pool.available(time.Now())); u != nil {
+		return u
+	}
+	return pool.choose(r, pool.upstreams)
+}
+
+// pickFrom chooses one of candidates for r, or nil when none can take it.
+func (pool *upstreamPool) pickFrom(r *http.Request, candidates []*upstream) *upstream {
+	now := time.Now()
+	for len(candidates) > 0 {
+		u := pool.choose(r, candidates)
+		if u.acquire(now) {
+			return u
+		}
+		// another request took the trial of this half-open upstream
+		candidates = slices.DeleteFunc(slices.Clone(candidates), func(c *upstream) bool { return c == u })
+	}
+	return nil
+}
+
+// untried returns the available upstreams not in tried.
+func (pool *upstreamPool) untried(now time.Time, tried []*upstream) []*upstream {
+	return slices.DeleteFunc(slices.Clone(pool.available(now)), func(u *upstream) bool {
+		return slices.Contains(tried, u)
+	})
+}
+
+// available returns the upstreams that can take a request at now. It copies
+// only once one is found unavailable, so the common case doesn't allocate.
+func (pool *upstreamPool) available(now time.Time) []*upstream {
+	for i, u := range pool.upstreams {
+		if u.available(now) {
+			continue
+		}
+		available := make([]*upstream, 0, len(pool.upstreams)-1)
+		available = append(available, pool.upstreams[:i]...)
+		for _, u := range pool.upstreams[i+1:] {
+			if u.available(now) {
+				available = append(available, u)
+			}
+		}
+		return available
+	}
+	return pool.upstreams
+}
+
+// buildHealthCheck validates the host's health_check_* settings. Checks are
+// off unless health_check_path is set.
+func (host *Host) buildHealthCheck() error {
+	host.healthCheck = nil
+	if host.HealthCheckPath == "" {
+		return nil
+	}
+	if !strings.HasPrefix(host.HealthCheckPath, "/") {
+		return fmt.Errorf("health_check_path '%v' must start with / for host: %v", host.HealthCheckPath, host.Name)
+	}
+	check := &healthCheck{
+		path:     host.HealthCheckPath,
+		interval: healthCheckInterval,
+		timeout:  healthCheckTimeout,
+		status:   host.HealthCheckStatus,
+		rise:     healthCheckRise,
+		fall:     healthCheckFall,
+	}
+	for _, setting := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"health_check_interval", host.HealthCheckInterval, &check.interval},
+		{"health_check_timeout", host.HealthCheckTimeout, &check.timeout},
+	} {
+		if setting.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(setting.value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid %v '%v' for host: %v", setting.name, setting.value, host.Name)
+		}
+		*setting.dst = d
+	}
+	if check.status != 0 && (check.status < 100 || check.status > 599) {
+		return fmt.Errorf("invalid health_check_status %v for host: %v", check.status, host.Name)
+	}
+	if host.HealthCheckRise < 0 || host.HealthCheckFall < 0 {
+		return fmt.Errorf("health_check_rise and health_check_fall must not be negative for host: %v", host.Name)
+	}
+	if host.HealthCheckRise > 0 {
+		check.rise = host.HealthCheckRise
+	}
+	if host.HealthCheckFall > 0 {
+		check.fall = host.HealthCheckFall
+	}
+	host.healthCheck = check
+	return nil
+}
+
+// pools returns the upstream pools of the host's own settings, or its
+// upstream groups, and its routes.
+func (host *Host) pools() []*upstreamPool {
+	var pools []*upstreamPool
+	if host.ownRoute != nil && host.ownRoute.forwardPool != nil {
+		pools = append(pools, host.ownRoute.forwardPool)
+	}
+	if host.ownRoute != nil && host.ownRoute.groups != nil {
+		pools = append(pools, host.ownRoute.groups.pools...)
+	}
+	for _, route := range host.Routes {
+		if route.forwardPool != nil {
+			pools = append(pools, route.forwardPool)
+		}
+	}
+	return pools
+}
+
+// startHealthChecks starts checking every upstream of the enabled hosts
+// with health checks, until done is closed.
+func (this *Server) startHealthChecks(done <-chan struct{}) {
+	for _, host := range this.Hosts {
+		if host.Disabled || host.healthCheck == nil {
+			continue
+		}
+		for _, pool := range host.pools() {
+			for _, u := range pool.upstreams {
+				go this.checkUpstream(host, host.healthCheck, u, done)
+			}
+		}
+	}
+}
+
+// checkUpstream probes u every interval, the first time right away.
+func (this *Server) checkUpstream(host *Host, check *healthCheck, u *upstream, done <-chan struct{}) {
+	ticker := time.NewTicker(check.interval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), check.timeout)
+		err := check.probe(ctx, u)
+		cancel()
+		if changed, down := u.record(err, check); changed {
+			logger := slog.With("server", this.Name, "host", host.Name, "upstream", u.target.String())
+			if down {
+				logger.Warn("Upstream down", "err", err)
+			} else {
+				logger.Info("Upstream up")
+			}
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe requests the health check path on u, reaching it as its proxy does.
+func (check *healthCheck) probe(ctx context.Context, u *upstream) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.address.JoinPath(check.path).String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "goweb health check")
+	client := healthCheckClient
+	if u.transport != nil {
+		client = &http.Client{Transport: u.transport, CheckRedirect: healthCheckClient.CheckRedirect}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	// drain a little so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if check.status == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299) ||
+		check.status != 0 && resp.StatusCode != check.status {
+		return fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// record counts the result of a check, taking the upstream out of the
+// rotation after fall consecutive failures and back in after rise
+// consecutive successes. It reports whether that changed, and the new state.
+func (u *upstream) record(err error, check *healthCheck) (changed, down bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.lastCheck = time.Now()
+	down = u.down.Load()
+	if err != nil {
+		u.lastErr = err.Error()
+		u.successes = 0
+		u.failures++
+		if !down && u.failures >= check.fall {
+			u.down.Store(true)
+			return true, true
+		}
+	} else {
+		u.lastErr = ""
+		u.failures = 0
+		u.successes++
+		if down && u.successes >= check.rise {
+			u.down.Store(false)
+			return true, false
+		}
+	}
+	return false, down
+}
+
+// upstreamState is one upstream as reported by the admin API.
+type upstreamState struct {
+	Server    string     `json:"server"`
+	Host      string     `json:"host"`
+	Route     string     `json:"route,omitempty"` // the route's prefix, exact path or regex; empty for the host's own
+	Group     string     `json:"group,omitempty"` // the upstream group, for hosts with upstream_groups
+	URL       string     `json:"url"`
+	Healthy   bool       `json:"healthy"`
+	Checked   bool       `json:"checked"` // false when the host has no health checks
+	LastCheck *time.Time `json:"last_check,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	Circuit   string     `json:"circuit"` // closed, open, half_open or off
+	Fails     int        `json:"fails"`   // consecutive failed requests
+	Weight    int        `json:"weight"`
+	Active    int64      `json:"active"` // requests in flight
+}
+
+// upstreamStates reports every upstream of the server's running
+// reverse_proxy hosts and routes.
+func (this *Server) upstreamStates() []upstreamState {
+	states := []upstreamState{}
+	if this.done == nil {
+		// not running
+		return states
+	}
+	for _, host := range this.Hosts {
+		if host.Disabled {
+			continue
+		}
+		add := func(route, group string, pool *upstreamPool) {
+			if pool == nil {
+				return
+			}
+			for _, u := range pool.upstreams {
+				state := upstreamState{
+					Server:  this.Name,
+					Host:    host.Name,
+					Route:   route,
+					Group:   group,
+					URL:     u.target.String(),
+					Healthy: !u.down.Load(),
+					Checked: host.healthCheck != nil,
+					Weight:  u.weight,
+					Active:  u.active.Load(),
+				}
+				u.mu.Lock()
+				if !u.lastCheck.IsZero() {
+					lastCheck := u.lastCheck
+					state.LastCheck = &lastCheck
+				}
+				state.LastError = u.lastErr
+				state.Circuit = u.circuit(time.Now())
+				state.Fails = u.fails
+				u.mu.Unlock()
+				states = append(states, state)
+			}
+		}
+		if host.ownRoute != nil {
+			add("", "", host.ownRoute.forwardPool)
+			if groups := host.ownRoute.groups; groups != nil {
+				for i, name := range groups.names {
+					add("", name, groups.pools[i])
+				}
+			}
+		}
+		for _, route := range host.Routes {
+			add(route.Prefix+route.Exact+route.Regex, "", route.forwardPool)
+		}
+	}
+	return states
+}
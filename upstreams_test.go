@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// checkedServer is an upstream answering with its name, whose /healthz
+// fails while sick is set.
+func checkedServer(t *testing.T, name string) (*httptest.Server, *atomic.Bool) {
+	t.Helper()
+	sick := new(atomic.Bool)
+	srv := echoServer(t, name, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path == "/healthz" && sick.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true
+		}
+		return false
+	})
+	return srv, sick
+}
+
+func TestHealthChecksTakeFailingUpstreamsOut(t *testing.T) {
+	one, oneSick := checkedServer(t, "one")
+	two, _ := checkedServer(t, "two")
+	// put the upstream failing its checks where the client's IP hash lands
+	urls := []string{two.URL, two.URL}
+	urls[hashIndex("127.0.0.1", 2)] = one.URL
+	oneSick.Store(true)
+
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: strings.Join(urls, " "),
+		HealthCheckPath: "/healthz", HealthCheckInterval: "10ms", HealthCheckRise: 2, HealthCheckFall: 1,
+	}}}
+	client := startTestServer(t, server)
+
+	waitFor(t, "the sick upstream to leave the rotation", func() bool {
+		return upstreamOf(t, client, "http://proxy.example.com/") == "two"
+	})
+	oneSick.Store(false)
+	waitFor(t, "the upstream to come back", func() bool {
+		return upstreamOf(t, client, "http://proxy.example.com/") == "one"
+	})
+}
+
+func TestHealthChecksCoverRoutes(t *testing.T) {
+	one, oneSick := checkedServer(t, "one")
+	two, _ := checkedServer(t, "two")
+	urls := []string{two.URL, two.URL}
+	urls[hashIndex("127.0.0.1", 2)] = one.URL
+	oneSick.Store(true)
+
+	host := redirectHost("proxy.example.com")
+	host.HealthCheckPath, host.HealthCheckInterval, host.HealthCheckFall = "/healthz", "10ms", 1
+	host.Routes = []*Route{{Prefix: "/api/", Type: "reverse_proxy", ForwardURLs: strings.Join(urls, " ")}}
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+	client := startTestServer(t, server)
+
+	waitFor(t, "the sick route upstream to leave the rotation", func() bool {
+		return upstreamOf(t, client, "http://proxy.example.com/api/") == "two"
+	})
+}
+
+func TestUpstreamPoolFallsBackWhenAllDown(t *testing.T) {
+	pool := &upstreamPool{upstreams: []*upstream{{}, {}}}
+	for _, u := range pool.upstreams {
+		u.down.Store(true)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if pool.pick(r) == nil {
+		t.Fatal("pick() = nil, want an upstream even with all of them down")
+	}
+	pool.upstreams[1].down.Store(false)
+	for range 10 {
+		if got := pool.pick(r); got != pool.upstreams[1] {
+			t.Fatal("pick() chose a down upstream with a healthy one left")
+		}
+	}
+}
+
+func TestUpstreamRecordRiseAndFall(t *testing.T) {
+	check := &healthCheck{rise: 2, fall: 3}
+	u := &upstream{}
+	fail := http.ErrHandlerTimeout
+	steps := []struct {
+		err         error
+		wantChanged bool
+		wantDown    bool
+	}{
+		{fail, false, false},
+		{fail, false, false},
+		{nil, false, false}, // a success resets the failures
+		{fail, false, false},
+		{fail, false, false},
+		{fail, true, true},
+		{nil, false, true},
+		{fail, false, true}, // a failure resets the successes
+		{nil, false, true},
+		{nil, true, false},
+	}
+	for i, step := range steps {
+		changed, down := u.record(step.err, check)
+		if changed != step.wantChanged || down != step.wantDown {
+			t.Errorf("check %v: record() = %v, %v, want %v, %v", i+1, changed, down, step.wantChanged, step.wantDown)
+		}
+	}
+}
+
+func TestStartRejectsInvalidHealthChecks(t *testing.T) {
+	cases := []struct {
+		name string
+		host *Host
+		want string
+	}{
+		{"relative path", &Host{HealthCheckPath: "healthz"}, "must start with /"},
+		{"bad interval", &Host{HealthCheckPath: "/healthz", HealthCheckInterval: "often"}, "invalid health_check_interval 'often'"},
+		{"zero timeout", &Host{HealthCheckPath: "/healthz", HealthCheckTimeout: "0s"}, "invalid health_check_timeout '0s'"},
+		{"bad status", &Host{HealthCheckPath: "/healthz", HealthCheckStatus: 1000}, "invalid health_check_status 1000"},
+		{"negative fall", &Host{HealthCheckPath: "/healthz", HealthCheckFall: -1}, "must not be negative"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host := c.host
+			host.Name, host.Type, host.ForwardURLs = "proxy.example.com", "reverse_proxy", "http://127.0.0.1:1"
+			server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %q, want it to mention %q", err, c.want)
+			}
+			if server.listener != nil {
+				t.Error("listener is non-nil, want no port bound")
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKeyPair writes cert and its ECDSA key into dir as PEM files.
+func writeKeyPair(t *testing.T, dir string, cert tls.Certificate) (certPath, keyPath string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath = filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+// tlsUpstream is an https upstream serving a certificate for
+// backend.internal, which caPath trusts, and requiring a client certificate
+// issued by the CA clientCAPath.
+func tlsUpstream(t *testing.T, dir, clientCAPath string) (srv *httptest.Server, caPath string) {
+	t.Helper()
+	caPath, keyPath := writeSelfSignedCert(t, dir, "backend.internal")
+	cert, err := tls.LoadX509KeyPair(caPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAPEM, err := os.ReadFile(clientCAPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs.AppendCertsFromPEM(clientCAPEM)
+	srv = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"upstream": "backend", "client": r.TLS.PeerCertificates[0].Subject.CommonName})
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, caPath
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCAPath, clientCert := writeClientCA(t, dir, "goweb proxy")
+	certPath, keyPath := writeKeyPair(t, dir, clientCert)
+	backend, caPath := tlsUpstream(t, dir, clientCAPath)
+
+	cases := []struct {
+		name string
+		host *Host
+		want int
+	}{
+		{"verified with a client certificate", &Host{UpstreamCAPath: caPath, UpstreamServerName: "backend.internal",
+			UpstreamCertPath: certPath, UpstreamKeyPath: keyPath}, http.StatusOK},
+		{"system roots", &Host{UpstreamCertPath: certPath, UpstreamKeyPath: keyPath}, http.StatusBadGateway},
+		{"name of the forward URL", &Host{UpstreamCAPath: caPath, UpstreamCertPath: certPath, UpstreamKeyPath: keyPath}, http.StatusBadGateway},
+		{"no client certificate", &Host{UpstreamCAPath: caPath, UpstreamServerName: "backend.internal"}, http.StatusBadGateway},
+		{"not verified", &Host{UpstreamInsecureSkipVerify: true, UpstreamCertPath: certPath, UpstreamKeyPath: keyPath}, http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host := c.host
+			host.Name, host.Type, host.ForwardURLs = "proxy.example.com", "reverse_proxy", backend.URL
+			client := startTestServer(t, &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{host}})
+			resp := get(t, client, "http://proxy.example.com/")
+			body := bodyString(t, resp)
+			if resp.StatusCode != c.want {
+				t.Fatalf("status = %v, want %v", resp.StatusCode, c.want)
+			}
+			if c.want == http.StatusOK && !strings.Contains(body, `"client":"goweb proxy"`) {
+				t.Errorf("body = %v, want the upstream to see the client certificate", body)
+			}
+		})
+	}
+}
+
+func TestUpstreamTLSHealthChecks(t *testing.T) {
+	dir := t.TempDir()
+	clientCAPath, clientCert := writeClientCA(t, dir, "goweb proxy")
+	certPath, keyPath := writeKeyPair(t, dir, clientCert)
+	backend, caPath := tlsUpstream(t, dir, clientCAPath)
+
+	server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{{
+		Name: "proxy.example.com", Type: "reverse_proxy", ForwardURLs: backend.URL,
+		UpstreamCAPath: caPath, UpstreamServerName: "backend.internal", UpstreamCertPath: certPath, UpstreamKeyPath: keyPath,
+		HealthCheckPath: "/", HealthCheckInterval: "20ms",
+	}}}
+	startTestServer(t, server)
+	waitFor(t, "a passed health check", func() bool {
+		states := server.upstreamStates()
+		return len(states) == 1 && states[0].LastCheck != nil && states[0].LastError == ""
+	})
+}
+
+func TestStartRejectsInvalidUpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.txt")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0600)
+	cases := []struct {
+		name string
+		host *Host
+		want string
+	}{
+		{"missing CA", &Host{UpstreamCAPath: filepath.Join(dir, "missing.pem")}, "missing.pem"},
+		{"CA without certificates", &Host{UpstreamCAPath: notPEM}, "no certificates found in upstream_ca_path"},
+		{"cert without key", &Host{UpstreamCertPath: notPEM}, "upstream_cert_path and upstream_key_path must be set together"},
+		{"bad key pair", &Host{UpstreamCertPath: notPEM, UpstreamKeyPath: notPEM}, "for host: proxy.example.com"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host := c.host
+			host.Name, host.Type, host.ForwardURLs = "proxy.example.com", "reverse_proxy", "https://127.0.0.1:1"
+			server := &Server{Name: "edge", Type: "http", Listen: "127.0.0.1:0", Hosts: []*Host{host}}
+			err := server.Start()
+			if err == nil {
+				server.Shutdown()
+				t.Fatal("Start() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %q, want it to mention %q", err, c.want)
+			}
+		})
+	}
+}